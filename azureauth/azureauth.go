@@ -0,0 +1,70 @@
+// Package azureauth authenticates pgds connections to Azure Database for
+// PostgreSQL with Microsoft Entra ID (Azure AD) access tokens, so that
+// deployments using a managed identity, such as workload identity on AKS, need
+// no password.
+//
+// The user of the connection string must be the name of the Entra ID role
+// created for the identity, and the connections must use TLS:
+//
+//	cred, err := azidentity.NewDefaultAzureCredential(nil)
+//	d, err := pgds.NewDatastore(ctx, "postgres://my-identity@myserver.postgres.database.azure.com/ipfs?sslmode=verify-full",
+//		pgds.BeforeConnect(azureauth.BeforeConnect(cred)))
+package azureauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/jackc/pgx/v5"
+)
+
+// Scope is the scope of the access tokens accepted by Azure Database for
+// PostgreSQL.
+const Scope = "https://ossrdbms-aad.database.windows.net/.default"
+
+// refreshBefore is how long before they expire tokens are replaced.
+const refreshBefore = 5 * time.Minute
+
+// BeforeConnect returns a hook for the pgds.BeforeConnect option that sets the
+// password of each new connection to an access token obtained from cred.
+// Tokens are requested again when they are about to expire.
+func BeforeConnect(cred azcore.TokenCredential) func(context.Context, *pgx.ConnConfig) error {
+	t := &tokens{cred: cred}
+	return t.beforeConnect
+}
+
+// tokens caches the current access token.
+type tokens struct {
+	cred azcore.TokenCredential
+
+	mu      sync.Mutex
+	current azcore.AccessToken
+}
+
+func (t *tokens) beforeConnect(ctx context.Context, config *pgx.ConnConfig) error {
+	token, err := t.get(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	config.Password = token
+	return nil
+}
+
+func (t *tokens) get(ctx context.Context, now time.Time) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current.Token != "" && now.Before(t.current.ExpiresOn.Add(-refreshBefore)) {
+		return t.current.Token, nil
+	}
+	token, err := t.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{Scope}})
+	if err != nil {
+		return "", fmt.Errorf("getting Entra ID access token: %w", err)
+	}
+	t.current = token
+	return token.Token, nil
+}
@@ -0,0 +1,72 @@
+package azureauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/jackc/pgx/v5"
+)
+
+type testCredential struct {
+	requested int
+	lifetime  time.Duration
+	err       error
+}
+
+func (c *testCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if c.err != nil {
+		return azcore.AccessToken{}, c.err
+	}
+	if len(opts.Scopes) != 1 || opts.Scopes[0] != Scope {
+		return azcore.AccessToken{}, fmt.Errorf("unexpected scopes %v", opts.Scopes)
+	}
+	c.requested++
+	return azcore.AccessToken{
+		Token:     fmt.Sprintf("token-%d", c.requested),
+		ExpiresOn: time.Now().Add(c.lifetime),
+	}, nil
+}
+
+func TestBeforeConnect(t *testing.T) {
+	cred := &testCredential{lifetime: time.Hour}
+	config, err := pgx.ParseConfig("postgres://my-identity@myserver.postgres.database.azure.com/ipfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeConnect := BeforeConnect(cred)
+	for i := 0; i < 2; i++ {
+		err = beforeConnect(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the token is reused until it is about to expire
+	if config.Password != "token-1" || cred.requested != 1 {
+		t.Fatalf("unexpected password %s after %d requests", config.Password, cred.requested)
+	}
+
+	tokens := &tokens{cred: cred}
+	now := time.Now()
+	_, err = tokens.get(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.get(context.Background(), now.Add(time.Hour-refreshBefore+time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token-3" {
+		t.Fatalf("expected the token to be refreshed, got %s", token)
+	}
+
+	cred.err = errors.New("no identity")
+	err = BeforeConnect(cred)(context.Background(), config)
+	if !errors.Is(err, cred.err) {
+		t.Fatalf("expected the credential error, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// backoff returns how long to wait before the given retry attempt, starting
+// at zero: the delay doubles from base on each attempt up to max, and is
+// jittered so that clients that failed together do not retry together.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 32 && base<<attempt < max {
+		delay = base << attempt
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// connect ensures the database is reachable, retrying with backoff for up to
+// the given duration while it is not. Errors reported by a reachable server,
+// such as an authentication failure, are not retried unless they are
+// transient.
+func connect(ctx context.Context, pool *pgxpool.Pool, retryFor time.Duration) error {
+	deadline := time.Now().Add(retryFor)
+	for attempt := 0; ; attempt++ {
+		err := pool.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && !retriable(err) {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		// the last attempt is made at the deadline
+		delay := backoff(attempt, 100*time.Millisecond, 5*time.Second)
+		if delay > remaining {
+			delay = remaining
+		}
+		if sleep(ctx, delay) != nil {
+			return err
+		}
+	}
+}
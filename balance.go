@@ -0,0 +1,134 @@
+package pgds
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// balancer spreads the connections of a pool over the servers of a
+// YugabyteDB cluster, which all accept reads and writes. The servers are
+// listed by yb_servers() on one of them, again once the list is older than
+// the refresh interval, so that servers added to or removed from the cluster
+// are followed.
+type balancer struct {
+	refresh time.Duration
+
+	mu        sync.Mutex
+	servers   []string // host:port
+	refreshed time.Time
+	conns     map[string]int
+	next      int
+}
+
+func newBalancer(refresh time.Duration) *balancer {
+	return &balancer{refresh: refresh, conns: make(map[string]int)}
+}
+
+// beforeConnect points a new connection at the server with the fewest
+// connections of the pool.
+func (b *balancer) beforeConnect(ctx context.Context, config *pgx.ConnConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.refreshed) > b.refresh {
+		// the list is left as it was if no server can be reached, the
+		// connection will then fail or use the hosts of the connection string
+		servers, err := listServers(ctx, config)
+		b.refreshed = time.Now()
+		if err == nil && len(servers) > 0 {
+			b.servers = servers
+		}
+	}
+
+	server := b.pick()
+	if server == "" {
+		return nil
+	}
+	host, p, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return err
+	}
+	if config.TLSConfig != nil && config.TLSConfig.ServerName != "" {
+		config.TLSConfig = config.TLSConfig.Clone()
+		config.TLSConfig.ServerName = host
+	}
+	config.Host = host
+	config.Port = uint16(port)
+	return nil
+}
+
+// pick returns the server with the fewest connections, taking the servers in
+// turn when they have as many.
+func (b *balancer) pick() string {
+	var best string
+	for i := range b.servers {
+		server := b.servers[(b.next+i)%len(b.servers)]
+		if best == "" || b.conns[server] < b.conns[best] {
+			best = server
+		}
+	}
+	b.next++
+	return best
+}
+
+func (b *balancer) opened(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns[server]++
+}
+
+func (b *balancer) closed(server string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns[server]--
+}
+
+func (b *balancer) afterConnect(ctx context.Context, conn *pgx.Conn) error {
+	b.opened(serverOf(conn))
+	return nil
+}
+
+func (b *balancer) beforeClose(conn *pgx.Conn) {
+	b.closed(serverOf(conn))
+}
+
+// serverOf returns the host and port a connection was configured with.
+func serverOf(conn *pgx.Conn) string {
+	config := conn.Config()
+	return net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+}
+
+// listServers returns the servers of the cluster, over a connection of its
+// own made with the given configuration.
+func listServers(ctx context.Context, config *pgx.ConnConfig) ([]string, error) {
+	conn, err := pgx.ConnectConfig(ctx, config.Copy())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, "SELECT host, port FROM yb_servers()")
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for rows.Next() {
+		var host string
+		var port int64
+		err = rows.Scan(&host, &port)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return servers, rows.Err()
+}
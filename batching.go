@@ -3,47 +3,167 @@ package pgds
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	ds "github.com/ipfs/go-datastore"
-	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v5"
 )
 
+// batchOp is a queued update. Only the last update queued for a key is kept.
+type batchOp struct {
+	value  []byte
+	delete bool
+}
+
 type batch struct {
-	ds    *Datastore
-	batch *pgx.Batch
+	ds   *Datastore
+	ops  map[ds.Key]batchOp
+	size int // bytes of queued values
 }
 
-// Batch creates a set of deferred updates to the database.
+// Batch creates a set of deferred updates to the database. The updates are
+// applied atomically, in a single transaction, when the batch is committed.
+// Repeated updates to the same key are collapsed into the last one. The
+// returned batch also has Get, Has and GetSize methods that observe the
+// updates queued in it. If the
+// BatchMaxOps or BatchMaxBytes options are set, the updates queued so far are
+// committed whenever the batch grows beyond them.
 func (d *Datastore) Batch(_ context.Context) (ds.Batch, error) {
-	return &batch{ds: d, batch: &pgx.Batch{}}, nil
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	return &batch{ds: d, ops: map[ds.Key]batchOp{}}, nil
 }
 
 func (b *batch) Put(ctx context.Context, key ds.Key, value []byte) error {
-	b.batch.Queue("BEGIN")
-	sql := fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = $2", b.ds.table)
-	b.batch.Queue(sql, key.String(), value)
-	b.batch.Queue("COMMIT")
-	return nil
+	if err := b.ds.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	b.queue(key, batchOp{value: value})
+	return b.maybeFlush(ctx)
 }
 
 func (b *batch) Delete(ctx context.Context, key ds.Key) error {
-	b.batch.Queue("BEGIN")
-	b.batch.Queue(fmt.Sprintf("DELETE FROM %s WHERE key = $1", b.ds.table), key.String())
-	b.batch.Queue("COMMIT")
+	b.queue(key, batchOp{delete: true})
+	return b.maybeFlush(ctx)
+}
+
+func (b *batch) queue(key ds.Key, op batchOp) {
+	if prev, ok := b.ops[key]; ok {
+		b.size -= len(prev.value)
+	}
+	b.ops[key] = op
+	b.size += len(op.value)
+}
+
+// Get retrieves the value for the given key, taking into account the updates
+// queued in the batch that have not yet been committed.
+func (b *batch) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if op, ok := b.ops[key]; ok {
+		if op.delete {
+			return nil, ds.ErrNotFound
+		}
+		return op.value, nil
+	}
+	return b.ds.Get(ctx, key)
+}
+
+// Has determines if a value for the given key exists, taking into account the
+// updates queued in the batch that have not yet been committed.
+func (b *batch) Has(ctx context.Context, key ds.Key) (bool, error) {
+	if op, ok := b.ops[key]; ok {
+		return !op.delete, nil
+	}
+	return b.ds.Has(ctx, key)
+}
+
+// GetSize determines the size of the value for the given key, taking into
+// account the updates queued in the batch that have not yet been committed.
+func (b *batch) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	if op, ok := b.ops[key]; ok {
+		if op.delete {
+			return -1, ds.ErrNotFound
+		}
+		return len(op.value), nil
+	}
+	return b.ds.GetSize(ctx, key)
+}
+
+// maybeFlush commits the queued updates if the batch has grown beyond the
+// configured thresholds.
+func (b *batch) maybeFlush(ctx context.Context) error {
+	if (b.ds.batchMaxOps > 0 && len(b.ops) >= b.ds.batchMaxOps) ||
+		(b.ds.batchMaxBytes > 0 && b.size >= b.ds.batchMaxBytes) {
+		return b.Commit(ctx)
+	}
 	return nil
 }
 
 func (b *batch) Commit(ctx context.Context) error {
-	res := b.ds.pool.SendBatch(ctx, b.batch)
-	defer res.Close()
+	return b.ds.do(ctx, opBatch, "", b.commit)
+}
+
+func (b *batch) commit(ctx context.Context) error {
+	// updates are applied in key order so that concurrent batches lock rows
+	// in the same order and cannot deadlock
+	keys := make([]ds.Key, 0, len(b.ops))
+	for k := range b.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	pgxBatch := &pgx.Batch{}
+	var large []ds.Key
+	for _, k := range keys {
+		op := b.ops[k]
+		// the updates of all the tables are applied in the same transaction
+		td := b.ds.route(k)
+		tk := td.prefixKey(k)
+		if !op.delete && td.large(op.value) {
+			// values stored in large objects are written after the batch
+			large = append(large, k)
+			continue
+		}
+		if op.delete {
+			sql := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", td.table, td.keyCol)
+			pgxBatch.Queue(b.ds.commentSQL(ctx, opBatch, sql), td.keyArg(tk.String()))
+		} else {
+			sql, args, err := td.putQuery(tk, op.value)
+			if err != nil {
+				return err
+			}
+			pgxBatch.Queue(b.ds.commentSQL(ctx, opBatch, sql), args...)
+		}
+	}
 
-	for i := 0; i < b.batch.Len(); i++ {
-		_, err := res.Exec()
+	err := b.ds.inTx(ctx, func(tx pgx.Tx) error {
+		res := tx.SendBatch(ctx, pgxBatch)
+		for i := 0; i < pgxBatch.Len(); i++ {
+			_, err := res.Exec()
+			if err != nil {
+				res.Close()
+				return err
+			}
+		}
+		err := res.Close()
 		if err != nil {
 			return err
 		}
+		for _, k := range large {
+			td := b.ds.route(k)
+			err = td.putLarge(ctx, b.ds.annotate(ctx, opBatch, tx), td.prefixKey(k), b.ops[k].value, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
+	b.ds.metrics.bytesWritten.Add(int64(b.size))
+	b.ops = map[ds.Key]batchOp{}
+	b.size = 0
 	return nil
 }
 
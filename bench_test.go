@@ -0,0 +1,125 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// benchSizes are the sizes of the values of the benchmarks, from small
+// records to the largest blocks of IPFS.
+var benchSizes = []int{64, 4 << 10, 256 << 10}
+
+// benchParallelism are the numbers of goroutines per CPU of the parallel
+// benchmarks.
+var benchParallelism = []int{1, 8}
+
+// benchKey returns the i-th key of a benchmark.
+func benchKey(i int64) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/bench/%012d", i))
+}
+
+// benchPopulate puts n values of the given size.
+func benchPopulate(b *testing.B, d *Datastore, n, size int) {
+	b.Helper()
+	ctx := context.Background()
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := make([]byte, size)
+	for i := 0; i < n; i++ {
+		if err := batch.Put(ctx, benchKey(int64(i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchRun runs fn in a sub-benchmark for each value size and parallelism,
+// with a new datastore holding populate values of the size. fn is given a
+// counter unique to each call, and reads or writes values values.
+func benchRun(b *testing.B, populate, values int, fn func(b *testing.B, d *Datastore, value []byte, i int64)) {
+	for _, size := range benchSizes {
+		for _, p := range benchParallelism {
+			b.Run(fmt.Sprintf("size=%d/parallelism=%d", size, p), func(b *testing.B) {
+				d, done := newDS(b)
+				defer done()
+				benchPopulate(b, d, populate, size)
+				value := make([]byte, size)
+				var n atomic.Int64
+				b.SetBytes(int64(size * values))
+				b.SetParallelism(p)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						fn(b, d, value, n.Add(1))
+					}
+				})
+			})
+		}
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	benchRun(b, 0, 1, func(b *testing.B, d *Datastore, value []byte, i int64) {
+		if err := d.Put(context.Background(), benchKey(i), value); err != nil {
+			b.Error(err)
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchRun(b, 1000, 1, func(b *testing.B, d *Datastore, value []byte, i int64) {
+		if _, err := d.Get(context.Background(), benchKey(i%1000)); err != nil {
+			b.Error(err)
+		}
+	})
+}
+
+func BenchmarkHas(b *testing.B) {
+	benchRun(b, 1000, 0, func(b *testing.B, d *Datastore, value []byte, i int64) {
+		if _, err := d.Has(context.Background(), benchKey(i%1000)); err != nil {
+			b.Error(err)
+		}
+	})
+}
+
+func BenchmarkQuery(b *testing.B) {
+	benchRun(b, 1000, 100, func(b *testing.B, d *Datastore, value []byte, i int64) {
+		res, err := d.Query(context.Background(), dsq.Query{Prefix: "/bench", Limit: 100})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		if _, err := res.Rest(); err != nil {
+			b.Error(err)
+		}
+	})
+}
+
+func BenchmarkBatch(b *testing.B) {
+	benchRun(b, 0, 100, func(b *testing.B, d *Datastore, value []byte, i int64) {
+		ctx := context.Background()
+		batch, err := d.Batch(ctx)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		for j := int64(0); j < 100; j++ {
+			if err := batch.Put(ctx, benchKey(i*100+j), value); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+		if err := batch.Commit(ctx); err != nil {
+			b.Error(err)
+		}
+	})
+}
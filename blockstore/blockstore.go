@@ -0,0 +1,242 @@
+// Package blockstore implements the go-ipfs-blockstore Blockstore interface
+// directly over a pool of connections to PostgreSQL.
+//
+// Blocks are stored in a table of their own keyed by the binary multihash of
+// their CID, rather than by the base32 encoded datastore key the blockstore of
+// a datastore uses, so keys are half the size and are not encoded and decoded
+// on every operation. Like that blockstore, blocks with the same multihash and
+// different codecs are stored once, and AllKeysChan returns CIDv1 with the raw
+// codec.
+//
+// The table has the following structure:
+//
+//	CREATE TABLE IF NOT EXISTS blockstore (mh BYTEA PRIMARY KEY, data BYTEA NOT NULL)
+package blockstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var log = logging.Logger("pgds/blockstore")
+
+// Config configures a blockstore.
+type Config struct {
+	// Table is the name of the table, optionally qualified by its schema,
+	// "blockstore" if empty.
+	Table string
+	// CreateTable creates the table if it does not exist.
+	CreateTable bool
+	// FetchSize is the number of keys AllKeysChan fetches from its cursor at
+	// a time, 1000 if zero.
+	FetchSize int
+}
+
+// Blockstore is a blockstore backed by a PostgreSQL table.
+type Blockstore struct {
+	pool      *pgxpool.Pool
+	table     string // quoted
+	fetchSize int
+	rehash    atomic.Bool
+}
+
+var (
+	_ bstore.Blockstore = (*Blockstore)(nil)
+	_ bstore.Viewer     = (*Blockstore)(nil)
+)
+
+// New returns a blockstore that stores blocks in the table of the config,
+// using the given pool of connections.
+func New(ctx context.Context, pool *pgxpool.Pool, cfg Config) (*Blockstore, error) {
+	table := cfg.Table
+	if table == "" {
+		table = "blockstore"
+	}
+	fetchSize := cfg.FetchSize
+	if fetchSize == 0 {
+		fetchSize = 1000
+	}
+	if fetchSize < 0 {
+		return nil, fmt.Errorf("invalid fetch size: %d", fetchSize)
+	}
+	bs := &Blockstore{
+		pool:      pool,
+		table:     pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+		fetchSize: fetchSize,
+	}
+	if cfg.CreateTable {
+		sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (mh BYTEA PRIMARY KEY, data BYTEA NOT NULL)", bs.table)
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			return nil, err
+		}
+	}
+	return bs, nil
+}
+
+// HashOnRead configures Get and View to verify that the blocks they read
+// match their CID.
+func (bs *Blockstore) HashOnRead(enabled bool) {
+	bs.rehash.Store(enabled)
+}
+
+// Has reports whether the block of the CID is stored.
+func (bs *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	sql := fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE mh = $1)", bs.table)
+	var exists bool
+	err := bs.pool.QueryRow(ctx, sql, []byte(c.Hash())).Scan(&exists)
+	return exists, err
+}
+
+// Get returns the block of the CID, or ipld.ErrNotFound.
+func (bs *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	data, err := bs.get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// View calls fn with the data of the block of the CID, without copying it.
+func (bs *Blockstore) View(ctx context.Context, c cid.Cid, fn func([]byte) error) error {
+	data, err := bs.get(ctx, c)
+	if err != nil {
+		return err
+	}
+	return fn(data)
+}
+
+func (bs *Blockstore) get(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if !c.Defined() {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	sql := fmt.Sprintf("SELECT data FROM %s WHERE mh = $1", bs.table)
+	var data []byte
+	err := bs.pool.QueryRow(ctx, sql, []byte(c.Hash())).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bs.rehash.Load() {
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !sum.Equals(c) {
+			return nil, bstore.ErrHashMismatch
+		}
+	}
+	return data, nil
+}
+
+// GetSize returns the size of the block of the CID, or ipld.ErrNotFound.
+func (bs *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	sql := fmt.Sprintf("SELECT octet_length(data) FROM %s WHERE mh = $1", bs.table)
+	var size int
+	err := bs.pool.QueryRow(ctx, sql, []byte(c.Hash())).Scan(&size)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+// Put stores a block. Blocks are immutable, so a block that is already
+// stored is left as it is.
+func (bs *Blockstore) Put(ctx context.Context, b blocks.Block) error {
+	sql := fmt.Sprintf("INSERT INTO %s (mh, data) VALUES ($1, $2) ON CONFLICT (mh) DO NOTHING", bs.table)
+	_, err := bs.pool.Exec(ctx, sql, []byte(b.Cid().Hash()), b.RawData())
+	return err
+}
+
+// PutMany stores blocks in a single statement.
+func (bs *Blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if len(blks) == 0 {
+		return nil
+	}
+	mhs := make([][]byte, len(blks))
+	data := make([][]byte, len(blks))
+	for i, b := range blks {
+		mhs[i] = b.Cid().Hash()
+		data[i] = b.RawData()
+	}
+	sql := fmt.Sprintf("INSERT INTO %s (mh, data) SELECT * FROM unnest($1::bytea[], $2::bytea[]) ON CONFLICT (mh) DO NOTHING", bs.table)
+	_, err := bs.pool.Exec(ctx, sql, mhs, data)
+	return err
+}
+
+// DeleteBlock deletes the block of the CID, if it is stored.
+func (bs *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE mh = $1", bs.table)
+	_, err := bs.pool.Exec(ctx, sql, []byte(c.Hash()))
+	return err
+}
+
+// AllKeysChan returns the CIDs of the stored blocks, read through a cursor.
+// The channel is closed once all CIDs are sent, the context is done or
+// reading fails, which is logged.
+func (bs *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	tx, err := bs.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sql := fmt.Sprintf("DECLARE pgds_blockstore_keys NO SCROLL CURSOR FOR SELECT mh FROM %s", bs.table)
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		// the transaction is rolled back even if the context is done
+		defer tx.Rollback(context.Background())
+		fetch := fmt.Sprintf("FETCH %d FROM pgds_blockstore_keys", bs.fetchSize)
+		for {
+			rows, err := tx.Query(ctx, fetch)
+			if err != nil {
+				log.Errorf("fetching keys: %s", err)
+				return
+			}
+			var keys []cid.Cid
+			for rows.Next() {
+				var mh []byte
+				if err := rows.Scan(&mh); err != nil {
+					rows.Close()
+					log.Errorf("fetching keys: %s", err)
+					return
+				}
+				keys = append(keys, cid.NewCidV1(cid.Raw, mh))
+			}
+			if err := rows.Err(); err != nil {
+				log.Errorf("fetching keys: %s", err)
+				return
+			}
+			for _, k := range keys {
+				select {
+				case out <- k:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(keys) < bs.fetchSize {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
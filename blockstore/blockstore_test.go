@@ -0,0 +1,119 @@
+package blockstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func envString(key string, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+func testConnString() string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable",
+		envString("PG_USER", "postgres"),
+		envString("PG_PASS", ""),
+		envString("PG_HOST", "127.0.0.1"),
+		envString("PG_DB", envString("PG_USER", "postgres")),
+	)
+}
+
+func TestBlockstore(t *testing.T) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, testConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	bs, err := New(ctx, pool, Config{Table: "blockstore_test", CreateTable: true, FetchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Exec(ctx, "DROP TABLE blockstore_test")
+
+	var blks []blocks.Block
+	for i := 0; i < 5; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	if err := bs.Put(ctx, blks[0]); err != nil {
+		t.Fatal(err)
+	}
+	// putting a block again is a no-op
+	if err := bs.PutMany(ctx, blks); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range blks {
+		has, err := bs.Has(ctx, b.Cid())
+		if err != nil || !has {
+			t.Fatalf("expected block %s to be stored: %v", b.Cid(), err)
+		}
+		got, err := bs.Get(ctx, b.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.RawData(), b.RawData()) {
+			t.Fatalf("unexpected data of block %s: %q", b.Cid(), got.RawData())
+		}
+		size, err := bs.GetSize(ctx, b.Cid())
+		if err != nil || size != len(b.RawData()) {
+			t.Fatalf("unexpected size of block %s: %d, %v", b.Cid(), size, err)
+		}
+	}
+
+	// blocks are found by their multihash, whatever the codec of their CID
+	raw := cid.NewCidV1(cid.Raw, blks[0].Cid().Hash())
+	if has, err := bs.Has(ctx, raw); err != nil || !has {
+		t.Fatalf("expected block %s to be stored: %v", raw, err)
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for range keys {
+		n++
+	}
+	if n != len(blks) {
+		t.Fatalf("expected %d keys, got %d", len(blks), n)
+	}
+
+	if err := bs.DeleteBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bs.Get(ctx, blks[0].Cid())
+	if !ipld.IsNotFound(err) {
+		t.Fatalf("expected a deleted block not to be found, got: %v", err)
+	}
+	_, err = bs.GetSize(ctx, blks[0].Cid())
+	if !ipld.IsNotFound(err) {
+		t.Fatalf("expected a deleted block not to be found, got: %v", err)
+	}
+
+	// a corrupted block fails to verify
+	_, err = pool.Exec(ctx, "UPDATE blockstore_test SET data = 'corrupted' WHERE mh = $1", []byte(blks[1].Cid().Hash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.HashOnRead(true)
+	_, err = bs.Get(ctx, blks[1].Cid())
+	if !errors.Is(err, bstore.ErrHashMismatch) {
+		t.Fatalf("expected a hash mismatch, got: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrCircuitOpen is returned by the datastore operations while the circuit
+// breaker is open after repeated failures to reach the database.
+var ErrCircuitOpen = errors.New("circuit breaker is open: database unreachable")
+
+// breaker is a circuit breaker that opens after a number of consecutive
+// connection failures, failing operations fast instead of letting them pile up
+// waiting for the database. Once the cooldown has passed, a single operation
+// is let through to probe the database: the breaker closes if it succeeds and
+// opens again if it fails.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether an operation may run.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of an operation that was allowed to run.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	switch {
+	case connectionError(err):
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		// says nothing about the database
+	default:
+		b.failures = 0
+	}
+}
+
+// connectionError reports whether an error means the database could not be
+// reached or the connection to it was lost.
+func connectionError(err error) bool {
+	if err == nil || errors.Is(err, ds.ErrNotFound) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P01", "57P02", "57P03":
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) || errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || pgconn.SafeToRetry(err)
+}
@@ -0,0 +1,145 @@
+// Package car exports the blocks stored in a pgds table to CAR (content
+// addressable archive) files, and imports the blocks of CAR files.
+//
+// Blocks are stored by the blockstore of kubo under the "/blocks" namespace,
+// keyed by the base32 encoding of their multihash. As the key does not record
+// the codec of a block, exported blocks are given CIDv1 with the codec of the
+// Config, raw by default.
+//
+// The format is described at https://ipld.io/specs/transport/car/.
+package car
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// CodecRaw is the multicodec of raw blocks.
+const CodecRaw = 0x55
+
+// v2Pragma starts CARv2 files, it is a CARv1 header with version 2.
+var v2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// v2HeaderSize is the size of the CARv2 header that follows the pragma.
+const v2HeaderSize = 40
+
+// keyEncoding is the encoding of the multihashes in the keys of blocks.
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// keyMultihash returns the multihash of a block from its key, the last
+// namespace of the key.
+func keyMultihash(key string) ([]byte, error) {
+	name := ds.RawKey(key).BaseNamespace()
+	mh, err := keyEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid block key %s: %w", key, err)
+	}
+	return mh, nil
+}
+
+// multihashKey returns the key of a block with the given multihash under
+// the given namespace.
+func multihashKey(prefix string, mh []byte) ds.Key {
+	return ds.NewKey(prefix).ChildString(keyEncoding.EncodeToString(mh))
+}
+
+// cidV1 returns the binary CIDv1 of a block with the given codec and
+// multihash.
+func cidV1(codec uint64, mh []byte) []byte {
+	cid := binary.AppendUvarint(nil, 1)
+	cid = binary.AppendUvarint(cid, codec)
+	return append(cid, mh...)
+}
+
+// cidMultihash returns the length of the binary CID at the start of b, and
+// its multihash.
+func cidMultihash(b []byte) (int, []byte, error) {
+	// a CIDv0 is a sha2-256 multihash
+	if len(b) >= 34 && b[0] == 0x12 && b[1] == 0x20 {
+		return 34, b[:34], nil
+	}
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != 1 {
+		return 0, nil, errors.New("invalid CID version")
+	}
+	_, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return 0, nil, errors.New("invalid CID codec")
+	}
+	n += m
+	start := n
+	_, m = binary.Uvarint(b[n:])
+	if m <= 0 {
+		return 0, nil, errors.New("invalid CID multihash")
+	}
+	n += m
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 || uint64(len(b)-n-m) < size {
+		return 0, nil, errors.New("invalid CID multihash")
+	}
+	n += m + int(size)
+	return n, b[start:n], nil
+}
+
+// cborHead appends the head of a CBOR data item of the given major type and
+// argument.
+func cborHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= 0xff:
+		return append(b, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
+
+// v1Header returns the DAG-CBOR encoded header of a CARv1 with the given
+// roots: {"roots": [CID...], "version": 1}.
+func v1Header(roots [][]byte) []byte {
+	b := cborHead(nil, 5, 2)
+	b = cborHead(b, 3, 5)
+	b = append(b, "roots"...)
+	b = cborHead(b, 4, uint64(len(roots)))
+	for _, cid := range roots {
+		// CIDs are tag 42 byte strings with a leading zero byte
+		b = cborHead(b, 6, 42)
+		b = cborHead(b, 2, uint64(len(cid)+1))
+		b = append(b, 0)
+		b = append(b, cid...)
+	}
+	b = cborHead(b, 3, 7)
+	b = append(b, "version"...)
+	return cborHead(b, 0, 1)
+}
+
+// writeSection writes a length prefixed section of a CARv1 and returns its
+// size.
+func writeSection(w io.Writer, parts ...[]byte) (int, error) {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+	n, err := w.Write(binary.AppendUvarint(nil, uint64(size)))
+	if err != nil {
+		return n, err
+	}
+	for _, p := range parts {
+		m, err := w.Write(p)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
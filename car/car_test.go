@@ -0,0 +1,156 @@
+package car
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+func envString(key string, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+func testConnString() string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable",
+		envString("PG_USER", "postgres"),
+		envString("PG_PASS", ""),
+		envString("PG_HOST", "127.0.0.1"),
+		envString("PG_DB", envString("PG_USER", "postgres")),
+	)
+}
+
+// the sha2-256 multihash of "hello"
+var helloMultihash, _ = hex.DecodeString("12202cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+
+func TestV1Header(t *testing.T) {
+	// {"roots": [], "version": 1}
+	expected, _ := hex.DecodeString("a265726f6f7473806776657273696f6e01")
+	if h := v1Header(nil); !bytes.Equal(h, expected) {
+		t.Fatalf("unexpected header %x", h)
+	}
+	h := v1Header([][]byte{cidV1(CodecRaw, helloMultihash)})
+	if !bytes.Contains(h, append([]byte{0xd8, 0x2a, 0x58, 0x25, 0x00, 0x01, 0x55}, helloMultihash...)) {
+		t.Fatalf("unexpected header %x", h)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	root := cidV1(CodecRaw, helloMultihash)
+	version, roots, err := parseHeader(v1Header([][]byte{root}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || len(roots) != 1 || !bytes.Equal(roots[0], root) {
+		t.Fatalf("unexpected header version %d, roots %x", version, roots)
+	}
+	_, _, err = parseHeader([]byte{0xa1})
+	if err == nil {
+		t.Fatal("expected a truncated header to fail")
+	}
+}
+
+func TestBlockEntry(t *testing.T) {
+	section := append(cidV1(CodecRaw, helloMultihash), "hello"...)
+	e, err := blockEntry("/blocks", section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Key != "/blocks/CIQCZ4SNXJP3BIYOE3UDWKWFXHRJ4GYWDZOB7J2CLZZQIM3CSOFZQJA" || string(e.Value) != "hello" {
+		t.Fatalf("unexpected entry %v", e)
+	}
+	// a CIDv0
+	_, err = blockEntry("/blocks", append(helloMultihash, "hullo"...))
+	if err == nil {
+		t.Fatal("expected a block that does not match its multihash to fail")
+	}
+}
+
+func TestKeyMultihash(t *testing.T) {
+	mh, err := keyMultihash("/blocks/CIQCZ4SNXJP3BIYOE3UDWKWFXHRJ4GYWDZOB7J2CLZZQIM3CSOFZQJA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mh, helloMultihash) {
+		t.Fatalf("unexpected multihash %x", mh)
+	}
+	_, err = keyMultihash("/blocks/not-base32")
+	if err == nil {
+		t.Fatal("expected an invalid key to fail")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	d, err := pgds.NewDatastore(ctx, testConnString(), pgds.Table("car_test"), pgds.CreateTable(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.PgxPool().Exec(ctx, "DROP TABLE car_test")
+	err = d.Put(ctx, ds.NewKey("/blocks/CIQCZ4SNXJP3BIYOE3UDWKWFXHRJ4GYWDZOB7J2CLZZQIM3CSOFZQJA"), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(ctx, d, &buf, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 block, got %d", n)
+	}
+	section := append([]byte{0x29, 0x01, 0x55}, helloMultihash...)
+	if !bytes.HasSuffix(buf.Bytes(), append(section, "hello"...)) {
+		t.Fatalf("unexpected archive %x", buf.Bytes())
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "blocks.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = Export(ctx, d, f, Config{Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v2[len(v2Pragma)+v2HeaderSize:], buf.Bytes()) {
+		t.Fatal("expected the CARv2 to wrap the CARv1")
+	}
+
+	err = d.Delete(ctx, ds.NewKey("/blocks/CIQCZ4SNXJP3BIYOE3UDWKWFXHRJ4GYWDZOB7J2CLZZQIM3CSOFZQJA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, n, err = Import(ctx, d, bytes.NewReader(v2), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 block imported, got %d", n)
+	}
+	// blocks already stored are skipped
+	_, n, err = Import(ctx, d, bytes.NewReader(buf.Bytes()), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no block imported, got %d", n)
+	}
+}
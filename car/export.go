@@ -0,0 +1,118 @@
+package car
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	dsq "github.com/ipfs/go-datastore/query"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// Config configures an export.
+type Config struct {
+	// Prefix is the namespace of the blocks, "/blocks" if empty.
+	Prefix string
+	// Version is the version of the CAR format, 1 if zero. Writing a CARv2
+	// requires an io.WriteSeeker, to fill in the size of the data once it
+	// is written.
+	Version int
+	// Roots are the binary CIDs recorded as the roots of the archive.
+	Roots [][]byte
+	// Codec is the multicodec of the CIDs of the blocks, CodecRaw if zero.
+	Codec uint64
+}
+
+func (cfg Config) prefix() string {
+	if cfg.Prefix == "" {
+		return "/blocks"
+	}
+	return cfg.Prefix
+}
+
+// Export writes the blocks of the datastore to w as a CAR, streaming them in
+// key order, and returns the number of blocks written.
+func Export(ctx context.Context, d *pgds.Datastore, w io.Writer, cfg Config) (int64, error) {
+	switch cfg.Version {
+	case 0, 1:
+		_, n, err := exportV1(ctx, d, w, cfg)
+		return n, err
+	case 2:
+		ws, ok := w.(io.WriteSeeker)
+		if !ok {
+			return 0, errors.New("writing a CARv2 requires an io.WriteSeeker")
+		}
+		return exportV2(ctx, d, ws, cfg)
+	}
+	return 0, errors.New("unsupported CAR version")
+}
+
+// exportV1 writes a CARv1 and returns its size and the number of blocks.
+func exportV1(ctx context.Context, d *pgds.Datastore, w io.Writer, cfg Config) (int64, int64, error) {
+	codec := cfg.Codec
+	if codec == 0 {
+		codec = CodecRaw
+	}
+	size, err := writeSection(w, v1Header(cfg.Roots))
+	if err != nil {
+		return 0, 0, err
+	}
+	written := int64(size)
+
+	res, err := d.Query(ctx, dsq.Query{Prefix: cfg.prefix(), Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		return written, 0, err
+	}
+	defer res.Close()
+	var blocks int64
+	for r := range res.Next() {
+		if r.Error != nil {
+			return written, blocks, r.Error
+		}
+		mh, err := keyMultihash(r.Key)
+		if err != nil {
+			return written, blocks, err
+		}
+		size, err := writeSection(w, cidV1(codec, mh), r.Value)
+		written += int64(size)
+		if err != nil {
+			return written, blocks, err
+		}
+		blocks++
+	}
+	return written, blocks, nil
+}
+
+// exportV2 writes a CARv2 without an index, the CARv1 it wraps directly
+// following its header.
+func exportV2(ctx context.Context, d *pgds.Datastore, w io.WriteSeeker, cfg Config) (int64, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, v2HeaderSize)
+	if _, err := w.Write(append(v2Pragma, header...)); err != nil {
+		return 0, err
+	}
+	dataSize, blocks, err := exportV1(ctx, d, w, cfg)
+	if err != nil {
+		return blocks, err
+	}
+	end, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return blocks, err
+	}
+
+	// no characteristics, and no index
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(v2Pragma)+v2HeaderSize))
+	binary.LittleEndian.PutUint64(header[24:], uint64(dataSize))
+	if _, err := w.Seek(start+int64(len(v2Pragma)), io.SeekStart); err != nil {
+		return blocks, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return blocks, err
+	}
+	_, err = w.Seek(end, io.SeekStart)
+	return blocks, err
+}
@@ -0,0 +1,212 @@
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	dsq "github.com/ipfs/go-datastore/query"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// maxSectionSize bounds the size of the sections read, far above the size of
+// the blocks of IPFS.
+const maxSectionSize = 32 << 20
+
+// Import reads a CARv1 or CARv2 from r and inserts the blocks that are not
+// already stored under the Prefix of the config, streaming them to the
+// database with COPY. It returns the roots of the archive and the number of
+// blocks inserted. The blocks of sha2-256 multihashes are verified.
+func Import(ctx context.Context, d *pgds.Datastore, r io.Reader, cfg Config) ([][]byte, int64, error) {
+	br := bufio.NewReader(r)
+	header, err := readSection(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading CAR header: %w", err)
+	}
+	if bytes.Equal(header, v2Pragma[1:]) {
+		// the data of a CARv2 is a CARv1
+		v2Header := make([]byte, v2HeaderSize)
+		if _, err := io.ReadFull(br, v2Header); err != nil {
+			return nil, 0, fmt.Errorf("reading CARv2 header: %w", err)
+		}
+		offset := binary.LittleEndian.Uint64(v2Header[16:])
+		size := binary.LittleEndian.Uint64(v2Header[24:])
+		skip := int64(offset) - int64(len(v2Pragma)+v2HeaderSize)
+		if skip < 0 {
+			return nil, 0, errors.New("invalid CARv2 data offset")
+		}
+		if _, err := br.Discard(int(skip)); err != nil {
+			return nil, 0, err
+		}
+		br = bufio.NewReader(io.LimitReader(br, int64(size)))
+		header, err = readSection(br)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading CAR header: %w", err)
+		}
+	}
+	version, roots, err := parseHeader(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version != 1 {
+		return nil, 0, fmt.Errorf("unsupported CAR version %d", version)
+	}
+
+	var readErr error
+	blocks := dsq.ResultsFromIterator(dsq.Query{}, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			section, err := readSection(br)
+			if errors.Is(err, io.EOF) {
+				return dsq.Result{}, false
+			}
+			if err == nil {
+				var e dsq.Entry
+				e, err = blockEntry(cfg.prefix(), section)
+				if err == nil {
+					return dsq.Result{Entry: e}, true
+				}
+			}
+			readErr = err
+			return dsq.Result{Error: err}, true
+		},
+	})
+	n, err := d.ImportNewEntries(ctx, blocks)
+	if readErr != nil {
+		return roots, 0, readErr
+	}
+	return roots, n, err
+}
+
+// readSection reads a length prefixed section of a CARv1. It returns io.EOF
+// at the end of the archive.
+func readSection(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSectionSize {
+		return nil, fmt.Errorf("CAR section of %d bytes is too large", size)
+	}
+	section := make([]byte, size)
+	if _, err := io.ReadFull(br, section); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return section, nil
+}
+
+// blockEntry returns the entry of the block of a section.
+func blockEntry(prefix string, section []byte) (dsq.Entry, error) {
+	n, mh, err := cidMultihash(section)
+	if err != nil {
+		return dsq.Entry{}, err
+	}
+	data := section[n:]
+	if mh[0] == 0x12 && mh[1] == 0x20 {
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], mh[2:]) {
+			return dsq.Entry{}, fmt.Errorf("block %s does not match its multihash", multihashKey(prefix, mh))
+		}
+	}
+	return dsq.Entry{Key: multihashKey(prefix, mh).String(), Value: data}, nil
+}
+
+// parseHeader decodes the DAG-CBOR header of a CARv1.
+func parseHeader(b []byte) (uint64, [][]byte, error) {
+	r := &cborReader{b: b}
+	major, pairs, err := r.head()
+	if err != nil || major != 5 {
+		return 0, nil, errors.New("invalid CAR header")
+	}
+	var version uint64
+	var roots [][]byte
+	for i := uint64(0); i < pairs; i++ {
+		key, err := r.bytes(3)
+		if err != nil {
+			return 0, nil, errors.New("invalid CAR header")
+		}
+		switch string(key) {
+		case "version":
+			major, version, err = r.head()
+			if err != nil || major != 0 {
+				return 0, nil, errors.New("invalid CAR version")
+			}
+		case "roots":
+			major, n, err := r.head()
+			if err != nil || major != 4 {
+				return 0, nil, errors.New("invalid CAR roots")
+			}
+			for j := uint64(0); j < n; j++ {
+				major, tag, err := r.head()
+				if err != nil || major != 6 || tag != 42 {
+					return 0, nil, errors.New("invalid CAR root")
+				}
+				cid, err := r.bytes(2)
+				if err != nil || len(cid) < 2 || cid[0] != 0 {
+					return 0, nil, errors.New("invalid CAR root")
+				}
+				roots = append(roots, cid[1:])
+			}
+		default:
+			return 0, nil, fmt.Errorf("unexpected CAR header field %s", key)
+		}
+	}
+	return version, roots, nil
+}
+
+// cborReader decodes the CBOR data items of a CAR header.
+type cborReader struct {
+	b []byte
+}
+
+// head reads the head of a data item and returns its major type and
+// argument.
+func (r *cborReader) head() (byte, uint64, error) {
+	if len(r.b) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	major, info := r.b[0]>>5, r.b[0]&0x1f
+	r.b = r.b[1:]
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, 0, errors.New("unsupported CBOR item")
+	}
+	if len(r.b) < size {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	var n uint64
+	for _, c := range r.b[:size] {
+		n = n<<8 | uint64(c)
+	}
+	r.b = r.b[size:]
+	return major, n, nil
+}
+
+// bytes reads a byte or text string of the given major type.
+func (r *cborReader) bytes(major byte) ([]byte, error) {
+	m, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	if m != major || uint64(len(r.b)) < n {
+		return nil, errors.New("invalid CBOR string")
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
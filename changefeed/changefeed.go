@@ -0,0 +1,393 @@
+// Package changefeed streams the changes made to a pgds table using
+// PostgreSQL logical decoding.
+//
+// Unlike Watch and the journal, the changefeed does not need any trigger on
+// the table: changes are read from the write-ahead log through a logical
+// replication slot using the built-in pgoutput plugin. The slot is kept by the
+// server between connections, so a feed that is closed and opened again resumes
+// after the last position that was acknowledged with Ack.
+//
+// The server must run with wal_level = logical and the user must be allowed to
+// replicate (the REPLICATION attribute), own the table and create publications.
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ChangeTruncate is the operation of events sent when the table is truncated.
+// Their key is empty.
+const ChangeTruncate pgds.ChangeOp = "truncate"
+
+// Event is a change made to a row of the table.
+type Event struct {
+	Key ds.Key
+	Op  pgds.ChangeOp
+	// Value is the new value of the row for inserts and updates. It is nil for
+	// deletes, and for updates that did not change the value.
+	Value []byte
+	// LSN is the commit position of the transaction that made the change.
+	// Events are sent in commit order, so the LSN never decreases.
+	LSN pglogrepl.LSN
+	// CommitTime is the time the transaction that made the change committed.
+	CommitTime time.Time
+}
+
+// Config configures a changefeed.
+type Config struct {
+	// Table is the name of the datastore table, "blocks" if empty.
+	Table string
+	// Slot is the name of the replication slot, "pgds_changefeed" if empty.
+	// Each consumer of the feed needs its own slot.
+	Slot string
+	// Publication is the name of the publication of the table,
+	// "pgds_changefeed" if empty.
+	Publication string
+	// StartLSN is the position to start streaming from. When zero, streaming
+	// resumes after the last position acknowledged on the slot.
+	StartLSN pglogrepl.LSN
+	// StatusInterval is how often the feed reports its position to the
+	// server, 10 seconds if zero.
+	StatusInterval time.Duration
+}
+
+// Feed is a stream of changes to the table.
+type Feed struct {
+	conn           *pgconn.PgConn
+	typeMap        *pgtype.Map
+	statusInterval time.Duration
+
+	relations  map[uint32]*pglogrepl.RelationMessage
+	commitLSN  pglogrepl.LSN
+	commitTime time.Time
+	received   pglogrepl.LSN
+	nextStatus time.Time
+
+	mu    sync.Mutex
+	acked pglogrepl.LSN
+}
+
+// Open connects to the database, creates the publication and the replication
+// slot if they do not exist and starts streaming changes.
+//
+// The table is given a replica identity on its key index if it has no primary
+// key, so that deletes carry the key of the deleted row.
+func Open(ctx context.Context, connString string, cfg Config) (*Feed, error) {
+	if cfg.Table == "" {
+		cfg.Table = "blocks"
+	}
+	if cfg.Slot == "" {
+		cfg.Slot = "pgds_changefeed"
+	}
+	if cfg.Publication == "" {
+		cfg.Publication = "pgds_changefeed"
+	}
+	if cfg.StatusInterval <= 0 {
+		cfg.StatusInterval = 10 * time.Second
+	}
+
+	connConfig, err := pgconn.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	connConfig.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setup(ctx, conn, cfg)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+
+	err = pglogrepl.StartReplication(ctx, conn, pgx.Identifier{cfg.Slot}.Sanitize(), cfg.StartLSN, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", "publication_names " + quoteLiteral(cfg.Publication)},
+	})
+	if err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+
+	return &Feed{
+		conn:           conn,
+		typeMap:        pgtype.NewMap(),
+		statusInterval: cfg.StatusInterval,
+		relations:      make(map[uint32]*pglogrepl.RelationMessage),
+		received:       cfg.StartLSN,
+		acked:          cfg.StartLSN,
+		nextStatus:     time.Now().Add(cfg.StatusInterval),
+	}, nil
+}
+
+// setup creates the publication and the replication slot of the feed.
+func setup(ctx context.Context, conn *pgconn.PgConn, cfg Config) error {
+	table := pgx.Identifier(strings.Split(cfg.Table, ".")).Sanitize()
+
+	// without a primary key, deletes from a published table fail unless the
+	// table has another replica identity
+	rows, err := queryRows(ctx, conn, fmt.Sprintf(
+		`SELECT c.relreplident, i.relname
+		FROM pg_class c
+		LEFT JOIN LATERAL (
+			SELECT ic.relname FROM pg_index x
+			JOIN pg_class ic ON ic.oid = x.indexrelid
+			JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = x.indkey[0]
+			WHERE x.indrelid = c.oid AND x.indisunique AND x.indisvalid AND x.indnatts = 1
+				AND x.indpred IS NULL AND a.attname = 'key'
+			ORDER BY x.indisprimary DESC LIMIT 1
+		) i ON true
+		WHERE c.oid = %s::regclass AND NOT EXISTS (
+			SELECT 1 FROM pg_index WHERE indrelid = c.oid AND indisprimary
+		)`, quoteLiteral(table)))
+	if err != nil {
+		return err
+	}
+	if len(rows) == 1 && string(rows[0][0]) == "d" {
+		if rows[0][1] == nil {
+			return fmt.Errorf("table %s has no unique index on key", cfg.Table)
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY USING INDEX %s", table, pgx.Identifier{string(rows[0][1])}.Sanitize())
+		_, err = conn.Exec(ctx, sql).ReadAll()
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err = queryRows(ctx, conn, "SELECT 1 FROM pg_publication WHERE pubname = "+quoteLiteral(cfg.Publication))
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		sql := fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", pgx.Identifier{cfg.Publication}.Sanitize(), table)
+		_, err = conn.Exec(ctx, sql).ReadAll()
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err = queryRows(ctx, conn, "SELECT 1 FROM pg_replication_slots WHERE slot_name = "+quoteLiteral(cfg.Slot))
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		_, err = pglogrepl.CreateReplicationSlot(ctx, conn, pgx.Identifier{cfg.Slot}.Sanitize(), "pgoutput", pglogrepl.CreateReplicationSlotOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryRows runs a query using the simple protocol, the only one available on
+// replication connections, and returns its rows.
+func queryRows(ctx context.Context, conn *pgconn.PgConn, sql string) ([][][]byte, error) {
+	results, err := conn.Exec(ctx, sql).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return results[0].Rows, nil
+}
+
+// quoteLiteral quotes a string for use as a SQL literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Next waits for the next change to the table.
+//
+// The feed only reports its position to the server while Next is being
+// called, so a feed that is not read from for long may be disconnected by the
+// server's wal_sender_timeout.
+func (f *Feed) Next(ctx context.Context) (Event, error) {
+	for {
+		if !time.Now().Before(f.nextStatus) {
+			err := f.sendStatus(ctx)
+			if err != nil {
+				return Event{}, err
+			}
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, f.nextStatus)
+		msg, err := f.conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return Event{}, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return Event{}, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case pglogrepl.PrimaryKeepaliveMessageByteID:
+				keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+				if err != nil {
+					return Event{}, err
+				}
+				if keepalive.ServerWALEnd > f.received {
+					f.received = keepalive.ServerWALEnd
+				}
+				if keepalive.ReplyRequested {
+					f.nextStatus = time.Time{}
+				}
+			case pglogrepl.XLogDataByteID:
+				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+				if err != nil {
+					return Event{}, err
+				}
+				if end := xld.WALStart + pglogrepl.LSN(len(xld.WALData)); end > f.received {
+					f.received = end
+				}
+				e, ok, err := f.decode(xld.WALData)
+				if err != nil {
+					return Event{}, err
+				}
+				if ok {
+					return e, nil
+				}
+			}
+		}
+	}
+}
+
+// decode decodes a pgoutput message, returning the event it carries if any.
+func (f *Feed) decode(data []byte) (Event, bool, error) {
+	msg, err := pglogrepl.Parse(data)
+	if err != nil {
+		return Event{}, false, err
+	}
+
+	var (
+		relationID uint32
+		tuple      *pglogrepl.TupleData
+		op         pgds.ChangeOp
+	)
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		f.relations[msg.RelationID] = msg
+		return Event{}, false, nil
+	case *pglogrepl.BeginMessage:
+		f.commitLSN = msg.FinalLSN
+		f.commitTime = msg.CommitTime
+		return Event{}, false, nil
+	case *pglogrepl.InsertMessage:
+		relationID, tuple, op = msg.RelationID, msg.Tuple, pgds.ChangeInsert
+	case *pglogrepl.UpdateMessage:
+		relationID, tuple, op = msg.RelationID, msg.NewTuple, pgds.ChangeUpdate
+	case *pglogrepl.DeleteMessage:
+		relationID, tuple, op = msg.RelationID, msg.OldTuple, pgds.ChangeDelete
+	case *pglogrepl.TruncateMessage:
+		return Event{Op: ChangeTruncate, LSN: f.commitLSN, CommitTime: f.commitTime}, true, nil
+	default:
+		return Event{}, false, nil
+	}
+
+	rel, ok := f.relations[relationID]
+	if !ok {
+		return Event{}, false, fmt.Errorf("unknown relation %d", relationID)
+	}
+	if tuple == nil {
+		return Event{}, false, errors.New("change without row data")
+	}
+
+	e := Event{Op: op, LSN: f.commitLSN, CommitTime: f.commitTime}
+	for i, col := range tuple.Columns {
+		if i >= len(rel.Columns) || col.DataType != pglogrepl.TupleDataTypeText {
+			continue
+		}
+		switch rel.Columns[i].Name {
+		case "key":
+			e.Key = ds.RawKey(string(col.Data))
+		case "data":
+			if op == pgds.ChangeDelete {
+				continue
+			}
+			var value []byte
+			err := f.typeMap.Scan(rel.Columns[i].DataType, pgtype.TextFormatCode, col.Data, &value)
+			if err != nil {
+				return Event{}, false, err
+			}
+			e.Value = value
+		}
+	}
+	return e, true, nil
+}
+
+// sendStatus reports the position of the feed to the server.
+func (f *Feed) sendStatus(ctx context.Context) error {
+	f.mu.Lock()
+	acked := f.acked
+	f.mu.Unlock()
+
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, f.conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: f.received,
+		WALFlushPosition: acked,
+		WALApplyPosition: acked,
+	})
+	if err != nil {
+		return err
+	}
+	f.nextStatus = time.Now().Add(f.statusInterval)
+	return nil
+}
+
+// Ack acknowledges that all the events up to and including those with the
+// given LSN have been processed. When the feed is opened again on the same
+// slot without a StartLSN, it resumes after the last acknowledged position,
+// which is reported to the server every StatusInterval and on Close. Ack may
+// be called concurrently with Next.
+//
+// Events of a transaction share the same LSN, so a transaction is only
+// acknowledged as a whole.
+func (f *Feed) Ack(lsn pglogrepl.LSN) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// LSN is where the commit record starts, and the server only skips the
+	// transactions that committed before the acknowledged position
+	if lsn+1 > f.acked {
+		f.acked = lsn + 1
+	}
+}
+
+// Close reports the acknowledged position to the server and closes the
+// connection. The replication slot is kept so the feed can be resumed; drop
+// it with DropSlot when it is no longer needed, or the server will keep the
+// write-ahead log it has not consumed.
+func (f *Feed) Close(ctx context.Context) error {
+	statusErr := f.sendStatus(ctx)
+	err := f.conn.Close(ctx)
+	if err != nil {
+		return err
+	}
+	return statusErr
+}
+
+// DropSlot drops the replication slot of a feed that is not open.
+func DropSlot(ctx context.Context, conn *pgx.Conn, slot string) error {
+	_, err := conn.Exec(ctx, "SELECT pg_drop_replication_slot($1)", slot)
+	return err
+}
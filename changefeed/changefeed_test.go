@@ -0,0 +1,127 @@
+package changefeed
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+	"github.com/jackc/pgx/v5"
+)
+
+func envString(key string, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+func testConnString() string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable",
+		envString("PG_USER", "postgres"),
+		envString("PG_PASS", ""),
+		envString("PG_HOST", "127.0.0.1"),
+		envString("PG_DB", envString("PG_USER", "postgres")),
+	)
+}
+
+func TestFeed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	connString := testConnString()
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	var walLevel string
+	err = conn.QueryRow(ctx, "SHOW wal_level").Scan(&walLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walLevel != "logical" {
+		t.Skipf("wal_level is %s, not logical", walLevel)
+	}
+
+	_, err = conn.Exec(ctx, "CREATE TABLE changefeed_test (key TEXT NOT NULL UNIQUE, data BYTEA)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DropSlot(context.Background(), conn, "changefeed_test")
+		_, _ = conn.Exec(context.Background(), "DROP PUBLICATION IF EXISTS changefeed_test")
+		_, _ = conn.Exec(context.Background(), "DROP TABLE changefeed_test")
+	}()
+
+	cfg := Config{Table: "changefeed_test", Slot: "changefeed_test", Publication: "changefeed_test"}
+	feed, err := Open(ctx, connString, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := pgds.NewDatastore(ctx, connString, pgds.Table("changefeed_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, err := range []error{
+		d.Put(ctx, ds.NewKey("a"), []byte("1")),
+		d.Put(ctx, ds.NewKey("a"), []byte("2")),
+		d.Delete(ctx, ds.NewKey("a")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []Event{
+		{Key: ds.NewKey("a"), Op: pgds.ChangeInsert, Value: []byte("1")},
+		{Key: ds.NewKey("a"), Op: pgds.ChangeUpdate, Value: []byte("2")},
+		{Key: ds.NewKey("a"), Op: pgds.ChangeDelete},
+	}
+	var last Event
+	for i, exp := range expected {
+		e, err := feed.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != exp.Key || e.Op != exp.Op || string(e.Value) != string(exp.Value) {
+			t.Fatalf("event %d: expected %s %s %q, got %s %s %q", i, exp.Op, exp.Key, exp.Value, e.Op, e.Key, e.Value)
+		}
+		if e.LSN < last.LSN {
+			t.Fatalf("event %d: LSN went backwards from %s to %s", i, last.LSN, e.LSN)
+		}
+		last = e
+	}
+	feed.Ack(last.LSN)
+	err = feed.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resuming on the slot only sends the changes made after the ack
+	err = d.Put(ctx, ds.NewKey("b"), []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err = Open(ctx, connString, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close(context.Background())
+	e, err := feed.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Key != ds.NewKey("b") || e.Op != pgds.ChangeInsert {
+		t.Fatalf("expected insert of /b after resuming, got %s %s", e.Op, e.Key)
+	}
+}
@@ -0,0 +1,128 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// chunksTable returns the quoted name of the table the chunks of values are
+// stored in.
+func (d *Datastore) chunksTable() string {
+	return quoteTable(d.tableName + "_chunks")
+}
+
+// ensureChunks creates the table of chunks, the column that counts the chunks
+// of a value, and the trigger that deletes the chunks of values that are
+// overwritten or deleted, if they do not already exist.
+func (d *Datastore) ensureChunks(ctx context.Context, tx pgx.Tx) error {
+	chunks := d.chunksTable()
+	fn := quoteTable(d.tableName + "_chunks_delete")
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			%s %s NOT NULL,
+			seq INTEGER NOT NULL,
+			chunk BYTEA NOT NULL,
+			PRIMARY KEY (%s, seq)
+		)`, chunks, d.keyCol, d.keyType(), d.keyCol),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS chunks INTEGER", d.table),
+		// the chunks of a value that is rewritten in place are replaced by
+		// writeChunks
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF OLD.chunks IS NOT NULL AND (TG_OP = 'DELETE' OR NEW.chunks IS NULL) THEN
+				DELETE FROM %s WHERE %s = OLD.%s;
+			END IF;
+			RETURN NULL;
+		END
+		$$`, fn, chunks, d.keyCol, d.keyCol),
+	}
+	for _, sql := range stmts {
+		_, err := tx.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_trigger WHERE tgrelid = $1::regclass AND tgname = 'pgds_chunks_delete')", d.table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TRIGGER pgds_chunks_delete AFTER UPDATE OF chunks OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE %s()", d.table, fn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChunks replaces the chunks of the value of a locked row by the data
+// read from r, one statement per chunk, and returns their number and size.
+func (d *Datastore) writeChunks(ctx context.Context, tx pgx.Tx, key string, r io.Reader) (uint32, int64, error) {
+	_, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = $1", d.chunksTable(), d.keyCol), d.keyArg(key))
+	if err != nil {
+		return 0, 0, err
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s, seq, chunk) VALUES ($1, $2, $3)", d.chunksTable(), d.keyCol)
+	buf := make([]byte, d.chunkSize)
+	var n uint32
+	var size int64
+	for {
+		chunk, err := readChunk(r, buf)
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if len(chunk) > 0 {
+			_, ierr := tx.Exec(ctx, insert, d.keyArg(key), n, chunk)
+			if ierr != nil {
+				return 0, 0, ierr
+			}
+			n++
+			size += int64(len(chunk))
+		}
+		if err == io.EOF {
+			return n, size, nil
+		}
+	}
+}
+
+// getChunks reads a value stored in chunks. The row and its chunks are read
+// by the same statement, so that they are consistent even if the value is
+// replaced in the meantime, and the chunks are received as they are read.
+func (d *Datastore) getChunks(ctx context.Context, db querier, key string, sumCol string) (largeValue, error) {
+	var v largeValue
+	sql := fmt.Sprintf(
+		"SELECT t.chunks, %s, c.chunk FROM %s AS t JOIN %s AS c ON c.%s = t.%s WHERE t.%s = $1 AND t.chunks IS NOT NULL%s ORDER BY c.seq",
+		sumCol, d.table, d.chunksTable(), d.keyCol, d.keyCol, d.keyCol, d.notExpired(),
+	)
+	rows, err := db.Query(ctx, sql, d.keyArg(key))
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+
+	var n uint32
+	for rows.Next() {
+		var chunk []byte
+		err = rows.Scan(&v.ref, &v.sum, &chunk)
+		if err != nil {
+			return v, err
+		}
+		v.data = append(v.data, chunk...)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return v, err
+	}
+	if n == 0 {
+		return v, errLargeObjectReplaced
+	}
+	if n != v.ref {
+		return v, fmt.Errorf("%w: %d chunks, expected %d", ErrCorruptValue, n, v.ref)
+	}
+	return v, nil
+}
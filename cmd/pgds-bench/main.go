@@ -0,0 +1,188 @@
+// Command pgds-bench generates load on a pgds table and reports the
+// throughput and latencies of the operations.
+//
+//	pgds-bench -conn postgres://localhost/ipfs -create-table -op put -size 4096 -concurrency 16 -duration 30s
+//
+// The get, has and query operations read the keys written by a previous put
+// run with the same -keys, and mixed runs reads and writes in the ratio of
+// -read-ratio.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// config is the configuration of a run.
+type config struct {
+	op          string
+	size        int
+	concurrency int
+	duration    time.Duration
+	keys        int
+	batchSize   int
+	readRatio   float64
+}
+
+func main() {
+	connString := flag.String("conn", os.Getenv("DATABASE_URL"), "connection string of the database")
+	table := flag.String("table", "bench", "name of the table")
+	createTable := flag.Bool("create-table", false, "create the table if it does not exist")
+	var cfg config
+	flag.StringVar(&cfg.op, "op", "put", "operation: put, get, has, query, batch or mixed")
+	flag.IntVar(&cfg.size, "size", 4096, "size of the values in bytes")
+	flag.IntVar(&cfg.concurrency, "concurrency", 8, "number of concurrent workers")
+	flag.DurationVar(&cfg.duration, "duration", 10*time.Second, "duration of the run")
+	flag.IntVar(&cfg.keys, "keys", 100000, "number of distinct keys")
+	flag.IntVar(&cfg.batchSize, "batch", 100, "number of puts in each batch")
+	flag.Float64Var(&cfg.readRatio, "read-ratio", 0.9, "fraction of gets in mixed runs")
+	flag.Parse()
+
+	if *connString == "" || cfg.concurrency < 1 || cfg.keys < 1 || cfg.batchSize < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	op, err := operation(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pgds-bench:", err)
+		os.Exit(2)
+	}
+	if err := run(*connString, *table, *createTable, cfg, op); err != nil {
+		fmt.Fprintln(os.Stderr, "pgds-bench:", err)
+		os.Exit(1)
+	}
+}
+
+// opFunc runs an operation with a random number generator of its worker.
+type opFunc func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error
+
+func key(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/bench/%012d", i))
+}
+
+// operation returns the operation of the configuration.
+func operation(cfg config) (opFunc, error) {
+	value := make([]byte, cfg.size)
+	rand.New(rand.NewSource(1)).Read(value)
+	put := func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error {
+		return d.Put(ctx, key(rnd.Intn(cfg.keys)), value)
+	}
+	get := func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error {
+		_, err := d.Get(ctx, key(rnd.Intn(cfg.keys)))
+		return err
+	}
+	switch cfg.op {
+	case "put":
+		return put, nil
+	case "get":
+		return get, nil
+	case "has":
+		return func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error {
+			_, err := d.Has(ctx, key(rnd.Intn(cfg.keys)))
+			return err
+		}, nil
+	case "query":
+		return func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error {
+			res, err := d.Query(ctx, dsq.Query{Prefix: "/bench", Offset: rnd.Intn(cfg.keys), Limit: 100, Orders: []dsq.Order{dsq.OrderByKey{}}})
+			if err != nil {
+				return err
+			}
+			_, err = res.Rest()
+			return err
+		}, nil
+	case "batch":
+		return func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error {
+			b, err := d.Batch(ctx)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < cfg.batchSize; i++ {
+				if err := b.Put(ctx, key(rnd.Intn(cfg.keys)), value); err != nil {
+					return err
+				}
+			}
+			return b.Commit(ctx)
+		}, nil
+	case "mixed":
+		return func(ctx context.Context, d *pgds.Datastore, rnd *rand.Rand) error {
+			if rnd.Float64() < cfg.readRatio {
+				return get(ctx, d, rnd)
+			}
+			return put(ctx, d, rnd)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operation %s", cfg.op)
+}
+
+func run(connString, table string, createTable bool, cfg config, op opFunc) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	d, err := pgds.NewDatastore(ctx, connString, pgds.Table(table), pgds.CreateTable(createTable), pgds.MaxConns(int32(cfg.concurrency)))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	ctx, stop := context.WithTimeout(ctx, cfg.duration)
+	defer stop()
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var errs int
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < cfg.concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			var lat []time.Duration
+			var failed int
+			for ctx.Err() == nil {
+				t := time.Now()
+				err := op(ctx, d, rnd)
+				if ctx.Err() != nil {
+					break
+				}
+				if err != nil && !errors.Is(err, ds.ErrNotFound) {
+					failed++
+					continue
+				}
+				lat = append(lat, time.Since(t))
+			}
+			mu.Lock()
+			latencies = append(latencies, lat...)
+			errs += failed
+			mu.Unlock()
+		}(int64(w))
+	}
+	wg.Wait()
+	report(cfg, latencies, errs, time.Since(start))
+	return nil
+}
+
+// report prints the throughput and latency percentiles of a run.
+func report(cfg config, latencies []time.Duration, errs int, elapsed time.Duration) {
+	fmt.Printf("op: %s, size: %d, concurrency: %d, elapsed: %s\n", cfg.op, cfg.size, cfg.concurrency, elapsed.Truncate(time.Millisecond))
+	fmt.Printf("ops: %d, errors: %d, ops/s: %.0f\n", len(latencies), errs, float64(len(latencies))/elapsed.Seconds())
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("latency p50: %s, p90: %s, p99: %s, max: %s\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// flatfs reads the entries of a flatfs datastore, which stores each value in
+// a file named after its key, in a directory of the shard of the key.
+type flatfs struct {
+	root   string
+	shards []string
+}
+
+func openFlatfs(root string) (*flatfs, error) {
+	if _, err := os.Stat(filepath.Join(root, "SHARDING")); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	f := &flatfs{root: root}
+	for _, e := range entries {
+		if e.IsDir() {
+			f.shards = append(f.shards, e.Name())
+		}
+	}
+	return f, nil
+}
+
+// path returns the file of a key, or false if the key cannot be stored in a
+// flatfs datastore.
+func (f *flatfs) path(key ds.Key) (string, bool) {
+	name := strings.TrimPrefix(key.String(), "/")
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	for _, shard := range f.shards {
+		p := filepath.Join(f.root, shard, name+".data")
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (f *flatfs) Get(_ context.Context, key ds.Key) ([]byte, error) {
+	p, ok := f.path(key)
+	if !ok {
+		return nil, ds.ErrNotFound
+	}
+	return os.ReadFile(p)
+}
+
+func (f *flatfs) Has(_ context.Context, key ds.Key) (bool, error) {
+	_, ok := f.path(key)
+	return ok, nil
+}
+
+func (f *flatfs) GetSize(_ context.Context, key ds.Key) (int, error) {
+	p, ok := f.path(key)
+	if !ok {
+		return -1, ds.ErrNotFound
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return -1, err
+	}
+	return int(fi.Size()), nil
+}
+
+// Query lists the keys of all the files, sorted, and reads the values of the
+// keys that match the query as the results are consumed. Filters on values
+// are not supported.
+func (f *flatfs) Query(_ context.Context, q dsq.Query) (dsq.Results, error) {
+	paths := map[string]string{}
+	var keys []dsq.Entry
+	for _, shard := range f.shards {
+		entries, err := os.ReadDir(filepath.Join(f.root, shard))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			name, ok := strings.CutSuffix(e.Name(), ".data")
+			if !ok || e.IsDir() {
+				continue
+			}
+			key := "/" + name
+			paths[key] = filepath.Join(f.root, shard, e.Name())
+			keys = append(keys, dsq.Entry{Key: key})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	kq := q
+	kq.KeysOnly = true
+	matched := dsq.NaiveQueryApply(kq, dsq.ResultsWithEntries(kq, keys))
+	return dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				r, ok := matched.NextSync()
+				if !ok || r.Error != nil || q.KeysOnly {
+					return r, ok
+				}
+				r.Value, r.Error = os.ReadFile(paths[r.Key])
+				if errors.Is(r.Error, fs.ErrNotExist) {
+					// removed since it was listed
+					continue
+				}
+				return r, true
+			}
+		},
+		Close: matched.Close,
+	}), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestFlatfs(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"SHARDING":        "/repo/flatfs/shard/v1/next-to-last/2\n",
+		"AB/CIQAB.data":   "b",
+		"AA/CIQAA.data":   "a",
+		"AA/CIQAA.data.x": "",
+	}
+	for name, data := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := openFlatfs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	v, err := f.Get(ctx, ds.NewKey("/CIQAB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "b" {
+		t.Fatalf("unexpected value %q", v)
+	}
+	res, err := f.Query(ctx, dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/CIQAA" || string(entries[0].Value) != "a" || entries[1].Key != "/CIQAB" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
@@ -0,0 +1,73 @@
+// Command pgds-migrate copies the blocks of the flatfs datastore of a kubo
+// repo into a pgds table.
+//
+//	pgds-migrate -flatfs ~/.ipfs/blocks -conn postgres://localhost/ipfs -create-table
+//
+// Run it again with -resume to continue a migration that was interrupted.
+// Other datastores, such as badger or leveldb, can be migrated by a program
+// that opens them with their driver and calls migrate.Migrate.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+	"github.com/ipfs/ipfs-ds-postgres/migrate"
+)
+
+func main() {
+	dir := flag.String("flatfs", "", "directory of the flatfs datastore to migrate")
+	connString := flag.String("conn", os.Getenv("DATABASE_URL"), "connection string of the database")
+	table := flag.String("table", "blocks", "name of the table")
+	createTable := flag.Bool("create-table", false, "create the table if it does not exist")
+	batchSize := flag.Int("batch", 1000, "number of entries imported in each transaction")
+	resume := flag.Bool("resume", false, "resume after the greatest key of the table")
+	flag.Parse()
+
+	if *dir == "" || *connString == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*dir, *connString, *table, *createTable, *batchSize, *resume); err != nil {
+		fmt.Fprintln(os.Stderr, "pgds-migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, connString, table string, createTable bool, batchSize int, resume bool) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	src, err := openFlatfs(dir)
+	if err != nil {
+		return err
+	}
+	dst, err := pgds.NewDatastore(ctx, connString, pgds.Table(table), pgds.CreateTable(createTable))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	start := time.Now()
+	p, err := migrate.Migrate(ctx, src, dst, migrate.Config{
+		BatchSize: batchSize,
+		Resume:    resume,
+		Progress: func(p migrate.Progress) {
+			fmt.Fprintf(os.Stderr, "\r%d entries, %d bytes, %s", p.Entries, p.Bytes, time.Since(start).Truncate(time.Second))
+		},
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		if p.LastKey != "" {
+			return fmt.Errorf("%w (imported up to %s, run again with -resume)", err, p.LastKey)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "migrated %d entries\n", p.Entries)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	dsq "github.com/ipfs/go-datastore/query"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// newFlagSet returns the flag set of a command, which reports errors rather
+// than exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// noArgs reports an error if a command that takes no arguments is given any.
+func noArgs(fs *flag.FlagSet) error {
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%s takes no arguments", fs.Name())
+	}
+	return nil
+}
+
+// prefixArg returns the optional prefix argument of a command.
+func prefixArg(fs *flag.FlagSet) (string, error) {
+	switch fs.NArg() {
+	case 0:
+		return "/", nil
+	case 1:
+		return fs.Arg(0), nil
+	}
+	return "", fmt.Errorf("%s takes a single prefix", fs.Name())
+}
+
+func schemaCommand(args []string) ([]pgds.Option, runFunc, error) {
+	fs := newFlagSet("schema")
+	checksums := fs.Bool("checksums", false, "add the checksum column")
+	ttl := fs.Bool("ttl", false, "add the expiration column")
+	journal := fs.Bool("journal", false, "create the journal of changes")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := noArgs(fs); err != nil {
+		return nil, nil, err
+	}
+	opts := []pgds.Option{pgds.Checksums(*checksums), pgds.TTL(*ttl), pgds.Journal(*journal)}
+	return opts, func(ctx context.Context, d *pgds.Datastore) error {
+		return d.EnsureSchema(ctx)
+	}, nil
+}
+
+func statsCommand(args []string) ([]pgds.Option, runFunc, error) {
+	fs := newFlagSet("stats")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := noArgs(fs); err != nil {
+		return nil, nil, err
+	}
+	return nil, func(ctx context.Context, d *pgds.Datastore) error {
+		usage, err := d.DiskUsage(ctx)
+		if err != nil {
+			return err
+		}
+		res, err := d.Query(ctx, dsq.Query{KeysOnly: true, ReturnsSizes: true})
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		var entries, size int64
+		for r := range res.Next() {
+			if r.Error != nil {
+				return r.Error
+			}
+			entries++
+			size += int64(r.Size)
+		}
+		fmt.Printf("disk usage: %d bytes\nentries: %d\nvalues: %d bytes\n", usage, entries, size)
+		return nil
+	}, nil
+}
+
+func listCommand(args []string) ([]pgds.Option, runFunc, error) {
+	fs := newFlagSet("ls")
+	limit := fs.Int("limit", 0, "maximum number of keys to list")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	prefix, err := prefixArg(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, func(ctx context.Context, d *pgds.Datastore) error {
+		res, err := d.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}, Limit: *limit})
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		w := bufio.NewWriter(os.Stdout)
+		for r := range res.Next() {
+			if r.Error != nil {
+				return r.Error
+			}
+			fmt.Fprintln(w, r.Key)
+		}
+		return w.Flush()
+	}, nil
+}
+
+func exportCommand(args []string) ([]pgds.Option, runFunc, error) {
+	fs := newFlagSet("export")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	prefix, err := prefixArg(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, func(ctx context.Context, d *pgds.Datastore) error {
+		n, err := d.Export(ctx, os.Stdout, pgds.ExportOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d entries\n", n)
+		return nil
+	}, nil
+}
+
+func importCommand(args []string) ([]pgds.Option, runFunc, error) {
+	fs := newFlagSet("import")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	prefix, err := prefixArg(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, func(ctx context.Context, d *pgds.Datastore) error {
+		n, err := d.Import(ctx, bufio.NewReader(os.Stdin), pgds.ImportOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "imported %d entries\n", n)
+		return nil
+	}, nil
+}
+
+func checkCommand(args []string) ([]pgds.Option, runFunc, error) {
+	fs := newFlagSet("check")
+	scrub := fs.Bool("scrub", false, "verify the checksum of every row")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := noArgs(fs); err != nil {
+		return nil, nil, err
+	}
+	return []pgds.Option{pgds.Checksums(*scrub)}, func(ctx context.Context, d *pgds.Datastore) error {
+		if err := d.Check(ctx); err != nil {
+			return err
+		}
+		if *scrub {
+			if err := d.Scrub(ctx); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(os.Stderr, "ok")
+		return nil
+	}, nil
+}
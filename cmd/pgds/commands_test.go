@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestSetup(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"ls"}, true},
+		{[]string{"ls", "-limit", "10", "/blocks"}, true},
+		{[]string{"ls", "/blocks", "/pins"}, false},
+		{[]string{"schema", "-checksums", "-ttl"}, true},
+		{[]string{"schema", "-unknown"}, false},
+		{[]string{"stats", "extra"}, false},
+		{[]string{"check", "-scrub"}, true},
+	} {
+		_, run, err := commands[c.args[0]].setup(c.args[1:])
+		if c.ok && (err != nil || run == nil) {
+			t.Fatalf("%v: unexpected error %v", c.args, err)
+		}
+		if !c.ok && err == nil {
+			t.Fatalf("%v: expected an error", c.args)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Command pgds manages a pgds table from the command line.
+//
+//	pgds [-conn connstring] [-table name] command [flags]
+//
+// The commands are:
+//
+//	schema   create the table, or add the columns and indexes of the options
+//	stats    print the size of the table and the number of entries
+//	ls       list the keys under a prefix
+//	export   write the entries under a prefix to stdout
+//	import   read entries written by export from stdin, under a prefix
+//	check    verify the table, and optionally the checksums of its rows
+//
+// The connection string defaults to the DATABASE_URL environment variable.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// runFunc runs a command on the datastore.
+type runFunc func(ctx context.Context, d *pgds.Datastore) error
+
+type command struct {
+	usage string
+	// setup parses the arguments of the command, and returns the options of
+	// the datastore it needs and the function that runs it.
+	setup func(args []string) ([]pgds.Option, runFunc, error)
+}
+
+var commands = map[string]command{
+	"schema": {usage: "schema [-checksums] [-ttl] [-journal]", setup: schemaCommand},
+	"stats":  {usage: "stats", setup: statsCommand},
+	"ls":     {usage: "ls [-limit n] [prefix]", setup: listCommand},
+	"export": {usage: "export [prefix]", setup: exportCommand},
+	"import": {usage: "import [prefix]", setup: importCommand},
+	"check":  {usage: "check [-scrub]", setup: checkCommand},
+}
+
+func main() {
+	connString := flag.String("conn", os.Getenv("DATABASE_URL"), "connection string of the database")
+	table := flag.String("table", "blocks", "name of the table")
+	schema := flag.String("schema", "", "schema of the table")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || *connString == "" {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "pgds: unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	opts, run, err := cmd.setup(flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pgds:", err)
+		os.Exit(2)
+	}
+	options := append([]pgds.Option{pgds.Table(*table), pgds.Schema(*schema)}, opts...)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	err = func() error {
+		d, err := pgds.NewDatastore(ctx, *connString, options...)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		return run(ctx, d)
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pgds:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pgds [-conn connstring] [-table name] [-schema name] command [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range []string{"schema", "stats", "ls", "export", "import", "check"} {
+		fmt.Fprintln(os.Stderr, "  pgds", commands[name].usage)
+	}
+}
@@ -0,0 +1,112 @@
+package pgds
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type componentKey struct{}
+type traceParentKey struct{}
+
+// WithComponent returns a context that attributes the statements run with it
+// to the given component, when the SQLComments option is set.
+func WithComponent(ctx context.Context, component string) context.Context {
+	return context.WithValue(ctx, componentKey{}, component)
+}
+
+// WithTraceParent returns a context that attributes the statements run with it
+// to the given W3C traceparent, when the SQLComments option is set.
+func WithTraceParent(ctx context.Context, traceParent string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceParent)
+}
+
+// sqlComment returns the sqlcommenter-style comment appended to the
+// statements of an operation run with the given context.
+func sqlComment(ctx context.Context, op string) string {
+	fields := map[string]string{"op": op}
+	if component, ok := ctx.Value(componentKey{}).(string); ok && component != "" {
+		fields["component"] = component
+	}
+	if traceParent, ok := ctx.Value(traceParentKey{}).(string); ok && traceParent != "" {
+		fields["traceparent"] = traceParent
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		// escaping also removes any "*/" that would end the comment
+		pairs = append(pairs, k+"='"+url.PathEscape(fields[k])+"'")
+	}
+	return " /*" + strings.Join(pairs, ",") + "*/"
+}
+
+// annotate returns a querier that appends the comment of the operation to
+// the statements it runs, if the SQLComments option is set.
+func (d *Datastore) annotate(ctx context.Context, op string, db querier) querier {
+	if !d.sqlComments {
+		return db
+	}
+	return &commentedQuerier{querier: db, comment: sqlComment(ctx, op)}
+}
+
+// commentSQL appends the comment of the operation to a statement, if the
+// SQLComments option is set.
+func (d *Datastore) commentSQL(ctx context.Context, op string, sql string) string {
+	if !d.sqlComments {
+		return sql
+	}
+	return sql + sqlComment(ctx, op)
+}
+
+type commentedQuerier struct {
+	querier
+	comment string
+}
+
+func (q *commentedQuerier) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return q.querier.Exec(ctx, sql+q.comment, args...)
+}
+
+func (q *commentedQuerier) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return q.querier.Query(ctx, sql+q.comment, args...)
+}
+
+func (q *commentedQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return q.querier.QueryRow(ctx, sql+q.comment, args...)
+}
+
+func (q *commentedQuerier) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := q.querier.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &commentedTx{Tx: tx, comment: q.comment}, nil
+}
+
+// commentedTx is a transaction that appends a comment to the statements it
+// runs.
+type commentedTx struct {
+	pgx.Tx
+	comment string
+}
+
+func (tx *commentedTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return tx.Tx.Exec(ctx, sql+tx.comment, args...)
+}
+
+func (tx *commentedTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return tx.Tx.Query(ctx, sql+tx.comment, args...)
+}
+
+func (tx *commentedTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return tx.Tx.QueryRow(ctx, sql+tx.comment, args...)
+}
@@ -0,0 +1,191 @@
+package pgds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// CompressionAlgorithm is an algorithm values are compressed with.
+type CompressionAlgorithm string
+
+const (
+	// CompressionZstd compresses values with Zstandard, which compresses
+	// best.
+	CompressionZstd CompressionAlgorithm = "zstd"
+	// CompressionLZ4 compresses values with the block format of LZ4, which
+	// decompresses fastest.
+	CompressionLZ4 CompressionAlgorithm = "lz4"
+	// CompressionSnappy compresses values with the block format of Snappy.
+	CompressionSnappy CompressionAlgorithm = "snappy"
+)
+
+// The format byte that starts the values of a table with compression, which
+// is followed by the size of the value as a big endian uint32 and the
+// possibly compressed value.
+const (
+	formatNone byte = iota
+	formatZstd
+	formatLZ4
+	formatSnappy
+
+	compressionHeaderSize = 5
+)
+
+var compressionFormats = map[CompressionAlgorithm]byte{
+	CompressionZstd:   formatZstd,
+	CompressionLZ4:    formatLZ4,
+	CompressionSnappy: formatSnappy,
+}
+
+// ErrCorruptValue is returned when a stored value cannot be decompressed or
+// decrypted.
+var ErrCorruptValue = errors.New("corrupt value")
+
+// the encoder and decoder of zstd are safe for concurrent use
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil)
+		return dec
+	})
+)
+
+// compressor compresses the values of a datastore.
+type compressor struct {
+	format  byte
+	minSize int
+}
+
+// encode returns the value as stored: compressed if it is at least minSize
+// bytes long and compressing it saves space, otherwise as it is, which is
+// always the case for a nil compressor.
+func (c *compressor) encode(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	out := make([]byte, compressionHeaderSize, compressionHeaderSize+len(value))
+	out[0] = formatNone
+	binary.BigEndian.PutUint32(out[1:], uint32(len(value)))
+	if c != nil && len(value) >= c.minSize {
+		var compressed []byte
+		switch c.format {
+		case formatZstd:
+			compressed = zstdEncoder().EncodeAll(value, out)
+		case formatLZ4:
+			buf := make([]byte, compressionHeaderSize+lz4.CompressBlockBound(len(value)))
+			copy(buf, out)
+			// n is 0 if the value is incompressible
+			n, err := lz4.CompressBlock(value, buf[compressionHeaderSize:], nil)
+			if err == nil && n > 0 {
+				compressed = buf[:compressionHeaderSize+n]
+			}
+		case formatSnappy:
+			buf := snappy.Encode(make([]byte, snappy.MaxEncodedLen(len(value))), value)
+			compressed = append(out, buf...)
+		}
+		if compressed != nil && len(compressed)-compressionHeaderSize < len(value) {
+			compressed[0] = c.format
+			return compressed
+		}
+	}
+	return append(out, value...)
+}
+
+// decodeValue returns a value as it was put, from its stored form in a table
+// with compression.
+func decodeValue(stored []byte) ([]byte, error) {
+	if stored == nil {
+		return nil, nil
+	}
+	if len(stored) < compressionHeaderSize {
+		return nil, fmt.Errorf("%w: short header", ErrCorruptValue)
+	}
+	size := int(binary.BigEndian.Uint32(stored[1:]))
+	data := stored[compressionHeaderSize:]
+	var value []byte
+	var err error
+	switch stored[0] {
+	case formatNone:
+		value = data
+	case formatZstd:
+		value, err = zstdDecoder().DecodeAll(data, make([]byte, 0, size))
+	case formatLZ4:
+		value = make([]byte, size)
+		var n int
+		n, err = lz4.UncompressBlock(data, value)
+		value = value[:n]
+	case formatSnappy:
+		value, err = snappy.Decode(make([]byte, size), data)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %d", ErrCorruptValue, stored[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptValue, err)
+	}
+	if len(value) != size {
+		return nil, fmt.Errorf("%w: size %d, expected %d", ErrCorruptValue, len(value), size)
+	}
+	return value, nil
+}
+
+// encodesValues reports whether values are stored with a header, because they
+// are compressed or encrypted.
+func (d *Datastore) encodesValues() bool {
+	return d.compression != nil || d.encryption != nil
+}
+
+// comparesValues reports whether values can be compared and ordered in SQL,
+// which they cannot be if they are encoded or may be stored outside their
+// rows.
+func (d *Datastore) comparesValues() bool {
+	return !d.encodesValues() && !d.largeValues()
+}
+
+// decode returns a value as it was put from its stored form.
+func (d *Datastore) decode(stored []byte) ([]byte, error) {
+	if stored == nil || !d.encodesValues() {
+		return stored, nil
+	}
+	if d.encryption != nil && len(stored) > 0 && stored[0]&formatEncrypted != 0 {
+		encoded, err := d.encryption.open(stored)
+		if err != nil {
+			return nil, err
+		}
+		return decodeValue(encoded)
+	}
+	return decodeValue(stored)
+}
+
+// sizeExpr returns the expression of the size of the value of a row, which
+// tables with compression or encryption store in the header of the value.
+// The size of a value stored outside its row is read without reading the
+// value.
+func (d *Datastore) sizeExpr() string {
+	value := d.valueExpr()
+	if !d.encodesValues() {
+		switch {
+		case d.loThreshold > 0:
+			return fmt.Sprintf("coalesce(octet_length(%s), lo_lseek64(lo_open(lo, %d), 0, 2))", value, invRead)
+		case d.chunkSize > 0:
+			return fmt.Sprintf("coalesce(octet_length(%s), (SELECT sum(octet_length(chunk)) FROM %s WHERE %s = %s.%s))", value, d.chunksTable(), d.keyCol, d.table, d.keyCol)
+		}
+		return fmt.Sprintf("octet_length(%s)", value)
+	}
+	// the header is at the start of the large object or first chunk
+	switch {
+	case d.loThreshold > 0:
+		value = fmt.Sprintf("coalesce(%s, lo_get(lo, 0, %d))", value, compressionHeaderSize)
+	case d.chunkSize > 0:
+		value = fmt.Sprintf("coalesce(%s, (SELECT chunk FROM %s WHERE %s = %s.%s AND seq = 0))", value, d.chunksTable(), d.keyCol, d.table, d.keyCol)
+	}
+	return fmt.Sprintf("(get_byte(%[1]s, 1) << 24 | get_byte(%[1]s, 2) << 16 | get_byte(%[1]s, 3) << 8 | get_byte(%[1]s, 4))", value)
+}
@@ -0,0 +1,118 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	dstest "github.com/ipfs/go-datastore/test"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+)
+
+var (
+	startOnce sync.Once
+	container *postgres.PostgresContainer
+	startConn string
+	startErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if container != nil {
+		_ = testcontainers.TerminateContainer(container)
+	}
+	os.Exit(code)
+}
+
+// connString returns the connection string of the test database, starting
+// a container the first time it is called unless PG_CONN is set.
+func connString(t *testing.T) string {
+	if conn := os.Getenv("PG_CONN"); conn != "" {
+		return conn
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	startOnce.Do(func() {
+		ctx := context.Background()
+		container, startErr = postgres.Run(ctx, "postgres:16-alpine", postgres.BasicWaitStrategies())
+		if startErr != nil {
+			return
+		}
+		startConn, startErr = container.ConnectionString(ctx, "sslmode=disable")
+	})
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+	return startConn
+}
+
+// configs are the configurations the suites run with, each with a table of
+// its own.
+var configs = []struct {
+	name    string
+	options []pgds.Option
+}{
+	{"default", nil},
+	{"checksums and ttl", []pgds.Option{pgds.Checksums(true), pgds.TTL(true)}},
+	{"bytea keys", []pgds.Option{pgds.ByteaKeys(true)}},
+	{"brin index", []pgds.Option{pgds.BRINIndex(32)}},
+	{"hash partitions", []pgds.Option{pgds.HashPartitions(4)}},
+	{"key prefix", []pgds.Option{pgds.KeyPrefix("/prefix")}},
+	{"namespace tables", []pgds.Option{pgds.NamespaceTables(map[string]string{"/1": "conformance_ns"})}},
+	{"fetch size", []pgds.Option{pgds.QueryFetchSize(3)}},
+	{"go-ds-sql", []pgds.Option{pgds.GoDSSQLCompat(true)}},
+}
+
+func newDatastore(t *testing.T, options []pgds.Option) *pgds.Datastore {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connString(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drop := func() {
+		_, err := conn.Exec(ctx, "DROP TABLE IF EXISTS conformance, conformance_ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	drop()
+	options = append([]pgds.Option{pgds.Table("conformance"), pgds.CreateTable(true)}, options...)
+	d, err := pgds.NewDatastore(ctx, connString(t), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = d.Close()
+		drop()
+		_ = conn.Close(ctx)
+	})
+	return d
+}
+
+func TestSuite(t *testing.T) {
+	for _, c := range configs {
+		t.Run(c.name, func(t *testing.T) {
+			dstest.SubtestAll(t, newDatastore(t, c.options))
+		})
+	}
+}
+
+func TestBatch(t *testing.T) {
+	for _, c := range configs {
+		t.Run(c.name, func(t *testing.T) {
+			for i, test := range []func(*testing.T, *pgds.Datastore){
+				func(t *testing.T, d *pgds.Datastore) { dstest.RunBatchTest(t, d) },
+				func(t *testing.T, d *pgds.Datastore) { dstest.RunBatchDeleteTest(t, d) },
+				func(t *testing.T, d *pgds.Datastore) { dstest.RunBatchPutAndDeleteTest(t, d) },
+			} {
+				t.Run(fmt.Sprint(i), func(t *testing.T) {
+					test(t, newDatastore(t, c.options))
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+// Package conformance runs the go-datastore test suites against pgds, with
+// the datastore configured in each of the ways that change how keys are
+// stored and queried.
+//
+// The tests use the database of the PG_CONN connection string if it is set,
+// or start PostgreSQL in a container with testcontainers, and are skipped if
+// neither is available:
+//
+//	cd conformance && go test ./...
+//
+// It is a module of its own so that the dependencies of testcontainers are
+// not dependencies of pgds.
+package conformance
@@ -0,0 +1,105 @@
+package pgds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// Count returns the number of keys under the given prefix, as a query with
+// the prefix would, in the table and in the tables of NamespaceTables. The
+// keys are counted by the server without being sent to the client, but every
+// matching row or index entry is still visited.
+func (d *Datastore) Count(ctx context.Context, prefix ds.Key) (int64, error) {
+	var total int64
+	for _, td := range d.prefixTables(prefix) {
+		n, err := td.count(ctx, prefix)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// EstimateCount returns an estimate of the number of keys under the given
+// prefix, from the statistics the planner estimates the rows of the query
+// with, which is only as accurate as the last ANALYZE of the table but takes
+// the same time whatever the number of keys. On other dialects the keys are
+// counted.
+func (d *Datastore) EstimateCount(ctx context.Context, prefix ds.Key) (int64, error) {
+	var total int64
+	for _, td := range d.prefixTables(prefix) {
+		n, err := td.estimateCount(ctx, prefix)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// count counts the keys of the table under the prefix.
+func (d *Datastore) count(ctx context.Context, prefix ds.Key) (n int64, err error) {
+	sql, args := d.countQuery("count(*)", prefix)
+	err = d.do(ctx, opCount, prefix.String(), func(ctx context.Context) error {
+		return d.annotate(ctx, opCount, d.reader(ctx)).QueryRow(ctx, sql, args...).Scan(&n)
+	})
+	return n, err
+}
+
+// estimateCount estimates the number of keys of the table under the prefix.
+func (d *Datastore) estimateCount(ctx context.Context, prefix ds.Key) (int64, error) {
+	if d.dialect != DialectPostgres {
+		return d.count(ctx, prefix)
+	}
+	sql, args := d.countQuery("1", prefix)
+	var plan []byte
+	err := d.do(ctx, opEstimateCount, prefix.String(), func(ctx context.Context) error {
+		// the arguments are interpolated, so that the rows are estimated
+		// for them rather than for a generic plan
+		args := append([]any{pgx.QueryExecModeSimpleProtocol}, args...)
+		return d.annotate(ctx, opEstimateCount, d.reader(ctx)).QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+sql, args...).Scan(&plan)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return planRows(plan)
+}
+
+// countQuery returns the statement that selects the given expression from
+// the rows of the keys under the given prefix that match the given
+// conditions, and its arguments.
+func (d *Datastore) countQuery(expr string, prefix ds.Key, conds ...string) (string, []any) {
+	where, args := d.prefixWhere(d.prefixKey(prefix).String(), conds, nil)
+	if d.ttl {
+		where = append(where, notExpiredPredicate)
+	}
+	sql := fmt.Sprintf("SELECT %s FROM %s", expr, d.table)
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	return sql, args
+}
+
+// planRows returns the rows estimated by a plan in the JSON format of
+// EXPLAIN.
+func planRows(plan []byte) (int64, error) {
+	var plans []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal(plan, &plans); err != nil {
+		return 0, err
+	}
+	if len(plans) == 0 {
+		return 0, fmt.Errorf("invalid plan: %s", plan)
+	}
+	return int64(math.Round(plans[0].Plan.Rows)), nil
+}
@@ -0,0 +1,52 @@
+package pgds
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CredentialsProvider provides the credentials of new connections, so that a
+// rotated password is used by the connections made after the rotation while
+// open connections are kept. The user is left as in the connection string when
+// empty.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (user, password string, err error)
+}
+
+// CredentialsFunc adapts a function to a CredentialsProvider.
+type CredentialsFunc func(ctx context.Context) (user, password string, err error)
+
+// Credentials calls f.
+func (f CredentialsFunc) Credentials(ctx context.Context) (string, string, error) {
+	return f(ctx)
+}
+
+// FileCredentials returns a provider that reads the password of each new
+// connection from the file at path, such as a Kubernetes secret mounted as a
+// volume or a file written by the Vault agent, which are updated in place when
+// the secret is rotated. Trailing newlines are removed.
+func FileCredentials(path string) CredentialsProvider {
+	return CredentialsFunc(func(ctx context.Context) (string, string, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", err
+		}
+		return "", strings.TrimRight(string(b), "\r\n"), nil
+	})
+}
+
+// setCredentials sets the credentials of a new connection from the provider.
+func (o *Options) setCredentials(ctx context.Context, config *pgx.ConnConfig) error {
+	user, password, err := o.CredentialsProvider.Credentials(ctx)
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		config.User = user
+	}
+	config.Password = password
+	return nil
+}
@@ -0,0 +1,106 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// resultRows are the methods of pgx.Rows used to iterate over query results.
+type resultRows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close()
+}
+
+// cursorID is used to give each cursor a unique name.
+var cursorID atomic.Uint64
+
+// cursor iterates over the results of a query using a server-side cursor,
+// fetching a fixed number of rows at a time.
+type cursor struct {
+	ctx       context.Context
+	tx        pgx.Tx
+	name      string
+	fetchSize int
+
+	rows    pgx.Rows
+	fetched int // rows read from the current fetch
+	err     error
+}
+
+// openCursor declares a cursor for the query in a new transaction, or a
+// savepoint if db is already a transaction, and fetches the first rows.
+func openCursor(ctx context.Context, db querier, fetchSize int, sql string, args ...any) (*cursor, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cursor{
+		ctx:       ctx,
+		tx:        tx,
+		name:      fmt.Sprintf("pgds_cursor_%d", cursorID.Add(1)),
+		fetchSize: fetchSize,
+	}
+	// the statements are not cached as every cursor has a different name
+	declare := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", c.name, sql)
+	_, err = tx.Exec(ctx, declare, append([]any{pgx.QueryExecModeDescribeExec}, args...)...)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	err = c.fetch()
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *cursor) fetch() error {
+	rows, err := c.tx.Query(c.ctx, fmt.Sprintf("FETCH %d FROM %s", c.fetchSize, c.name), pgx.QueryExecModeDescribeExec)
+	if err != nil {
+		return err
+	}
+	c.rows = rows
+	c.fetched = 0
+	return nil
+}
+
+func (c *cursor) Next() bool {
+	for c.err == nil {
+		if c.rows.Next() {
+			c.fetched++
+			return true
+		}
+		c.rows.Close()
+		if c.err = c.rows.Err(); c.err != nil {
+			return false
+		}
+		// a short fetch means the cursor is exhausted
+		if c.fetched < c.fetchSize {
+			return false
+		}
+		c.err = c.fetch()
+	}
+	return false
+}
+
+func (c *cursor) Scan(dest ...any) error {
+	return c.rows.Scan(dest...)
+}
+
+func (c *cursor) Err() error {
+	return c.err
+}
+
+// Close closes the cursor by rolling back the transaction it was declared in,
+// which only read from the database.
+func (c *cursor) Close() {
+	c.rows.Close()
+	_ = c.tx.Rollback(c.ctx)
+}
@@ -3,30 +3,354 @@ package pgds
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
-	dsq "github.com/ipfs/go-datastore/query"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/tracelog"
 )
 
+// querier is the subset of methods shared by a pool of connections and a
+// transaction that the datastore uses to run statements.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
 // Datastore is a PostgreSQL backed datastore.
 type Datastore struct {
-	table string
-	pool  *pgxpool.Pool
+	tableName string
+	table     string // quoted
+	pool      *pgxpool.Pool
+	ownsPool  bool
+
+	vacuumFull  bool
+	checksums   bool
+	scrubRepair bool
+	fetchSize   int
+
+	batchMaxOps   int
+	batchMaxBytes int
+
+	journal bool
+
+	ttl            bool
+	sweepBatchSize int
+	sweepCancel    context.CancelFunc
+	sweepWg        sync.WaitGroup
+
+	metrics       *metrics
+	logger        tracelog.Logger
+	logLevel      tracelog.LogLevel
+	slowThreshold time.Duration
+	breaker       *breaker
+	retryPolicy   RetryPolicy
+
+	replicas      []*pgxpool.Pool
+	ownedReplicas []*pgxpool.Pool
+	nextReplica   atomic.Uint64
+
+	failover *failover
+	readOnly bool
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	scanTimeout  time.Duration
+
+	sqlComments bool
+
+	dialect       SQLDialect
+	serverVersion int
+
+	distributed    bool
+	hypertable     *HypertableConfig
+	namespaces     []string
+	hashPartitions int
+	hashIndex      bool
+	brinPages      int
+	partialIndexes []string
+	byteaKeys      bool
+	ltreeKeys      bool
+	partition      *partitionColumn
+	merge          bool
+	unlogged       bool
+
+	storageParams []string
+
+	// the names of the key and data columns, and the names quoted
+	keyName  string
+	keyCol   string
+	dataName string
+	dataCol  string
+
+	// the tables of NamespaceTables, by descending length of namespace
+	tables []namespaceTable
+
+	// the prefix of the keys stored in the table, or empty
+	keyPrefix string
+
+	goDSSQL bool
+
+	// puts skip the keys that are already stored
+	immutable bool
+
+	// compresses values, or nil
+	compression *compressor
+
+	// encrypts values, or nil
+	encryption *encryptor
+
+	// reads verify values against their checksum
+	verifyChecksums bool
+
+	// values are stored once in the content table
+	dedup bool
+
+	// the size above which values are stored in large objects, or 0
+	loThreshold int
+
+	// the size of the chunks values are split into, or 0
+	chunkSize int
+
+	// the size of the largest value that can be put, or 0
+	maxValueSize int
+
+	// rows put again with the same value are not updated
+	skipUnchanged bool
+	// writes are committed without waiting for their WAL to be flushed
+	asyncCommit bool
+
+	// the statements of the hot paths, which are only formatted once
+	getSQL, hasSQL, getSizeSQL, deleteSQL string
+
+	// the faults injected into operations, or nil
+	faults atomic.Pointer[faultInjector]
 }
 
 // NewDatastore creates a new PostgreSQL datastore
 func NewDatastore(ctx context.Context, connString string, options ...Option) (*Datastore, error) {
 	cfg := Options{}
-	cfg.Apply(append([]Option{OptionDefaults}, options...)...)
+	err := cfg.Apply(append([]Option{OptionDefaults}, options...)...)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := cfg.newPool(ctx, connString, cfg.Failover)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDatastore(ctx, pool, cfg)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	d.ownsPool = true
+	return d, nil
+}
 
-	pool, err := pgxpool.Connect(ctx, connString)
+// NewDatastoreWithPool creates a new PostgreSQL datastore that uses an
+// existing pool of connections. The pool is not closed when the datastore is
+// closed.
+func NewDatastoreWithPool(ctx context.Context, pool *pgxpool.Pool, options ...Option) (*Datastore, error) {
+	cfg := Options{}
+	err := cfg.Apply(append([]Option{OptionDefaults}, options...)...)
 	if err != nil {
 		return nil, err
 	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return newDatastore(ctx, pool, cfg)
+}
 
-	return &Datastore{table: cfg.Table, pool: pool}, nil
+func newDatastore(ctx context.Context, pool *pgxpool.Pool, cfg Options) (*Datastore, error) {
+	tableName := cfg.Table
+	if cfg.Schema != "" && !strings.Contains(tableName, ".") {
+		tableName = cfg.Schema + "." + tableName
+	}
+	d := &Datastore{
+		tableName:      tableName,
+		table:          quoteTable(tableName),
+		keyName:        cfg.KeyColumn,
+		keyCol:         pgx.Identifier{cfg.KeyColumn}.Sanitize(),
+		dataName:       cfg.DataColumn,
+		dataCol:        pgx.Identifier{cfg.DataColumn}.Sanitize(),
+		pool:           pool,
+		vacuumFull:     cfg.VacuumFull,
+		checksums:      cfg.Checksums,
+		scrubRepair:    cfg.ScrubRepair,
+		fetchSize:      cfg.QueryFetchSize,
+		batchMaxOps:    cfg.BatchMaxOps,
+		batchMaxBytes:  cfg.BatchMaxBytes,
+		journal:        cfg.Journal,
+		ttl:            cfg.TTL,
+		sweepBatchSize: cfg.SweepBatchSize,
+		metrics:        newMetrics(tableName),
+		logger:         cfg.logger(),
+		logLevel:       cfg.LogLevel,
+		slowThreshold:  cfg.SlowQueryThreshold,
+		retryPolicy:    cfg.RetryPolicy,
+	}
+	if cfg.CircuitBreakerThreshold > 0 {
+		d.breaker = newBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	}
+	if cfg.Failover {
+		d.failover = &failover{}
+	}
+	d.readOnly = cfg.ReadOnly
+	d.readTimeout = cfg.ReadTimeout
+	d.writeTimeout = cfg.WriteTimeout
+	d.scanTimeout = cfg.ScanTimeout
+	d.sqlComments = cfg.SQLComments
+	d.distributed = cfg.Distributed
+	d.hypertable = cfg.Hypertable
+	d.namespaces = cfg.PartitionNamespaces
+	d.hashPartitions = cfg.HashPartitions
+	d.hashIndex = cfg.HashIndex
+	d.brinPages = cfg.BRINPagesPerRange
+	d.partialIndexes = cfg.PartialIndexes
+	d.byteaKeys = cfg.ByteaKeys
+	d.ltreeKeys = cfg.LtreeKeys
+	d.keyPrefix = cfg.KeyPrefix
+	d.goDSSQL = cfg.GoDSSQLCompat
+	d.immutable = cfg.ImmutableValues
+	d.verifyChecksums = cfg.VerifyChecksums
+	d.dedup = cfg.Dedup
+	d.loThreshold = cfg.LargeObjectThreshold
+	d.chunkSize = cfg.ChunkSize
+	d.maxValueSize = cfg.MaxValueSize
+	d.skipUnchanged = cfg.SkipUnchanged
+	d.asyncCommit = cfg.AsyncCommit
+	if cfg.Compression != "" {
+		d.compression = &compressor{format: compressionFormats[cfg.Compression], minSize: cfg.CompressionMinSize}
+	}
+	if cfg.Encryption != nil {
+		e, err := newEncryptor(cfg.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		d.encryption = e
+	}
+	if cfg.Faults != nil {
+		fi, err := newFaultInjector(*cfg.Faults)
+		if err != nil {
+			return nil, err
+		}
+		d.faults.Store(fi)
+	}
+	if d.hypertable != nil {
+		d.partition = timePartition(d.hypertable.KeyTime)
+	} else if len(d.namespaces) > 0 {
+		d.partition = namespacePartition
+	}
+	d.unlogged = cfg.Unlogged
+	d.storageParams = cfg.storageParameters()
+	d.dialect = cfg.Dialect
+	if !cfg.LazyConnect {
+		dialect, version, err := detectServer(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		if d.dialect == "" {
+			d.dialect = dialect
+		}
+		d.serverVersion = version
+	}
+	if d.dialect == "" {
+		d.dialect = DialectPostgres
+	}
+	d.getSQL = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1%s", d.valueCols(), d.table, d.keyCol, d.notExpired())
+	d.hasSQL = fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE %s = $1%s)", d.table, d.keyCol, d.notExpired())
+	d.getSizeSQL = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1%s", d.sizeExpr(), d.table, d.keyCol, d.notExpired())
+	d.deleteSQL = fmt.Sprintf("DELETE FROM %s WHERE %s = $1", d.table, d.keyCol)
+	// fail clearly now rather than with syntax errors on first use
+	if err := d.requireVersion("upserting rows with ON CONFLICT", 90500); err != nil {
+		return nil, err
+	}
+	if cfg.CreateTable {
+		if err := d.requireVersion("creating the table with ADD COLUMN IF NOT EXISTS", 90600); err != nil {
+			return nil, err
+		}
+	}
+	// MERGE is not used on partitioned tables, whose rows are matched on
+	// their partition as well
+	d.merge = cfg.Merge && d.dialect == DialectPostgres && d.serverVersion >= 150000 && d.partition == nil && !d.immutable && !d.dedup && !d.largeValues()
+	if d.partitioned() {
+		if err := d.requireVersion("partitioning", 110000); err != nil {
+			return nil, err
+		}
+	}
+	if d.hashIndex {
+		if err := d.supports("hash index"); err != nil {
+			return nil, err
+		}
+		// hash indexes are only crash safe since they are written to the WAL
+		if err := d.requireVersion("hash index", 100000); err != nil {
+			return nil, err
+		}
+	}
+	if d.ltreeKeys {
+		if err := d.supports("ltree keys"); err != nil {
+			return nil, err
+		}
+		// the path column is a generated column
+		if err := d.requireVersion("ltree keys", 120000); err != nil {
+			return nil, err
+		}
+	}
+	if d.brinPages > 0 {
+		if err := d.supports("BRIN index"); err != nil {
+			return nil, err
+		}
+	}
+	if d.journal {
+		if err := d.supports("journal"); err != nil {
+			return nil, err
+		}
+		if err := d.requireVersion("journal", 100000); err != nil {
+			return nil, err
+		}
+	}
+	d.replicas = append(d.replicas, cfg.ReadReplicaPools...)
+	for _, connString := range cfg.ReadReplicas {
+		replica, err := cfg.newPool(ctx, connString, false)
+		if err != nil {
+			d.closeReplicas()
+			return nil, err
+		}
+		d.replicas = append(d.replicas, replica)
+		d.ownedReplicas = append(d.ownedReplicas, replica)
+	}
+	if cfg.CreateTable {
+		err := d.EnsureSchema(ctx)
+		if err != nil {
+			d.closeReplicas()
+			return nil, err
+		}
+	}
+	if err := d.openNamespaceTables(ctx, pool, cfg); err != nil {
+		d.closeNamespaceTables()
+		d.closeReplicas()
+		return nil, err
+	}
+	if cfg.preparer != nil {
+		cfg.preparer.add(d.preparedStatements()...)
+	}
+	if (d.ttl || d.dedup) && cfg.SweepInterval > 0 && !d.readOnly {
+		d.startSweeper(cfg.SweepInterval)
+	}
+	return d, nil
 }
 
 // PgxPool exposes the underlying pool of connections to Postgres.
@@ -34,18 +358,37 @@ func (d *Datastore) PgxPool() *pgxpool.Pool {
 	return d.pool
 }
 
-// Close closes the underying PostgreSQL database.
+// Close closes the underying PostgreSQL database, unless the datastore was
+// created with an existing pool.
 func (d *Datastore) Close() error {
-	if d.pool != nil {
+	d.closeNamespaceTables()
+	if d.sweepCancel != nil {
+		d.sweepCancel()
+		d.sweepWg.Wait()
+	}
+	if d.ownsPool && d.pool != nil {
 		d.pool.Close()
 	}
+	d.closeReplicas()
 	return nil
 }
 
 // Delete removes a row from the PostgreSQL database by the given key.
 func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
-	sql := fmt.Sprintf("DELETE FROM %s WHERE key = $1", d.table)
-	_, err := d.pool.Exec(ctx, sql, key.String())
+	if td := d.route(key); td != d {
+		return td.Delete(ctx, key)
+	}
+	key = d.prefixKey(key)
+	if err := d.writable(); err != nil {
+		return err
+	}
+	return d.do(ctx, opDelete, key.String(), func(ctx context.Context) error {
+		return d.delete(ctx, d.annotate(ctx, opDelete, d.pool), key)
+	})
+}
+
+func (d *Datastore) delete(ctx context.Context, db querier, key ds.Key) error {
+	_, err := db.Exec(ctx, d.deleteSQL, d.keyArg(key.String()))
 	if err != nil {
 		return err
 	}
@@ -54,23 +397,59 @@ func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
 
 // Get retrieves a value from the PostgreSQL database by the given key.
 func (d *Datastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
-	sql := fmt.Sprintf("SELECT data FROM %s WHERE key = $1", d.table)
-	row := d.pool.QueryRow(ctx, sql, key.String())
-	var out []byte
-	switch err := row.Scan(&out); err {
+	return d.AppendValue(ctx, key, nil)
+}
+
+// AppendValue appends the value of the given key to buf and returns the
+// extended buffer, as Get does with a nil buffer. Readers of many values can
+// reuse a buffer between calls, once they no longer use the value it holds,
+// to avoid allocating one per value. On error buf is returned unchanged.
+func (d *Datastore) AppendValue(ctx context.Context, key ds.Key, buf []byte) (value []byte, err error) {
+	if td := d.route(key); td != d {
+		return td.AppendValue(ctx, key, buf)
+	}
+	key = d.prefixKey(key)
+	err = d.do(ctx, opGet, key.String(), func(ctx context.Context) error {
+		value, err = d.get(ctx, d.annotate(ctx, opGet, d.reader(ctx)), key, buf)
+		if err == nil {
+			d.metrics.bytesRead.Add(int64(len(value) - len(buf)))
+		}
+		return err
+	})
+	if err != nil {
+		return buf, err
+	}
+	return value, nil
+}
+
+func (d *Datastore) get(ctx context.Context, db querier, key ds.Key, buf []byte) ([]byte, error) {
+	s := d.newValueScan(false)
+	s.buf = buf
+	switch err := db.QueryRow(ctx, d.getSQL, d.keyArg(key.String())).Scan(s.dest...); err {
 	case pgx.ErrNoRows:
 		return nil, ds.ErrNotFound
 	case nil:
-		return out, nil
+		return d.value(ctx, db, key.String(), s)
 	default:
 		return nil, err
 	}
 }
 
 // Has determines if a value for the given key exists in the PostgreSQL database.
-func (d *Datastore) Has(ctx context.Context, key ds.Key) (bool, error) {
-	sql := fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE key = $1)", d.table)
-	row := d.pool.QueryRow(ctx, sql, key.String())
+func (d *Datastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	if td := d.route(key); td != d {
+		return td.Has(ctx, key)
+	}
+	key = d.prefixKey(key)
+	err = d.do(ctx, opHas, key.String(), func(ctx context.Context) error {
+		exists, err = d.has(ctx, d.annotate(ctx, opHas, d.reader(ctx)), key)
+		return err
+	})
+	return exists, err
+}
+
+func (d *Datastore) has(ctx context.Context, db querier, key ds.Key) (bool, error) {
+	row := db.QueryRow(ctx, d.hasSQL, d.keyArg(key.String()))
 	var exists bool
 	switch err := row.Scan(&exists); err {
 	case pgx.ErrNoRows:
@@ -84,130 +463,426 @@ func (d *Datastore) Has(ctx context.Context, key ds.Key) (bool, error) {
 
 // Put "upserts" a row into the SQL database.
 func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
-	sql := fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET data = $2", d.table)
-	_, err := d.pool.Exec(ctx, sql, key.String(), value)
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if td := d.route(key); td != d {
+		return td.Put(ctx, key, value)
+	}
+	key = d.prefixKey(key)
+	if err := d.writable(); err != nil {
+		return err
+	}
+	return d.do(ctx, opPut, key.String(), func(ctx context.Context) error {
+		var err error
+		if d.merge {
+			err = d.mergePut(ctx, d.annotate(ctx, opPut, d.pool), key, value)
+		} else {
+			err = d.put(ctx, d.annotate(ctx, opPut, d.pool), key, value)
+		}
+		if err == nil {
+			d.metrics.bytesWritten.Add(int64(len(value)))
+		}
+		return err
+	})
+}
+
+func (d *Datastore) put(ctx context.Context, db querier, key ds.Key, value []byte) error {
+	if d.large(value) {
+		return d.putLarge(ctx, db, key, value, nil)
+	}
+	sql, args, err := d.putQuery(key, value)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, sql, args...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Query returns multiple rows from the SQL database based on the passed query parameters.
-func (d *Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
-	var sql string
-	if q.KeysOnly && q.ReturnsSizes {
-		sql = fmt.Sprintf("SELECT key, octet_length(data) FROM %s", d.table)
-	} else if q.KeysOnly {
-		sql = fmt.Sprintf("SELECT key FROM %s", d.table)
-	} else {
-		sql = fmt.Sprintf("SELECT key, data FROM %s", d.table)
+// Sync is noop for PostgreSQL databases, unless writes are committed
+// asynchronously, in which case it flushes the WAL of all the writes committed
+// before it, whatever their keys.
+func (d *Datastore) Sync(ctx context.Context, key ds.Key) error {
+	if !d.asyncCommit || d.readOnly {
+		return nil
 	}
+	return d.do(ctx, opSync, d.prefixKey(key).String(), func(ctx context.Context) error {
+		return d.inTx(ctx, func(tx pgx.Tx) error {
+			// committing a transaction that has an ID synchronously waits
+			// for the WAL to be flushed up to its commit, which is after the
+			// commits of the writes before it
+			_, err := tx.Exec(ctx, "SET LOCAL synchronous_commit = on")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "SELECT txid_current()")
+			return err
+		})
+	})
+}
 
-	if q.Prefix != "" {
-		// normalize
-		prefix := ds.NewKey(q.Prefix).String()
-		if prefix != "/" {
-			sql += fmt.Sprintf(` WHERE key LIKE '%s%%' ORDER BY key`, prefix+"/")
+// GetSize determines the size in bytes of the value for a given key.
+func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	if td := d.route(key); td != d {
+		return td.GetSize(ctx, key)
+	}
+	key = d.prefixKey(key)
+	err = d.do(ctx, opGetSize, key.String(), func(ctx context.Context) error {
+		size, err = d.getSize(ctx, d.annotate(ctx, opGetSize, d.reader(ctx)), key)
+		return err
+	})
+	return size, err
+}
+
+func (d *Datastore) getSize(ctx context.Context, db querier, key ds.Key) (int, error) {
+	row := db.QueryRow(ctx, d.getSizeSQL, d.keyArg(key.String()))
+	var size int
+	switch err := row.Scan(&size); err {
+	case pgx.ErrNoRows:
+		return -1, ds.ErrNotFound
+	case nil:
+		return size, nil
+	default:
+		return -1, err
+	}
+}
+
+// DiskUsage returns the space used by the table in bytes, including its
+// partitions or hypertable chunks, indexes and TOAST data, the tables of its
+// deduplicated values, chunks and journal and the size of its large objects,
+// and the space used by the tables of NamespaceTables.
+func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
+	var size int64
+	err := d.pool.QueryRow(ctx, d.diskUsageSQL(), d.table).Scan(&size)
+	if err != nil {
+		return 0, err
+	}
+	usage := uint64(size)
+	for _, t := range d.tables {
+		tsize, err := t.ds.DiskUsage(ctx)
+		if err != nil {
+			return 0, err
 		}
+		usage += tsize
+	}
+	return usage, nil
+}
+
+// diskUsageSQL returns the statement that sums the space used by the table,
+// given as its parameter, and the relations that store its values.
+func (d *Datastore) diskUsageSQL() string {
+	// the parent of a partitioned table has no storage of its own
+	sizes := []string{"pg_total_relation_size($1::regclass)"}
+	if d.partitioned() {
+		sizes[0] = "(SELECT sum(pg_total_relation_size(relid)) FROM pg_partition_tree($1::regclass))"
+	} else if d.hypertable != nil {
+		sizes[0] = "hypertable_size($1::regclass)"
+	}
+	relationSize := func(table string) string {
+		return fmt.Sprintf("pg_total_relation_size(%s::regclass)", quoteLiteral(table))
+	}
+	if d.dedup {
+		sizes = append(sizes, relationSize(d.contentTable()))
+	}
+	if d.chunkSize > 0 {
+		sizes = append(sizes, relationSize(d.chunksTable()))
+	}
+	if d.journal {
+		sizes = append(sizes, relationSize(d.journalTable()))
+	}
+	if d.loThreshold > 0 {
+		sizes = append(sizes, fmt.Sprintf("(SELECT coalesce(sum(lo_lseek64(lo_open(lo, %d), 0, 2)), 0) FROM %s WHERE lo IS NOT NULL)", invRead, d.table))
+	}
+	return fmt.Sprintf("SELECT (%s)::bigint", strings.Join(sizes, " + "))
+}
+
+// putQuery returns the statement and arguments used to "upsert" a row.
+func (d *Datastore) putQuery(key ds.Key, value []byte) (string, []interface{}, error) {
+	return d.upsertQuery(key, value, nil)
+}
+
+// dataArg returns the parameter a value is bound to, which is compressed and
+// encrypted if the datastore compresses or encrypts values. The values of
+// go-ds-sql tables cannot be null.
+func (d *Datastore) dataArg(value []byte) ([]byte, error) {
+	if value == nil && d.goDSSQL {
+		return []byte{}, nil
+	}
+	if value == nil || !d.encodesValues() {
+		return value, nil
 	}
+	encoded := d.compression.encode(value)
+	if d.encryption != nil {
+		return d.encryption.seal(encoded)
+	}
+	return encoded, nil
+}
 
-	// only apply limit and offset if we do not have to naive filter/order the results
-	if len(q.Filters) == 0 && len(q.Orders) == 0 {
-		if q.Limit != 0 {
-			sql += fmt.Sprintf(" LIMIT %d", q.Limit)
+// upsertQuery returns the statement and arguments used to "upsert" a row that
+// expires after the given duration, or never expires if ttl is nil.
+func (d *Datastore) upsertQuery(key ds.Key, value []byte, ttl *time.Duration) (string, []interface{}, error) {
+	cols := []string{d.keyCol, d.dataCol}
+	vals := []string{"$1", d.dataExpr("$2")}
+	data, err := d.dataArg(value)
+	if err != nil {
+		return "", nil, err
+	}
+	args := []interface{}{d.keyArg(key.String()), data}
+	if d.checksums {
+		args = append(args, checksum(data))
+		cols = append(cols, "checksum")
+		vals = append(vals, fmt.Sprintf("$%d", len(args)))
+	}
+	if d.ttl {
+		// a plain put removes any expiration previously set on the key
+		cols = append(cols, "expires_at")
+		if ttl != nil {
+			args = append(args, ttl.Seconds())
+			vals = append(vals, fmt.Sprintf("now() + make_interval(secs => $%d)", len(args)))
+		} else {
+			vals = append(vals, "NULL")
 		}
-		if q.Offset != 0 {
-			sql += fmt.Sprintf(" OFFSET %d", q.Offset)
+	}
+	if d.partition != nil {
+		v, err := d.partitionValue(key)
+		if err != nil {
+			return "", nil, err
 		}
+		args = append(args, v)
+		cols = append(cols, d.partition.name)
+		vals = append(vals, fmt.Sprintf("$%d", len(args)))
+	}
+	if d.largeValues() {
+		// the value previously stored outside the row is removed
+		cols = append(cols, d.largeCol())
+		vals = append(vals, "NULL")
+	}
+
+	source := fmt.Sprintf("VALUES (%s)", strings.Join(vals, ", "))
+	if ttl != nil {
+		return d.withContent(d.upsertSQL(cols, source), "VALUES ($2::bytea)"), args, nil
+	}
+	return d.withContent(d.putSQL(cols, source), "VALUES ($2::bytea)"), args, nil
+}
+
+// putSQL returns the statement that puts the rows produced by source: an
+// "upsert", or an insert of the keys not already stored if values are
+// immutable.
+func (d *Datastore) putSQL(cols []string, source string) string {
+	if d.immutable {
+		return d.insertSQL(cols, source)
 	}
+	return d.upsertSQL(cols, source)
+}
 
-	rows, err := d.pool.Query(ctx, sql)
+// upsertSQL returns a statement that "upserts" the rows produced by source,
+// which may be a VALUES list or a SELECT, into the given columns.
+func (d *Datastore) upsertSQL(cols []string, source string) string {
+	if d.dialect == DialectCockroachDB {
+		// UPSERT only updates the given columns, without the cost of checking
+		// for conflicts
+		return fmt.Sprintf("UPSERT INTO %s (%s) %s", d.table, strings.Join(cols, ", "), source)
+	}
+	sets := make([]string, 0, len(cols)-1)
+	var old, updated []string
+	for _, col := range cols[1:] {
+		// the partition of a key never changes
+		if d.partition != nil && col == d.partition.name {
+			continue
+		}
+		sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+		old = append(old, fmt.Sprintf("%s.%s", d.table, col))
+		updated = append(updated, "EXCLUDED."+col)
+	}
+	sql := fmt.Sprintf(
+		"INSERT INTO %s (%s) %s ON CONFLICT (%s) DO UPDATE SET %s",
+		d.table, strings.Join(cols, ", "), source, d.conflictTarget(), strings.Join(sets, ", "),
+	)
+	if d.skipUnchanged {
+		// rows whose columns would not change are not updated
+		sql += fmt.Sprintf(" WHERE (%s) IS DISTINCT FROM (%s)", strings.Join(old, ", "), strings.Join(updated, ", "))
+	}
+	return sql
+}
+
+// insertSQL returns a statement that inserts the rows produced by source into
+// the given columns, skipping the rows of keys that are already stored.
+func (d *Datastore) insertSQL(cols []string, source string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) %s ON CONFLICT (%s) DO NOTHING", d.table, strings.Join(cols, ", "), source, d.conflictTarget())
+}
+
+// newPool creates a pool of connections to the given database, configured by
+// the options, and ensures the database is reachable unless connecting lazily.
+// A primary pool may fail over to the failover hosts.
+func (o *Options) newPool(ctx context.Context, connString string, primary bool) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	config.ConnConfig.Tracer = o.tracer()
+	err = o.configurePool(config)
 	if err != nil {
 		return nil, err
 	}
+	err = o.configureTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	if o.ReadOnly {
+		config.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	}
+	if primary && o.Failover {
+		err = o.configureFailover(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	// the pool connects lazily, so ensure the database is reachable
+	if !o.LazyConnect {
+		err = connect(ctx, pool, o.ConnectRetry)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
+	return pool, nil
+}
 
-	it := dsq.Iterator{
-		Next: func() (dsq.Result, bool) {
-			if !rows.Next() {
-				if rows.Err() != nil {
-					return dsq.Result{Error: rows.Err()}, false
+// configurePool applies the pool options to the configuration of a pool.
+func (o *Options) configurePool(config *pgxpool.Config) error {
+	if o.MaxConns > 0 {
+		config.MaxConns = o.MaxConns
+	}
+	if o.MinConns > 0 {
+		config.MinConns = o.MinConns
+	}
+	if config.MinConns > config.MaxConns {
+		return fmt.Errorf("min conns %d is greater than max conns %d", config.MinConns, config.MaxConns)
+	}
+	if o.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = o.MaxConnLifetime
+	}
+	if o.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = o.MaxConnIdleTime
+	}
+	if o.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = o.HealthCheckPeriod
+	}
+	if o.QueryExecMode != 0 {
+		config.ConnConfig.DefaultQueryExecMode = o.QueryExecMode
+	}
+	if o.StatementCacheCapacity > 0 {
+		config.ConnConfig.StatementCacheCapacity = o.StatementCacheCapacity
+	}
+	if o.AsyncCommit {
+		config.ConnConfig.RuntimeParams["synchronous_commit"] = "off"
+	}
+	if o.DialFunc != nil {
+		config.ConnConfig.DialFunc = o.DialFunc
+		// the dialer routes the connection, so host names are left to it
+		config.ConnConfig.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+			return []string{host}, nil
+		}
+	}
+	var hooks []func(context.Context, *pgx.ConnConfig) error
+	if config.BeforeConnect != nil {
+		hooks = append(hooks, config.BeforeConnect)
+	}
+	if o.CredentialsProvider != nil {
+		hooks = append(hooks, o.setCredentials)
+	}
+	if o.BeforeConnect != nil {
+		hooks = append(hooks, o.BeforeConnect)
+	}
+	var b *balancer
+	if o.LoadBalanceRefresh > 0 {
+		// the servers are listed with the credentials set by the other hooks
+		b = newBalancer(o.LoadBalanceRefresh)
+		hooks = append(hooks, b.beforeConnect)
+	}
+	if len(hooks) > 0 {
+		config.BeforeConnect = func(ctx context.Context, config *pgx.ConnConfig) error {
+			for _, hook := range hooks {
+				err := hook(ctx, config)
+				if err != nil {
+					return err
 				}
-				return dsq.Result{}, false
 			}
+			return nil
+		}
+	}
 
-			var key string
-			var size int
-			var data []byte
-
-			if q.KeysOnly && q.ReturnsSizes {
-				err := rows.Scan(&key, &size)
+	var settings []string
+	if o.StatementTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("SET statement_timeout = %d", o.StatementTimeout.Milliseconds()))
+	}
+	if o.LockTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("SET lock_timeout = %d", o.LockTimeout.Milliseconds()))
+	}
+	if len(settings) > 0 {
+		afterConnect := config.AfterConnect
+		config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			if afterConnect != nil {
+				err := afterConnect(ctx, conn)
 				if err != nil {
-					return dsq.Result{Error: err}, false
+					return err
 				}
-				return dsq.Result{Entry: dsq.Entry{Key: key, Size: size}}, true
-			} else if q.KeysOnly {
-				err := rows.Scan(&key)
+			}
+			for _, sql := range settings {
+				_, err := conn.Exec(ctx, sql)
 				if err != nil {
-					return dsq.Result{Error: err}, false
+					return err
 				}
-				return dsq.Result{Entry: dsq.Entry{Key: key}}, true
-			}
-
-			err := rows.Scan(&key, &data)
-			if err != nil {
-				return dsq.Result{Error: err}, false
 			}
-			entry := dsq.Entry{Key: key, Value: data}
-			if q.ReturnsSizes {
-				entry.Size = len(data)
-			}
-			return dsq.Result{Entry: entry}, true
-		},
-		Close: func() error {
-			rows.Close()
 			return nil
-		},
+		}
 	}
-
-	res := dsq.ResultsFromIterator(q, it)
-
-	for _, f := range q.Filters {
-		res = dsq.NaiveFilter(res, f)
+	if b != nil {
+		// connections are only counted once they join the pool
+		afterConnect := config.AfterConnect
+		config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			if afterConnect != nil {
+				err := afterConnect(ctx, conn)
+				if err != nil {
+					return err
+				}
+			}
+			return b.afterConnect(ctx, conn)
+		}
+		beforeClose := config.BeforeClose
+		config.BeforeClose = func(conn *pgx.Conn) {
+			if beforeClose != nil {
+				beforeClose(conn)
+			}
+			b.beforeClose(conn)
+		}
 	}
-
-	res = dsq.NaiveOrder(res, q.Orders...)
-
-	// if we have filters or orders, offset and limit won't have been applied in the query
-	if len(q.Filters) > 0 || len(q.Orders) > 0 {
-		if q.Offset != 0 {
-			res = dsq.NaiveOffset(res, q.Offset)
+	if o.preparer != nil {
+		beforeAcquire := config.BeforeAcquire
+		config.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+			if beforeAcquire != nil && !beforeAcquire(ctx, conn) {
+				return false
+			}
+			o.preparer.prepare(ctx, conn)
+			return true
 		}
-		if q.Limit != 0 {
-			res = dsq.NaiveLimit(res, q.Limit)
+		beforeClose := config.BeforeClose
+		config.BeforeClose = func(conn *pgx.Conn) {
+			if beforeClose != nil {
+				beforeClose(conn)
+			}
+			o.preparer.forget(conn)
 		}
 	}
-
-	return res, nil
-}
-
-// Sync is noop for PostgreSQL databases.
-func (d *Datastore) Sync(ctx context.Context, key ds.Key) error {
 	return nil
 }
 
-// GetSize determines the size in bytes of the value for a given key.
-func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
-	sql := fmt.Sprintf("SELECT octet_length(data) FROM %s WHERE key = $1", d.table)
-	row := d.pool.QueryRow(ctx, sql, key.String())
-	var size int
-	switch err := row.Scan(&size); err {
-	case pgx.ErrNoRows:
-		return -1, ds.ErrNotFound
-	case nil:
-		return size, nil
-	default:
-		return -1, err
-	}
-}
-
 var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
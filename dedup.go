@@ -0,0 +1,194 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// contentTable returns the quoted name of the table deduplicated values are
+// stored in.
+func (d *Datastore) contentTable() string {
+	return quoteTable(d.tableName + "_content")
+}
+
+// ensureContent creates the content table and the trigger that counts the
+// references to its rows, if they do not already exist.
+func (d *Datastore) ensureContent(ctx context.Context, tx pgx.Tx) error {
+	content := d.contentTable()
+	fn := quoteTable(d.tableName + "_content_refs")
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			content_hash BYTEA PRIMARY KEY,
+			content BYTEA NOT NULL,
+			refs BIGINT NOT NULL DEFAULT 0
+		)`, content),
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF TG_OP = 'UPDATE' AND OLD.%s IS NOT DISTINCT FROM NEW.%s THEN
+				RETURN NULL;
+			END IF;
+			IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.%s IS NOT NULL THEN
+				UPDATE %s SET refs = refs - 1 WHERE content_hash = OLD.%s;
+			END IF;
+			IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.%s IS NOT NULL THEN
+				UPDATE %s SET refs = refs + 1 WHERE content_hash = NEW.%s;
+			END IF;
+			RETURN NULL;
+		END
+		$$`, fn, d.dataCol, d.dataCol, d.dataCol, content, d.dataCol, d.dataCol, content, d.dataCol),
+	}
+	for _, sql := range stmts {
+		_, err := tx.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_trigger WHERE tgrelid = $1::regclass AND tgname = 'pgds_content_refs')", d.table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TRIGGER pgds_content_refs AFTER INSERT OR UPDATE OF %s OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE %s()", d.dataCol, d.table, fn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueExpr returns the expression of the value of a row, which is looked up
+// in the content table if values are deduplicated.
+func (d *Datastore) valueExpr() string {
+	if !d.dedup {
+		return d.dataCol
+	}
+	return fmt.Sprintf("(SELECT content FROM %s WHERE content_hash = %s.%s)", d.contentTable(), d.table, d.dataCol)
+}
+
+// dataExpr returns the expression stored in the data column for a value,
+// which is the hash of its content if values are deduplicated.
+func (d *Datastore) dataExpr(value string) string {
+	if !d.dedup {
+		return value
+	}
+	return fmt.Sprintf("sha256(%s::bytea)", value)
+}
+
+// dataCols returns the select list of the given columns, with the value
+// replaced by the hash of its content if values are deduplicated.
+func (d *Datastore) dataCols(cols []string) string {
+	if !d.dedup {
+		return strings.Join(cols, ", ")
+	}
+	exprs := make([]string, len(cols))
+	for i, col := range cols {
+		exprs[i] = col
+		if col == d.dataCol {
+			exprs[i] = d.dataExpr(col)
+		}
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// withContent prefixes a statement that puts rows with the insertion of their
+// values, produced by the given query, into the content table. The rows of
+// values that are already stored are locked, so that they are not collected
+// before the trigger counts the new references to them.
+func (d *Datastore) withContent(sql, values string) string {
+	if !d.dedup {
+		return sql
+	}
+	return fmt.Sprintf(
+		"WITH content AS (INSERT INTO %s AS c (content_hash, content) SELECT DISTINCT ON (sha256(value)) sha256(value), value FROM (%s) AS s(value) WHERE value IS NOT NULL ON CONFLICT (content_hash) DO UPDATE SET refs = c.refs) %s",
+		d.contentTable(), values, sql,
+	)
+}
+
+// ErrDedupDisabled is returned by the content methods when the datastore was
+// created without the Dedup option.
+var ErrDedupDisabled = errors.New("deduplication is not enabled")
+
+// CollectContent deletes the values of the content tables of the table and
+// of the tables of NamespaceTables that are no longer referenced by any key,
+// in batches of the sweep batch size, and returns the number of values
+// deleted. It is run by CollectGarbage and by the background sweeper.
+func (d *Datastore) CollectContent(ctx context.Context) (int64, error) {
+	if !d.dedup {
+		return 0, ErrDedupDisabled
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, td := range d.prefixTables(ds.NewKey("/")) {
+		n, err := td.collectContent(ctx)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// collectContent deletes unreferenced values in batches until none remain.
+// A value that a concurrent put references again is locked by the put, and
+// is left as it is once its references are counted.
+func (d *Datastore) collectContent(ctx context.Context) (int64, error) {
+	sql := fmt.Sprintf("DELETE FROM %[1]s WHERE content_hash IN (SELECT content_hash FROM %[1]s WHERE refs <= 0 LIMIT $1) AND refs <= 0", d.contentTable())
+	var deleted int64
+	for {
+		tag, err := d.annotate(ctx, opCollectContent, d.pool).Exec(ctx, sql, d.sweepBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < int64(d.sweepBatchSize) {
+			return deleted, nil
+		}
+	}
+}
+
+// RecountContent counts the references to the values of the content table
+// again from the rows of the table, for when the counts were lost, for
+// example because the table was truncated or written with triggers
+// disabled, and then deletes the values that are not referenced. Writes to
+// the table wait until the references are counted.
+func (d *Datastore) RecountContent(ctx context.Context) (int64, error) {
+	if !d.dedup {
+		return 0, ErrDedupDisabled
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("LOCK TABLE %s IN SHARE MODE", d.table))
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf(
+		`UPDATE %[1]s AS c SET refs = r.refs FROM (
+			SELECT c.content_hash, count(t.%[3]s) AS refs FROM %[1]s AS c LEFT JOIN %[2]s AS t ON t.%[3]s = c.content_hash GROUP BY c.content_hash
+		) AS r WHERE c.content_hash = r.content_hash AND c.refs <> r.refs`,
+		d.contentTable(), d.table, d.dataCol,
+	))
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return d.collectContent(ctx)
+}
@@ -0,0 +1,139 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SQLDialect is the dialect of SQL spoken by the database server.
+type SQLDialect string
+
+const (
+	// DialectPostgres is the dialect of PostgreSQL.
+	DialectPostgres SQLDialect = "postgres"
+	// DialectCockroachDB is the dialect of CockroachDB, which is wire
+	// compatible with PostgreSQL but does not support LISTEN/NOTIFY, triggers
+	// or VACUUM, and asks clients to retry conflicting transactions.
+	DialectCockroachDB SQLDialect = "cockroachdb"
+	// DialectYugabyteDB is the dialect of the YSQL API of YugabyteDB, which
+	// is compatible with PostgreSQL but does not support LISTEN/NOTIFY or the
+	// functions of the write-ahead log, and does not need VACUUM.
+	DialectYugabyteDB SQLDialect = "yugabytedb"
+)
+
+// ErrUnsupported is returned by the operations that the database server does
+// not support.
+var ErrUnsupported = errors.New("not supported by the database")
+
+// maxTxRestarts is how many times a transaction is restarted on CockroachDB
+// before its serialization failure is returned.
+const maxTxRestarts = 10
+
+// detectServer returns the dialect of the server the pool connects to, and
+// the version of PostgreSQL it is, or is compatible with, as a number like
+// server_version_num.
+func detectServer(ctx context.Context, db querier) (SQLDialect, int, error) {
+	var version string
+	var versionNum int
+	err := db.QueryRow(ctx, "SELECT version(), current_setting('server_version_num')::int").Scan(&version, &versionNum)
+	if err != nil {
+		return "", 0, err
+	}
+	if strings.Contains(version, "CockroachDB") {
+		return DialectCockroachDB, versionNum, nil
+	}
+	if strings.Contains(version, "-YB-") {
+		return DialectYugabyteDB, versionNum, nil
+	}
+	return DialectPostgres, versionNum, nil
+}
+
+// formatVersion formats a version number like server_version_num.
+func formatVersion(num int) string {
+	if num >= 100000 {
+		return fmt.Sprintf("%d.%d", num/10000, num%10000)
+	}
+	if num%100 == 0 {
+		return fmt.Sprintf("%d.%d", num/10000, num/100%100)
+	}
+	return fmt.Sprintf("%d.%d.%d", num/10000, num/100%100, num%100)
+}
+
+// ServerVersion returns the version of PostgreSQL the server is, or is
+// compatible with, as a number like server_version_num, such as 150004 for
+// 15.4. It is 0 if the datastore was created connecting lazily.
+func (d *Datastore) ServerVersion() int {
+	return d.serverVersion
+}
+
+// requireVersion returns ErrUnsupported if the server is older than the
+// version of PostgreSQL that introduced the feature. Unknown versions are
+// assumed to support it.
+func (d *Datastore) requireVersion(feature string, min int) error {
+	if d.serverVersion == 0 || d.serverVersion >= min {
+		return nil
+	}
+	return fmt.Errorf("%s requires PostgreSQL %s or later, the server runs %s: %w", feature, formatVersion(min), formatVersion(d.serverVersion), ErrUnsupported)
+}
+
+// supports returns ErrUnsupported if the feature relies on notifications or
+// the write-ahead log, which only PostgreSQL supports.
+func (d *Datastore) supports(feature string) error {
+	if d.dialect != DialectPostgres {
+		return fmt.Errorf("%s: %w", feature, ErrUnsupported)
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction and commits it. On CockroachDB, which aborts
+// transactions that conflict rather than waiting for locks, the transaction is
+// restarted from a savepoint when it fails with a serialization failure, so
+// that it keeps its priority over the transactions it conflicts with.
+func (d *Datastore) inTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if d.dialect != DialectCockroachDB {
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	_, err = tx.Exec(ctx, "SAVEPOINT cockroach_restart")
+	if err != nil {
+		return err
+	}
+	for restarts := 0; ; restarts++ {
+		err = fn(tx)
+		if err == nil {
+			_, err = tx.Exec(ctx, "RELEASE SAVEPOINT cockroach_restart")
+		}
+		if err == nil {
+			return tx.Commit(ctx)
+		}
+		if !serializationFailure(err) || restarts >= maxTxRestarts {
+			return err
+		}
+		_, rerr := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT cockroach_restart")
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// serializationFailure reports whether a transaction was aborted because it
+// conflicted with another.
+func serializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40001"
+}
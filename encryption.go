@@ -0,0 +1,328 @@
+package pgds
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// KeyProvider provides the keys values are encrypted with. Keys are 16, 24 or
+// 32 bytes long, for AES-128, AES-192 or AES-256, and the key of an ID must
+// never change, so a key is rotated by making a new ID current.
+type KeyProvider interface {
+	// CurrentKey returns the key new values are encrypted with, and its ID.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the ID, to decrypt the values encrypted with
+	// it.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys.
+type StaticKeys struct {
+	// Current is the ID of the key new values are encrypted with.
+	Current string
+	// Keys are the keys by ID, including those of the values that were
+	// encrypted before the current key was rotated in.
+	Keys map[string][]byte
+}
+
+// CurrentKey returns the current key.
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key returns the key with the ID.
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key: %q", id)
+	}
+	return key, nil
+}
+
+// formatEncrypted is set in the format byte of encrypted values.
+const formatEncrypted byte = 0x80
+
+// The size of the nonces of AES-GCM and of the keys values are encrypted
+// with, which are themselves encrypted with the keys of the provider.
+const (
+	nonceSize   = 12
+	tagSize     = 16
+	dataKeySize = 32
+)
+
+// encryptor encrypts values with envelope encryption: every value is
+// encrypted with AES-GCM under a random data key, which is stored with the
+// value encrypted under the current key of the provider, so rotating the key
+// of the provider only re-encrypts data keys.
+type encryptor struct {
+	keys  KeyProvider
+	aeads sync.Map // key ID -> cipher.AEAD
+}
+
+func newEncryptor(keys KeyProvider) (*encryptor, error) {
+	e := &encryptor{keys: keys}
+	id, _, err := e.current()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("invalid encryption key ID: %q", id)
+	}
+	return e, nil
+}
+
+// current returns the current key of the provider and its ID.
+func (e *encryptor) current() (string, cipher.AEAD, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	if aead, ok := e.aeads.Load(id); ok {
+		return id, aead.(cipher.AEAD), nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", nil, err
+	}
+	e.aeads.Store(id, aead)
+	return id, aead, nil
+}
+
+// key returns the key of the provider with the ID.
+func (e *encryptor) key(id string) (cipher.AEAD, error) {
+	if aead, ok := e.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads.Store(id, aead)
+	return aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts an encoded value. The header of the value is left in the
+// clear, so that its size can be read without decrypting it, and is
+// authenticated with the value, and with the ID of the key by the data key.
+// The encrypted value is
+//
+//	header | ID length | ID | nonce | encrypted data key | nonce | encrypted value
+func (e *encryptor) seal(encoded []byte) ([]byte, error) {
+	id, kek, err := e.current()
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, compressionHeaderSize, compressionHeaderSize+1+len(id))
+	copy(header, encoded)
+	header[0] |= formatEncrypted
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+
+	out := make([]byte, len(header), len(header)+2*nonceSize+dataKeySize+2*aead.Overhead()+len(encoded))
+	copy(out, header)
+	out, err = appendSealed(out, kek, dataKey, header)
+	if err != nil {
+		return nil, err
+	}
+	return appendSealed(out, aead, encoded[compressionHeaderSize:], header[:compressionHeaderSize])
+}
+
+// appendSealed appends a random nonce and the plaintext encrypted with it.
+func appendSealed(out []byte, aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, additional), nil
+}
+
+// parseSealed splits an encrypted value into its authenticated header, the ID
+// of its key, its encrypted data key and its encrypted value.
+func parseSealed(sealed []byte) (header []byte, id string, dataKey, value []byte, err error) {
+	if len(sealed) < compressionHeaderSize+1 {
+		return nil, "", nil, nil, fmt.Errorf("%w: short header", ErrCorruptValue)
+	}
+	n := compressionHeaderSize + 1 + int(sealed[compressionHeaderSize])
+	wrapped := n + nonceSize + dataKeySize + tagSize
+	if len(sealed) < wrapped {
+		return nil, "", nil, nil, fmt.Errorf("%w: short header", ErrCorruptValue)
+	}
+	return sealed[:n], string(sealed[compressionHeaderSize+1 : n]), sealed[n:wrapped], sealed[wrapped:], nil
+}
+
+// open decrypts an encrypted value into its encoded form.
+func (e *encryptor) open(sealed []byte) ([]byte, error) {
+	header, id, wrapped, value, err := parseSealed(sealed)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := e.key(id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := openSealed(kek, wrapped, header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, compressionHeaderSize, compressionHeaderSize+len(value))
+	copy(encoded, header)
+	encoded[0] &^= formatEncrypted
+	return openSealedTo(encoded, aead, value, header[:compressionHeaderSize])
+}
+
+func openSealed(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	return openSealedTo(nil, aead, sealed, additional)
+}
+
+// openSealedTo appends the plaintext of a nonce followed by its ciphertext.
+func openSealedTo(out []byte, aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("%w: short ciphertext", ErrCorruptValue)
+	}
+	out, err := aead.Open(out, sealed[:nonceSize], sealed[nonceSize:], additional)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptValue, err)
+	}
+	return out, nil
+}
+
+// rewrap re-encrypts the data key of an encrypted value with the current key,
+// or encrypts a value that is not encrypted. It returns nil if the value is
+// already encrypted with the current key.
+func (e *encryptor) rewrap(stored []byte) ([]byte, error) {
+	if stored[0]&formatEncrypted == 0 {
+		return e.seal(stored)
+	}
+	header, id, wrapped, value, err := parseSealed(stored)
+	if err != nil {
+		return nil, err
+	}
+	currentID, current, err := e.current()
+	if err != nil {
+		return nil, err
+	}
+	if id == currentID {
+		return nil, nil
+	}
+	kek, err := e.key(id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := openSealed(kek, wrapped, header)
+	if err != nil {
+		return nil, err
+	}
+
+	newHeader := append(header[:compressionHeaderSize:compressionHeaderSize], byte(len(currentID)))
+	newHeader = append(newHeader, currentID...)
+	out := make([]byte, len(newHeader), len(newHeader)+nonceSize+dataKeySize+current.Overhead()+len(value))
+	copy(out, newHeader)
+	out, err = appendSealed(out, current, dataKey, newHeader)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, value...), nil
+}
+
+// ErrEncryptionDisabled is returned by RotateKeys when the datastore was
+// created without the Encryption option.
+var ErrEncryptionDisabled = errors.New("encryption is not enabled")
+
+// RotateKeys re-encrypts the data keys of the values that are not encrypted
+// with the current key of the provider, and encrypts the values that are not
+// encrypted, in the table and in the tables of NamespaceTables. The keys
+// that are no longer current can be removed from the provider once it
+// returns.
+func (d *Datastore) RotateKeys(ctx context.Context) error {
+	if d.encryption == nil {
+		return ErrEncryptionDisabled
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	rows, err := d.pool.Query(ctx, fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NOT NULL", d.keyCol, d.dataCol, d.table, d.dataCol))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// rows written since they were read are left as they are
+	update := fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1 AND %s = $3", d.table, d.dataCol, d.keyCol, d.dataCol)
+	if d.checksums {
+		update = fmt.Sprintf("UPDATE %s SET %s = $2, checksum = $4 WHERE %s = $1 AND %s = $3", d.table, d.dataCol, d.keyCol, d.dataCol)
+	}
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(d.keyDest(&key), &data); err != nil {
+			return err
+		}
+		if len(data) < compressionHeaderSize {
+			return fmt.Errorf("%s: %w: short header", ds.RawKey(d.stripKey(key)), ErrCorruptValue)
+		}
+		rewrapped, err := d.encryption.rewrap(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ds.RawKey(d.stripKey(key)), err)
+		}
+		if rewrapped == nil {
+			continue
+		}
+		args := []any{d.keyArg(key), rewrapped, data}
+		if d.checksums {
+			args = append(args, checksum(rewrapped))
+		}
+		if _, err := d.pool.Exec(ctx, update, args...); err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	if d.largeValues() {
+		if err := d.rotateLarge(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range d.tables {
+		if err := t.ds.RotateKeys(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
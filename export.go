@@ -0,0 +1,153 @@
+package pgds
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// The export format is newline delimited JSON. The first line is a header,
+// followed by a line for each entry in key order, and a trailer with the
+// number of entries, so that a truncated export is detected:
+//
+//	{"format":"pgds-export","version":1}
+//	{"key":"/blocks/a","value":"aGVsbG8=","crc32c":2591144780}
+//	{"key":"/pins/b","crc32c":0,"expires":"2030-01-01T00:00:00Z"}
+//	{"entries":2}
+//
+// Values are base64 encoded, and omitted if empty, and crc32c is their CRC-32C
+// checksum. The expiration of entries is only exported if TTL support is
+// enabled.
+const exportFormat = "pgds-export"
+
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type exportLine struct {
+	Key     string     `json:"key,omitempty"`
+	Value   []byte     `json:"value,omitempty"`
+	CRC32C  *int64     `json:"crc32c,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Entries *int64     `json:"entries,omitempty"`
+}
+
+// ExportOptions configures Export.
+type ExportOptions struct {
+	// Prefix only exports the keys under the prefix.
+	Prefix string
+}
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// Prefix only imports the keys under the prefix, for a selective restore.
+	Prefix string
+}
+
+// Export writes the entries of the datastore to w in a line oriented format,
+// independent of the database, that Import reads. It returns the number of
+// entries written.
+func (d *Datastore) Export(ctx context.Context, w io.Writer, opts ExportOptions) (int64, error) {
+	res, err := d.Query(ctx, dsq.Query{Prefix: opts.Prefix, Orders: []dsq.Order{dsq.OrderByKey{}}, ReturnExpirations: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = enc.Encode(exportHeader{Format: exportFormat, Version: 1})
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for r := range res.Next() {
+		if r.Error != nil {
+			return n, r.Error
+		}
+		sum := checksum(r.Value)
+		line := exportLine{Key: r.Key, Value: r.Value, CRC32C: &sum}
+		if !r.Expiration.IsZero() {
+			line.Expires = &r.Expiration
+		}
+		err = enc.Encode(line)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	err = enc.Encode(exportLine{Entries: &n})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Import reads entries written by Export from r and "upserts" them in a
+// single transaction, after verifying their checksums, and returns the number
+// of entries imported. Nothing is imported if the export is truncated or
+// corrupted.
+func (d *Datastore) Import(ctx context.Context, r io.Reader, opts ImportOptions) (int64, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header exportHeader
+	err := dec.Decode(&header)
+	if err != nil {
+		return 0, fmt.Errorf("reading export header: %w", err)
+	}
+	if header.Format != exportFormat || header.Version != 1 {
+		return 0, fmt.Errorf("unsupported export format %s version %d", header.Format, header.Version)
+	}
+
+	prefix := ds.NewKey(opts.Prefix)
+	var read int64
+	var readErr error
+	fail := func(err error) (dsq.Result, bool) {
+		readErr = err
+		return dsq.Result{Error: err}, true
+	}
+	entries := dsq.ResultsFromIterator(dsq.Query{}, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				var line exportLine
+				err := dec.Decode(&line)
+				if errors.Is(err, io.EOF) {
+					return fail(errors.New("export is truncated"))
+				}
+				if err != nil {
+					return fail(err)
+				}
+				if line.Entries != nil {
+					if *line.Entries != read {
+						return fail(fmt.Errorf("export has %d entries, expected %d", read, *line.Entries))
+					}
+					return dsq.Result{}, false
+				}
+				read++
+				if line.CRC32C == nil || checksum(line.Value) != *line.CRC32C {
+					return fail(fmt.Errorf("entry %s failed checksum verification", line.Key))
+				}
+				if !hasPrefix(ds.RawKey(line.Key), prefix) {
+					continue
+				}
+				e := dsq.Entry{Key: line.Key, Value: line.Value}
+				if line.Expires != nil {
+					e.Expiration = *line.Expires
+				}
+				return dsq.Result{Entry: e}, true
+			}
+		},
+	})
+	n, err := d.ImportEntries(ctx, entries)
+	if readErr != nil {
+		return 0, readErr
+	}
+	return n, err
+}
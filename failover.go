@@ -0,0 +1,93 @@
+package pgds
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// failoverResetInterval is the least time between two resets of the pool
+// while failing over, so that an outage does not churn connections.
+const failoverResetInterval = time.Second
+
+// failover tracks when the pool was last reset to find a new primary.
+type failover struct {
+	mu        sync.Mutex
+	lastReset time.Time
+}
+
+// configureFailover adds the failover hosts to the configuration of a pool
+// and makes it only connect to a primary that accepts writes. The sessions of
+// a read-only datastore never accept writes, so it connects to the server
+// that is not in recovery instead.
+func (o *Options) configureFailover(config *pgxpool.Config) error {
+	// the hosts are tried with the same TLS settings as the first host, which
+	// is tried with and without TLS if the ssl mode prefers or allows it
+	cc := config.ConnConfig
+	tlsConfigs := []*tls.Config{cc.TLSConfig}
+	for _, fb := range cc.Fallbacks {
+		if fb.Host == cc.Host && fb.Port == cc.Port {
+			tlsConfigs = append(tlsConfigs, fb.TLSConfig)
+		}
+	}
+
+	for _, host := range o.FailoverHosts {
+		h, p, err := net.SplitHostPort(host)
+		if err != nil {
+			// no port
+			h, p = host, "5432"
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid failover host %q: %w", host, err)
+		}
+		for _, tlsConfig := range tlsConfigs {
+			if tlsConfig != nil && tlsConfig.ServerName != "" {
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.ServerName = h
+			}
+			cc.Fallbacks = append(cc.Fallbacks, &pgconn.FallbackConfig{
+				Host:      h,
+				Port:      uint16(port),
+				TLSConfig: tlsConfig,
+			})
+		}
+	}
+	cc.ValidateConnect = pgconn.ValidateConnectTargetSessionAttrsReadWrite
+	if o.ReadOnly {
+		cc.ValidateConnect = pgconn.ValidateConnectTargetSessionAttrsPrimary
+	}
+	return nil
+}
+
+// readOnlyError reports whether an error means a write was sent to a server
+// that does not accept writes, such as a primary that was demoted.
+func readOnlyError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "25006"
+}
+
+// maybeFailover closes the connections of the pool when an error means the
+// primary was lost or demoted, so that new connections are made to whichever
+// host is now the primary, resolving host names again. It reports whether the
+// operation should be tried again straight away: a write rejected by a
+// read-only server never took effect.
+func (d *Datastore) maybeFailover(err error) bool {
+	if d.failover == nil || !(readOnlyError(err) || connectionError(err)) {
+		return false
+	}
+	d.failover.mu.Lock()
+	if time.Since(d.failover.lastReset) >= failoverResetInterval {
+		d.failover.lastReset = time.Now()
+		d.pool.Reset()
+	}
+	d.failover.mu.Unlock()
+	return readOnlyError(err)
+}
@@ -0,0 +1,116 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Faults configures the faults injected into the operations of a datastore,
+// so that tests can verify how an application copes with a slow or failing
+// database. Faults are injected into each attempt of an operation, before
+// its statements run, so injected errors are retried and trip the circuit
+// breaker like real ones.
+type Faults struct {
+	// Latency delays every attempt, by up to LatencyJitter more.
+	Latency       time.Duration
+	LatencyJitter time.Duration
+	// ConnectionDropRate is the fraction of attempts that fail as if the
+	// connection to the server was lost.
+	ConnectionDropRate float64
+	// SerializationFailureRate is the fraction of attempts that fail with a
+	// serialization failure, SQLSTATE 40001.
+	SerializationFailureRate float64
+	// Ops are the names of the operations faults are injected into, such as
+	// "get", "put", "query" or "batch", or all of them if empty.
+	Ops []string
+	// Seed seeds the random faults, so that runs are reproducible.
+	Seed int64
+}
+
+// errInjectedSerializationFailure is the error of injected serialization
+// failures.
+var errInjectedSerializationFailure = &pgconn.PgError{
+	Severity: "ERROR",
+	Code:     "40001",
+	Message:  "could not serialize access due to concurrent update (injected)",
+}
+
+// faultInjector injects the faults of a configuration.
+type faultInjector struct {
+	faults Faults
+	ops    map[string]bool
+	mu     sync.Mutex
+	rand   *rand.Rand
+}
+
+func newFaultInjector(f Faults) (*faultInjector, error) {
+	if f.Latency < 0 || f.LatencyJitter < 0 {
+		return nil, fmt.Errorf("invalid fault latency: %s", f.Latency+f.LatencyJitter)
+	}
+	for _, rate := range []float64{f.ConnectionDropRate, f.SerializationFailureRate} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid fault rate: %v", rate)
+		}
+	}
+	fi := &faultInjector{faults: f, rand: rand.New(rand.NewSource(f.Seed))}
+	if len(f.Ops) > 0 {
+		fi.ops = make(map[string]bool, len(f.Ops))
+		for _, op := range f.Ops {
+			fi.ops[op] = true
+		}
+	}
+	return fi, nil
+}
+
+// inject delays an attempt of an operation and returns the error it fails
+// with, if any.
+func (fi *faultInjector) inject(ctx context.Context, op string) error {
+	if fi.ops != nil && !fi.ops[op] {
+		return nil
+	}
+	fi.mu.Lock()
+	delay := fi.faults.Latency
+	if fi.faults.LatencyJitter > 0 {
+		delay += time.Duration(fi.rand.Int63n(int64(fi.faults.LatencyJitter) + 1))
+	}
+	r := fi.rand.Float64()
+	fi.mu.Unlock()
+
+	if delay > 0 {
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	switch {
+	case r < fi.faults.ConnectionDropRate:
+		return fmt.Errorf("injected connection drop: %w", io.ErrUnexpectedEOF)
+	case r < fi.faults.ConnectionDropRate+fi.faults.SerializationFailureRate:
+		return errInjectedSerializationFailure
+	}
+	return nil
+}
+
+// SetFaults replaces the faults injected into the operations of the
+// datastore, and of its namespace tables. The zero Faults stops injecting
+// faults.
+func (d *Datastore) SetFaults(f Faults) error {
+	var fi *faultInjector
+	if f.Latency != 0 || f.LatencyJitter != 0 || f.ConnectionDropRate != 0 || f.SerializationFailureRate != 0 {
+		var err error
+		fi, err = newFaultInjector(f)
+		if err != nil {
+			return err
+		}
+	}
+	d.faults.Store(fi)
+	for _, t := range d.tables {
+		t.ds.faults.Store(fi)
+	}
+	return nil
+}
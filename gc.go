@@ -0,0 +1,60 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// CollectGarbage deletes expired rows, if TTL support is enabled, and the
+// values that are no longer referenced, if Dedup is enabled, and vacuums the
+// table and the tables of NamespaceTables to make the space used by dead rows
+// available for reuse. If the VacuumFull option is set the tables are
+// rewritten so that the space is returned to the operating system, which
+// requires an exclusive lock on each table for the duration.
+func (d *Datastore) CollectGarbage(ctx context.Context) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	for _, td := range d.prefixTables(ds.NewKey("/")) {
+		err := td.collectGarbage(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectGarbage collects the garbage of the table of the datastore.
+func (d *Datastore) collectGarbage(ctx context.Context) error {
+	if d.ttl {
+		err := d.sweep(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if d.dedup {
+		_, err := d.collectContent(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// CockroachDB and YugabyteDB collect the garbage of tables by themselves
+	if d.dialect != DialectPostgres {
+		return nil
+	}
+
+	sql := fmt.Sprintf("VACUUM (ANALYZE) %s", d.table)
+	if d.vacuumFull {
+		sql = fmt.Sprintf("VACUUM (FULL, ANALYZE) %s", d.table)
+	}
+	_, err := d.pool.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var _ ds.GCDatastore = (*Datastore)(nil)
@@ -0,0 +1,93 @@
+package pgds
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Health is a report of the health of a datastore.
+type Health struct {
+	// Latency is the round trip time of a ping to the database.
+	Latency time.Duration
+	// ReplicationLag is how far a standby is behind the primary, measured as
+	// the time since the last transaction it replayed committed. It is nil
+	// when the database is not a standby.
+	ReplicationLag *time.Duration
+	// AcquiredConns is the number of connections in use and MaxConns the most
+	// the pool will open.
+	AcquiredConns int32
+	MaxConns      int32
+	// PoolSaturation is the fraction of the pool's connections in use, from 0
+	// to 1. Operations wait for a connection when it is 1.
+	PoolSaturation float64
+	// Replicas are the health of the read replicas, in the order they were
+	// configured.
+	Replicas []ReplicaHealth
+}
+
+// ReplicaHealth is a report of the health of a read replica.
+type ReplicaHealth struct {
+	// Err is the error the replica could not be checked with, such as when
+	// it is unreachable, or nil.
+	Err error
+	// Latency is the round trip time of a ping to the replica.
+	Latency time.Duration
+	// ReplicationLag is how far the replica is behind the primary, as for
+	// Health. It is nil when the replica is not a standby.
+	ReplicationLag *time.Duration
+}
+
+// Ping checks that the database is reachable.
+func (d *Datastore) Ping(ctx context.Context) error {
+	return d.pool.Ping(ctx)
+}
+
+// Health checks that the database is reachable and reports the health of the
+// datastore and its read replicas, for use in readiness probes. Unreachable
+// replicas are reported rather than failing the check.
+func (d *Datastore) Health(ctx context.Context) (Health, error) {
+	var h Health
+	var err error
+	h.Latency, h.ReplicationLag, err = poolHealth(ctx, d.pool)
+	if err != nil {
+		return h, err
+	}
+
+	stat := d.pool.Stat()
+	h.AcquiredConns = stat.AcquiredConns()
+	h.MaxConns = stat.MaxConns()
+	if h.MaxConns > 0 {
+		h.PoolSaturation = float64(h.AcquiredConns) / float64(h.MaxConns)
+	}
+
+	for _, replica := range d.replicas {
+		var r ReplicaHealth
+		r.Latency, r.ReplicationLag, r.Err = poolHealth(ctx, replica)
+		h.Replicas = append(h.Replicas, r)
+	}
+	return h, nil
+}
+
+// poolHealth pings the database of a pool and returns the round trip time of
+// the ping and its replication lag, if it is a standby.
+func poolHealth(ctx context.Context, pool *pgxpool.Pool) (time.Duration, *time.Duration, error) {
+	start := time.Now()
+	err := pool.Ping(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	latency := time.Since(start)
+
+	var lag *float64
+	err = pool.QueryRow(ctx, "SELECT CASE WHEN pg_is_in_recovery() THEN extract(epoch FROM now() - pg_last_xact_replay_timestamp()) END").Scan(&lag)
+	if err != nil {
+		return latency, nil, err
+	}
+	if lag == nil {
+		return latency, nil, nil
+	}
+	l := time.Duration(*lag * float64(time.Second))
+	return latency, &l, nil
+}
@@ -0,0 +1,50 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// HypertableConfig configures the storage of a namespace whose keys embed a
+// time, such as metrics or logs, in a TimescaleDB hypertable.
+type HypertableConfig struct {
+	// KeyTime returns the time of the row of a key, which is stored in the ts
+	// column the table is partitioned by. It is given the key of the
+	// datastore, without KeyPrefix. Puts of keys it fails for return its
+	// error.
+	KeyTime func(ds.Key) (time.Time, error)
+	// ChunkInterval is the span of time of the rows of each chunk of the
+	// table. Zero leaves the TimescaleDB default of 7 days.
+	ChunkInterval time.Duration
+	// Retention is how long rows are kept: chunks with rows older than that
+	// are dropped in the background by TimescaleDB. Zero keeps all rows.
+	Retention time.Duration
+}
+
+// ensureHypertable makes the table a hypertable partitioned by the ts
+// column, with its retention policy, if it is not one already.
+func (d *Datastore) ensureHypertable(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s, ts)", d.indexName("key_ts_idx"), d.table, d.keyCol))
+	if err != nil {
+		return err
+	}
+	if d.hypertable.ChunkInterval > 0 {
+		_, err = tx.Exec(ctx, "SELECT create_hypertable($1::regclass, 'ts', chunk_time_interval => make_interval(secs => $2), if_not_exists => true)", d.table, d.hypertable.ChunkInterval.Seconds())
+	} else {
+		_, err = tx.Exec(ctx, "SELECT create_hypertable($1::regclass, 'ts', if_not_exists => true)", d.table)
+	}
+	if err != nil {
+		return err
+	}
+	if d.hypertable.Retention > 0 {
+		_, err = tx.Exec(ctx, "SELECT add_retention_policy($1::regclass, make_interval(secs => $2), if_not_exists => true)", d.table, d.hypertable.Retention.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// ImportEntries "upserts" all the entries produced by the given results, for
+// example those of a query on another datastore, and returns the number of
+// entries imported. The entries are streamed to the database using the COPY
+// protocol, which is much faster than putting them one at a time, and are
+// imported in a single transaction. If TTL support is enabled the expiration
+// of each entry is preserved. The results are closed when the import is done.
+func (d *Datastore) ImportEntries(ctx context.Context, entries dsq.Results) (int64, error) {
+	return d.importEntries(ctx, entries, true)
+}
+
+// ImportNewEntries inserts the entries produced by the given results whose
+// keys are not already stored, leaving existing rows untouched, and returns
+// the number of rows inserted. It suits content addressed blocks, whose value
+// never changes for a key. The entries are streamed to the database as by
+// ImportEntries.
+func (d *Datastore) ImportNewEntries(ctx context.Context, entries dsq.Results) (int64, error) {
+	return d.importEntries(ctx, entries, false)
+}
+
+// importEntries imports the entries, overwriting the rows of keys that are
+// already stored or not, and returns the number of entries copied or of rows
+// inserted. The entries of the namespaces of NamespaceTables are imported into
+// their tables, in the same transaction.
+func (d *Datastore) importEntries(ctx context.Context, entries dsq.Results, overwrite bool) (n int64, err error) {
+	defer entries.Close()
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	err = d.do(ctx, opImport, "", func(ctx context.Context) error {
+		var written int64
+		n, written, err = d.importRows(ctx, entries, overwrite)
+		if err == nil {
+			d.metrics.bytesWritten.Add(written)
+		}
+		return err
+	})
+	return n, err
+}
+
+// importRows imports the entries in a transaction, and returns the number of
+// entries copied or of rows inserted and the size of the values copied.
+func (d *Datastore) importRows(ctx context.Context, entries dsq.Results, overwrite bool) (int64, int64, error) {
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	cols := []string{d.keyCol, d.dataCol}
+	defs := []string{d.keyCol + " " + d.keyType(), d.dataCol + " BYTEA"}
+	if d.checksums {
+		cols = append(cols, "checksum")
+		defs = append(defs, "checksum BIGINT")
+	}
+	if d.ttl {
+		cols = append(cols, "expires_at")
+		defs = append(defs, "expires_at TIMESTAMPTZ")
+	}
+	if d.partition != nil {
+		cols = append(cols, d.partition.name)
+		defs = append(defs, d.partition.name+" "+d.partition.def)
+	}
+
+	// the rows are copied with their position in the input, so that the last
+	// entry of a key wins, and with the index of the table of their key
+	copyCols := append(cols[:len(cols):len(cols)], "pgds_seq")
+	defs = append(defs, "pgds_seq BIGINT")
+	tables := []*Datastore{d}
+	index := map[*Datastore]int{d: 0}
+	if len(d.tables) > 0 {
+		for _, t := range d.tables {
+			index[t.ds] = len(tables)
+			tables = append(tables, t.ds)
+		}
+		copyCols = append(copyCols, "pgds_table")
+		defs = append(defs, "pgds_table INTEGER")
+	}
+
+	// rows are copied into a temporary table first, as COPY cannot resolve
+	// conflicts with existing rows
+	_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE pgds_import (%s) ON COMMIT DROP", strings.Join(defs, ", ")))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var seq, written int64
+	src := pgx.CopyFromFunc(func() ([]any, error) {
+		res, ok := entries.NextSync()
+		if !ok {
+			return nil, nil
+		}
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		td := d.route(ds.RawKey(res.Key))
+		if err := td.checkSize(ds.RawKey(res.Key), int64(len(res.Value))); err != nil {
+			return nil, err
+		}
+		key := td.prefixKey(ds.RawKey(res.Key))
+		data, err := td.dataArg(res.Value)
+		if err != nil {
+			return nil, err
+		}
+		values := []any{td.keyArg(key.String()), data}
+		if d.checksums {
+			values = append(values, checksum(data))
+		}
+		if d.ttl {
+			if res.Expiration.IsZero() {
+				values = append(values, nil)
+			} else {
+				values = append(values, res.Expiration)
+			}
+		}
+		if d.partition != nil {
+			v, err := td.partitionValue(key)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		written += int64(len(res.Value))
+		seq++
+		values = append(values, seq)
+		if len(d.tables) > 0 {
+			values = append(values, index[td])
+		}
+		return values, nil
+	})
+	n, err := tx.CopyFrom(ctx, pgx.Identifier{"pgds_import"}, copyCols, src)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var inserted int64
+	for i, td := range tables {
+		where := ""
+		if len(d.tables) > 0 {
+			where = fmt.Sprintf(" WHERE pgds_table = %d", i)
+		}
+		tag, err := tx.Exec(ctx, td.importSQL(cols, where, overwrite))
+		if err != nil {
+			return 0, 0, err
+		}
+		inserted += tag.RowsAffected()
+	}
+	if !overwrite {
+		n = inserted
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, written, nil
+}
+
+// importSQL returns the statement that puts the rows of the temporary import
+// table that match where, with the given columns, into the table.
+func (d *Datastore) importSQL(cols []string, where string, overwrite bool) string {
+	// the same key may have been imported more than once, and a row can only
+	// be "upserted" once per statement, so the last entry of the key is kept
+	// as if the entries were put one after the other
+	order := fmt.Sprintf(" ORDER BY %s, pgds_seq DESC", d.keyCol)
+	source := fmt.Sprintf("SELECT DISTINCT ON (%s) %s FROM pgds_import%s%s", d.keyCol, d.dataCols(cols), where, order)
+	if d.largeValues() {
+		// the value previously stored outside the row is removed
+		source = fmt.Sprintf("SELECT DISTINCT ON (%s) %s, NULL::%s FROM pgds_import%s%s", d.keyCol, d.dataCols(cols), d.largeType(), where, order)
+		cols = append(cols[:len(cols):len(cols)], d.largeCol())
+	}
+	values := fmt.Sprintf("SELECT %s FROM pgds_import%s", d.dataCol, where)
+	if overwrite {
+		return d.withContent(d.upsertSQL(cols, source), values)
+	}
+	return d.withContent(d.insertSQL(cols, source), values)
+}
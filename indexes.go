@@ -0,0 +1,250 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// IndexKind is a kind of index on the key column.
+type IndexKind string
+
+const (
+	// IndexPrefix is a btree index that compares keys byte-wise, which
+	// serves prefix queries and queries ordered by key.
+	IndexPrefix IndexKind = "prefix"
+	// IndexHash is a hash index, which only serves exact matches of keys
+	// and is smaller than a btree index.
+	IndexHash IndexKind = "hash"
+	// IndexBRIN is a BRIN index, which records the range of keys in each
+	// range of pages of the table. It is tiny, and only serves range scans
+	// of tables whose keys are inserted in increasing order.
+	IndexBRIN IndexKind = "brin"
+)
+
+// IndexSpec describes an index on the key column of the table.
+type IndexSpec struct {
+	Kind IndexKind
+	// Namespace makes the index partial, with only the keys under the
+	// namespace, such as "/pins", if set.
+	Namespace string
+	// PagesPerRange is the number of pages of each range of a BRIN index.
+	// Zero leaves the PostgreSQL default of 128.
+	PagesPerRange int
+}
+
+// IndexAdvice is an index suggested by AdviseIndexes, with the reason it is
+// suggested for.
+type IndexAdvice struct {
+	Spec   IndexSpec
+	Reason string
+}
+
+// indexSpecs returns the indexes configured by the options, which are created
+// by EnsureSchema.
+func (d *Datastore) indexSpecs() []IndexSpec {
+	var specs []IndexSpec
+	if d.brinPages > 0 {
+		specs = append(specs, IndexSpec{Kind: IndexBRIN, PagesPerRange: d.brinPages})
+	}
+	if d.hashIndex {
+		specs = append(specs, IndexSpec{Kind: IndexHash})
+	}
+	for _, ns := range d.partialIndexes {
+		specs = append(specs, IndexSpec{Kind: IndexPrefix, Namespace: ns})
+	}
+	return specs
+}
+
+// indexSQL returns the statement that creates the index described by spec, if
+// it does not already exist.
+func (d *Datastore) indexSQL(spec IndexSpec, concurrently bool) (string, error) {
+	name := "key"
+	if spec.Namespace != "" {
+		if !strings.HasPrefix(spec.Namespace, "/") || spec.Namespace == "/" {
+			return "", fmt.Errorf("invalid index namespace: %s", spec.Namespace)
+		}
+		name = strings.ReplaceAll(strings.TrimPrefix(spec.Namespace, "/"), "/", "_")
+	}
+	var suffix, using string
+	switch spec.Kind {
+	case IndexPrefix:
+		suffix, using = "prefix_idx", "("+d.orderedKey()+")"
+		if spec.Namespace != "" {
+			suffix = "idx"
+		}
+	case IndexHash:
+		suffix, using = "hash_idx", fmt.Sprintf("USING hash (%s)", d.keyCol)
+	case IndexBRIN:
+		suffix, using = "brin_idx", "USING brin ("+d.orderedKey()+")"
+		if spec.PagesPerRange < 0 {
+			return "", fmt.Errorf("invalid BRIN pages per range: %d", spec.PagesPerRange)
+		}
+		if spec.PagesPerRange > 0 {
+			using += fmt.Sprintf(" WITH (pages_per_range = %d)", spec.PagesPerRange)
+		}
+	default:
+		return "", fmt.Errorf("invalid index kind: %s", spec.Kind)
+	}
+
+	create := "CREATE INDEX"
+	if concurrently {
+		create = "CREATE INDEX CONCURRENTLY"
+	}
+	sql := fmt.Sprintf("%s IF NOT EXISTS %s ON %s %s", create, d.indexName(name+"_"+suffix), d.table, using)
+	if spec.Namespace != "" {
+		sql += " WHERE " + d.namespacePredicate(spec.Namespace)
+	}
+	return sql, nil
+}
+
+// EnsureIndexes creates the given indexes on the key column, if they do not
+// already exist. Indexes are built without blocking writes to the table,
+// except on partitioned tables, which do not support it. A build that failed
+// leaves an invalid index that must be dropped before it is built again.
+func (d *Datastore) EnsureIndexes(ctx context.Context, specs ...IndexSpec) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := d.supports("EnsureIndexes"); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		sql, err := d.indexSQL(spec, !d.partitioned())
+		if err != nil {
+			return err
+		}
+		_, err = d.pool.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adviceRows is the number of rows from which the table is large enough for
+// AdviseIndexes to suggest indexes for it.
+const adviceRows = 10000
+
+// AdviseIndexes suggests indexes on the key column for the operations run on
+// the table, from its statistics in pg_stat_user_tables and pg_stats and,
+// if the extension is installed, the statements recorded by
+// pg_stat_statements. The statistics accumulate from when they were last
+// reset, so the suggestions reflect the workload since then. Suggestions can
+// be created with EnsureIndexes.
+func (d *Datastore) AdviseIndexes(ctx context.Context) ([]IndexAdvice, error) {
+	if err := d.supports("AdviseIndexes"); err != nil {
+		return nil, err
+	}
+
+	methods := map[string]bool{}
+	rows, err := d.pool.Query(ctx, `SELECT am.amname FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_am am ON am.oid = c.relam
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+		WHERE i.indrelid = $1::regclass AND i.indisvalid AND i.indpred IS NULL AND a.attname = $2`, d.table, d.keyName)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var method string
+		err = rows.Scan(&method)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		methods[method] = true
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	// the key index of bytea keys compares them byte-wise
+	prefixIndex := d.byteaKeys
+	if !prefixIndex {
+		err = d.pool.QueryRow(ctx, prefixIndexSQL, d.table, d.keyName).Scan(&prefixIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var seqScans, seqRows, liveRows int64
+	err = d.pool.QueryRow(ctx, "SELECT coalesce(seq_scan, 0), coalesce(seq_tup_read, 0), coalesce(n_live_tup, 0) FROM pg_stat_user_tables WHERE relid = $1::regclass", d.table).Scan(&seqScans, &seqRows, &liveRows)
+	if err != nil {
+		return nil, err
+	}
+	if liveRows < adviceRows {
+		return nil, nil
+	}
+
+	var advice []IndexAdvice
+	// scans that read most of the table are prefix queries the key index
+	// cannot serve
+	if !prefixIndex && !methods["brin"] && seqScans > 0 && seqRows/seqScans > liveRows/2 {
+		advice = append(advice, IndexAdvice{
+			Spec:   IndexSpec{Kind: IndexPrefix},
+			Reason: fmt.Sprintf("%d sequential scans read %d rows, the key index cannot serve prefix queries under the database collation", seqScans, seqRows),
+		})
+	}
+
+	// keys are stored in about the order they sort in, as in journals, when
+	// they are correlated with the physical order of the rows
+	var correlation *float32
+	err = d.pool.QueryRow(ctx, `SELECT max(s.correlation) FROM pg_stats s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = s.tablename
+		WHERE c.oid = $1::regclass AND s.attname = $2`, d.table, d.keyName).Scan(&correlation)
+	if err != nil {
+		return nil, err
+	}
+	if !methods["brin"] && correlation != nil && *correlation >= 0.9 {
+		advice = append(advice, IndexAdvice{
+			Spec:   IndexSpec{Kind: IndexBRIN},
+			Reason: fmt.Sprintf("keys are inserted in increasing order (correlation %.2f), a BRIN index can replace the prefix index", *correlation),
+		})
+	}
+
+	var statements bool
+	err = d.pool.QueryRow(ctx, "SELECT to_regclass('pg_stat_statements') IS NOT NULL").Scan(&statements)
+	if err != nil {
+		return nil, err
+	}
+	if statements && !methods["hash"] {
+		var lookups, prefixQueries int64
+		err = d.pool.QueryRow(ctx, `SELECT coalesce(sum(calls) FILTER (WHERE strpos(query, $2) > 0), 0)::bigint,
+			coalesce(sum(calls) FILTER (WHERE strpos(query, $3) > 0), 0)::bigint
+			FROM pg_stat_statements WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database()) AND strpos(query, $1) > 0`,
+			d.table, "WHERE "+d.keyCol+" = $1", d.keyCol+" LIKE").Scan(&lookups, &prefixQueries)
+		if err != nil {
+			return nil, err
+		}
+		if lookups >= adviceRows && prefixQueries*100 < lookups {
+			advice = append(advice, IndexAdvice{
+				Spec:   IndexSpec{Kind: IndexHash},
+				Reason: fmt.Sprintf("%d lookups of keys and %d prefix queries were run, a hash index serves lookups faster", lookups, prefixQueries),
+			})
+		}
+	}
+	return advice, nil
+}
+
+// namespacePredicate returns the condition of the partial index of a
+// namespace, which matches the keys under it: those from ns+"/" up to
+// ns+"0", as '0' follows '/'.
+func (d *Datastore) namespacePredicate(ns string) string {
+	k := d.orderedKey()
+	return fmt.Sprintf("%s >= %s AND %s < %s", k, d.keyLiteral(ns+"/"), k, d.keyLiteral(ns+"0"))
+}
+
+// partialIndex returns the namespace of the partial index that has the keys
+// under the given prefix, if any. The innermost namespace is preferred as its
+// index is the smallest.
+func (d *Datastore) partialIndex(prefix string) (string, bool) {
+	var match string
+	for _, ns := range d.partialIndexes {
+		if (prefix == ns || strings.HasPrefix(prefix, ns+"/")) && len(ns) > len(match) {
+			match = ns
+		}
+	}
+	return match, match != ""
+}
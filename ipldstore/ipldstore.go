@@ -0,0 +1,167 @@
+// Package ipldstore implements the storage interfaces of go-ipld-prime
+// directly over a pool of connections to PostgreSQL, so that a LinkSystem can
+// load and store blocks without going through a datastore and its adapter:
+//
+//	store, err := ipldstore.New(ctx, pool, ipldstore.Config{CreateTable: true})
+//	lsys := cidlink.DefaultLinkSystem()
+//	lsys.SetReadStorage(store)
+//	lsys.SetWriteStorage(store)
+//
+// The keys of the storage APIs are binary strings, the binary CIDs of blocks
+// for a LinkSystem, which are stored as they are in a BYTEA column. The table
+// has the following structure:
+//
+//	CREATE TABLE IF NOT EXISTS ipld (key BYTEA PRIMARY KEY, data BYTEA NOT NULL)
+//
+// As with the datastore adapter of go-ipld-prime, missing keys are reported
+// with ds.ErrNotFound.
+package ipldstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime/storage"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Config configures a storage.
+type Config struct {
+	// Table is the name of the table, optionally qualified by its schema,
+	// "ipld" if empty.
+	Table string
+	// CreateTable creates the table if it does not exist.
+	CreateTable bool
+	// ChunkSize is the number of bytes GetStream reads at a time, 1 MiB if
+	// zero.
+	ChunkSize int
+}
+
+// Storage is a go-ipld-prime storage backed by a PostgreSQL table.
+type Storage struct {
+	pool      *pgxpool.Pool
+	table     string // quoted
+	chunkSize int
+}
+
+var (
+	_ storage.ReadableStorage          = (*Storage)(nil)
+	_ storage.WritableStorage          = (*Storage)(nil)
+	_ storage.StreamingReadableStorage = (*Storage)(nil)
+)
+
+// New returns a storage that stores values in the table of the config, using
+// the given pool of connections.
+func New(ctx context.Context, pool *pgxpool.Pool, cfg Config) (*Storage, error) {
+	table := cfg.Table
+	if table == "" {
+		table = "ipld"
+	}
+	chunkSize := cfg.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = 1 << 20
+	}
+	if chunkSize < 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	s := &Storage{
+		pool:      pool,
+		table:     pgx.Identifier(strings.Split(table, ".")).Sanitize(),
+		chunkSize: chunkSize,
+	}
+	if cfg.CreateTable {
+		sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key BYTEA PRIMARY KEY, data BYTEA NOT NULL)", s.table)
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Has reports whether a value is stored under the key.
+func (s *Storage) Has(ctx context.Context, key string) (bool, error) {
+	sql := fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE key = $1)", s.table)
+	var exists bool
+	err := s.pool.QueryRow(ctx, sql, []byte(key)).Scan(&exists)
+	return exists, err
+}
+
+// Get returns the value stored under the key, or ds.ErrNotFound.
+func (s *Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	sql := fmt.Sprintf("SELECT data FROM %s WHERE key = $1", s.table)
+	var data []byte
+	err := s.pool.QueryRow(ctx, sql, []byte(key)).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ds.ErrNotFound
+	}
+	return data, err
+}
+
+// Put stores a value under the key. Keys address their content, so a value
+// that is already stored is left as it is.
+func (s *Storage) Put(ctx context.Context, key string, content []byte) error {
+	sql := fmt.Sprintf("INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING", s.table)
+	_, err := s.pool.Exec(ctx, sql, []byte(key), content)
+	return err
+}
+
+// GetStream returns a reader of the value stored under the key, or
+// ds.ErrNotFound. The value is read a chunk at a time as it is consumed, so
+// large values are not held in memory at once.
+func (s *Storage) GetStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	sql := fmt.Sprintf("SELECT octet_length(data) FROM %s WHERE key = $1", s.table)
+	var size int
+	err := s.pool.QueryRow(ctx, sql, []byte(key)).Scan(&size)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{ctx: ctx, s: s, key: []byte(key), size: size}, nil
+}
+
+// chunkReader reads a value a chunk at a time.
+type chunkReader struct {
+	ctx    context.Context
+	s      *Storage
+	key    []byte
+	size   int
+	offset int
+	chunk  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		// substring positions start at 1
+		sql := fmt.Sprintf("SELECT substring(data FROM $2 FOR $3) FROM %s WHERE key = $1", r.s.table)
+		err := r.s.pool.QueryRow(r.ctx, sql, r.key, r.offset+1, r.s.chunkSize).Scan(&r.chunk)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(r.chunk) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.offset += n
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.chunk = nil
+	r.offset = r.size
+	return nil
+}
@@ -0,0 +1,105 @@
+package ipldstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func envString(key string, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+func testConnString() string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable",
+		envString("PG_USER", "postgres"),
+		envString("PG_PASS", ""),
+		envString("PG_HOST", "127.0.0.1"),
+		envString("PG_DB", envString("PG_USER", "postgres")),
+	)
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, testConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	s, err := New(ctx, pool, Config{Table: "ipldstore_test", CreateTable: true, ChunkSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Exec(ctx, "DROP TABLE ipldstore_test")
+
+	if err := s.Put(ctx, "\x01key", []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := s.Has(ctx, "\x01key"); err != nil || !has {
+		t.Fatalf("expected the key to be stored: %v", err)
+	}
+	v, err := s.Get(ctx, "\x01key")
+	if err != nil || string(v) != "hello world" {
+		t.Fatalf("unexpected value %q: %v", v, err)
+	}
+	r, err := s.GetStream(ctx, "\x01key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = io.ReadAll(r)
+	if err != nil || string(v) != "hello world" {
+		t.Fatalf("unexpected streamed value %q: %v", v, err)
+	}
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("expected a missing key not to be found, got: %v", err)
+	}
+	if _, err := s.GetStream(ctx, "missing"); !errors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("expected a missing key not to be found, got: %v", err)
+	}
+
+	// a link system stores and loads nodes by their binary CID
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(s)
+	lsys.SetWriteStorage(s)
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "hello", qp.String("world"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{Version: 1, Codec: cid.DagJSON, MhType: 0x12, MhLength: 32}}
+	lnk, err := lsys.Store(linking.LinkContext{Ctx: ctx}, lp, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := lsys.Load(linking.LinkContext{Ctx: ctx}, lnk, basicnode.Prototype.Any)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := dagjson.Encode(loaded, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"hello":"world"}` {
+		t.Fatalf("unexpected node %s", buf.String())
+	}
+}
@@ -0,0 +1,147 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrJournalDisabled is returned by the journal methods when the datastore was
+// created without the Journal option.
+var ErrJournalDisabled = errors.New("journal is not enabled")
+
+// JournalEntry is a change recorded in the journal.
+type JournalEntry struct {
+	Cursor JournalCursor
+	Key    ds.Key
+	Op     ChangeOp
+	// Time is the start time of the transaction that made the change.
+	Time time.Time
+	// LSN is the write-ahead log location at the time of the change.
+	LSN string
+}
+
+// JournalCursor is a position in the journal. The zero value is the start of
+// the journal.
+type JournalCursor struct {
+	TxID int64
+	Seq  int64
+}
+
+// journalTable returns the quoted name of the journal table.
+func (d *Datastore) journalTable() string {
+	return quoteTable(d.tableName + "_journal")
+}
+
+// ensureJournal creates the journal table and the trigger that populates it,
+// if they do not already exist.
+func (d *Datastore) ensureJournal(ctx context.Context, tx pgx.Tx) error {
+	journal := d.journalTable()
+	fn := quoteTable(d.tableName + "_journal_change")
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			seq BIGSERIAL PRIMARY KEY,
+			txid BIGINT NOT NULL DEFAULT txid_current(),
+			key TEXT NOT NULL,
+			op TEXT NOT NULL,
+			ts TIMESTAMPTZ NOT NULL DEFAULT now(),
+			lsn PG_LSN NOT NULL DEFAULT pg_current_wal_lsn()
+		)`, journal),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (txid, seq)", d.indexName("journal_txid_seq_idx"), journal),
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				INSERT INTO %s (key, op) VALUES (OLD.%s, 'delete');
+			ELSE
+				INSERT INTO %s (key, op) VALUES (NEW.%s, lower(TG_OP));
+			END IF;
+			RETURN NULL;
+		END
+		$$`, fn, journal, d.keyCol, journal, d.keyCol),
+	}
+	for _, sql := range stmts {
+		_, err := tx.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_trigger WHERE tgrelid = $1::regclass AND tgname = 'pgds_journal_change')", d.table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TRIGGER pgds_journal_change AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE %s()", d.table, fn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes returns up to limit changes recorded in the journal after the given
+// cursor. Pass the cursor of the last entry returned to read the changes that
+// follow it. Only the changes made by transactions that have finished, and
+// every transaction started before them, are returned, so that no change is
+// ever skipped. A long running transaction therefore delays the changes made
+// after it started.
+func (d *Datastore) Changes(ctx context.Context, after JournalCursor, limit int) ([]JournalEntry, error) {
+	if !d.journal {
+		return nil, ErrJournalDisabled
+	}
+
+	args := []any{after.TxID, after.Seq, limit}
+	var where string
+	if d.keyPrefix != "" {
+		// only the changes to the keys of the datastore
+		args = append(args, escapeLike(d.keyPrefix+"/")+"%")
+		where = ` AND key LIKE $4 ESCAPE '\'`
+	}
+	sql := fmt.Sprintf(`SELECT txid, seq, key, op, ts, lsn::text FROM %s
+		WHERE (txid, seq) > ($1, $2) AND txid < txid_snapshot_xmin(txid_current_snapshot())%s
+		ORDER BY txid, seq LIMIT $3`, d.journalTable(), where)
+	rows, err := d.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		var key, op string
+		err = rows.Scan(&e.Cursor.TxID, &e.Cursor.Seq, &key, &op, &e.Time, &e.LSN)
+		if err != nil {
+			return nil, err
+		}
+		e.Key = ds.RawKey(d.stripKey(key))
+		e.Op = ChangeOp(op)
+		entries = append(entries, e)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return entries, nil
+}
+
+// TrimJournal deletes the changes recorded in the journal up to and including
+// the given cursor, once every consumer has read them.
+func (d *Datastore) TrimJournal(ctx context.Context, until JournalCursor) error {
+	if !d.journal {
+		return ErrJournalDisabled
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("DELETE FROM %s WHERE (txid, seq) <= ($1, $2)", d.journalTable())
+	_, err := d.pool.Exec(ctx, sql, until.TxID, until.Seq)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package pgds
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// keyType returns the SQL type of the key column.
+func (d *Datastore) keyType() string {
+	if d.byteaKeys {
+		return "BYTEA"
+	}
+	return "TEXT"
+}
+
+// keyArg returns the parameter a key is bound to. Keys of a bytea column are
+// bound as bytes, as text parameters must be valid UTF-8.
+func (d *Datastore) keyArg(key string) any {
+	if d.byteaKeys {
+		return []byte(key)
+	}
+	return key
+}
+
+// keyArgs returns the array parameter the given keys are bound to.
+func (d *Datastore) keyArgs(keys []ds.Key) any {
+	if d.byteaKeys {
+		bs := make([][]byte, len(keys))
+		for i, k := range keys {
+			bs[i] = []byte(k.String())
+		}
+		return bs
+	}
+	return keyStrings(keys)
+}
+
+// keyDest returns the destination a key column is scanned into.
+func (d *Datastore) keyDest(key *string) any {
+	if d.byteaKeys {
+		return byteaKey{key}
+	}
+	return key
+}
+
+// byteaKey scans a bytea key into a string.
+type byteaKey struct {
+	s *string
+}
+
+func (k byteaKey) ScanBytes(v []byte) error {
+	*k.s = string(v)
+	return nil
+}
+
+// orderedKey returns the expression of the key column that compares keys
+// byte-wise, as go-datastore does. go-ds-sql compares keys in the collation
+// of the database.
+func (d *Datastore) orderedKey() string {
+	if d.byteaKeys || d.goDSSQL {
+		return d.keyCol
+	}
+	return d.keyCol + ` COLLATE "C"`
+}
+
+// keyLiteral returns a key as a SQL literal of the type of the key column.
+func (d *Datastore) keyLiteral(key string) string {
+	if d.byteaKeys {
+		return fmt.Sprintf(`'\x%x'::bytea`, key)
+	}
+	return quoteLiteral(key)
+}
+
+// prefixRange returns the conditions that match the keys under the given
+// namespace by range rather than with LIKE, which bytea keys and BRIN indexes
+// require: the keys from ns+"/" up to ns+"0", as '0' follows '/'. The bounds
+// take parameters n and n+1.
+func (d *Datastore) prefixRange(ns string, n int) (string, []any) {
+	k := d.orderedKey()
+	return fmt.Sprintf("%s >= $%d AND %s < $%d", k, n, k, n+1), []any{d.keyArg(ns + "/"), d.keyArg(ns + "0")}
+}
+
+// hasPrefixSQL returns the condition that matches keys starting with the
+// given prefix, which takes the returned argument as parameter n.
+func (d *Datastore) hasPrefixSQL(prefix string, n int) (string, any) {
+	if d.byteaKeys {
+		return fmt.Sprintf("substring(%s FROM 1 FOR %d) = $%d", d.keyCol, len(prefix), n), []byte(prefix)
+	}
+	return fmt.Sprintf(`%s LIKE $%d ESCAPE '\'`, d.keyCol, n), escapeLike(prefix) + "%"
+}
+
+// childExpr returns the expression of the name of the child of the given
+// normalized prefix that the key of a row under it is in: its first namespace
+// after the prefix.
+func (d *Datastore) childExpr(prefix string) string {
+	rest := d.restExpr(prefix)
+	if d.byteaKeys {
+		return fmt.Sprintf(`substring(%[1]s FOR coalesce(nullif(position('\x2f'::bytea IN %[1]s), 0) - 1, length(%[1]s)))`, rest)
+	}
+	return fmt.Sprintf("split_part(%s, '/', 1)", rest)
+}
+
+// nestedExpr returns the condition that matches the rows under the given
+// normalized prefix whose keys are in a namespace of the prefix, rather than
+// children of it.
+func (d *Datastore) nestedExpr(prefix string) string {
+	if d.byteaKeys {
+		return fmt.Sprintf(`position('\x2f'::bytea IN %s) > 0`, d.restExpr(prefix))
+	}
+	return fmt.Sprintf("strpos(%s, '/') > 0", d.restExpr(prefix))
+}
+
+// restExpr returns the expression of the key of a row under the given
+// normalized prefix after the prefix and its slash. The keys of a text column
+// are indexed by character.
+func (d *Datastore) restExpr(prefix string) string {
+	start := 2
+	if prefix != "/" {
+		start = len(prefix) + 2
+		if !d.byteaKeys {
+			start = utf8.RuneCountInString(prefix) + 2
+		}
+	}
+	return fmt.Sprintf("substr(%s, %d)", d.keyCol, start)
+}
@@ -0,0 +1,350 @@
+package pgds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// largeObjectChunkSize is the size of the chunks large objects are written
+// and read in.
+const largeObjectChunkSize = 1 << 20
+
+// the modes of lo_open
+const (
+	invRead = 0x40000
+)
+
+// large reports whether a value is stored outside the row, in a large object
+// or in chunks.
+func (d *Datastore) large(value []byte) bool {
+	return d.largeValues() && len(value) > d.largeThreshold()
+}
+
+// largeThreshold returns the size above which values are stored outside
+// their rows.
+func (d *Datastore) largeThreshold() int {
+	if d.chunkSize > 0 {
+		return d.chunkSize
+	}
+	return d.loThreshold
+}
+
+// largeValues reports whether values may be stored outside their rows.
+func (d *Datastore) largeValues() bool {
+	return d.loThreshold > 0 || d.chunkSize > 0
+}
+
+// largeCol returns the column that references the value of a row stored
+// outside it: the OID of its large object, or its number of chunks.
+func (d *Datastore) largeCol() string {
+	if d.chunkSize > 0 {
+		return "chunks"
+	}
+	return "lo"
+}
+
+// largeType returns the type of the column of largeCol.
+func (d *Datastore) largeType() string {
+	if d.chunkSize > 0 {
+		return "integer"
+	}
+	return "oid"
+}
+
+// ensureLargeObjects adds the column that references the large objects of
+// values, and the trigger that unlinks the large objects that are no longer
+// referenced, if they do not already exist.
+func (d *Datastore) ensureLargeObjects(ctx context.Context, tx pgx.Tx) error {
+	fn := quoteTable(d.tableName + "_lo_unlink")
+	stmts := []string{
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS lo OID", d.table),
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF OLD.lo IS NOT NULL AND (TG_OP = 'DELETE' OR OLD.lo IS DISTINCT FROM NEW.lo) THEN
+				PERFORM lo_unlink(OLD.lo);
+			END IF;
+			RETURN NULL;
+		END
+		$$`, fn),
+	}
+	for _, sql := range stmts {
+		_, err := tx.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_trigger WHERE tgrelid = $1::regclass AND tgname = 'pgds_lo_unlink')", d.table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TRIGGER pgds_lo_unlink AFTER UPDATE OF lo OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE %s()", d.table, fn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putLarge "upserts" a row whose value is stored outside it, in a
+// transaction, or in a savepoint if db is a transaction. The value is
+// written in chunks, so that the server does not hold it in memory.
+func (d *Datastore) putLarge(ctx context.Context, db querier, key ds.Key, value []byte, ttl *time.Duration) error {
+	data, err := d.dataArg(value)
+	if err != nil {
+		return err
+	}
+	_, err = d.putLargeFrom(ctx, db, key, bytes.NewReader(data), ttl)
+	return err
+}
+
+// putLargeFrom "upserts" a row whose stored value is read from r and stored
+// outside it, and returns the size of the value.
+func (d *Datastore) putLargeFrom(ctx context.Context, db querier, key ds.Key, r io.Reader, ttl *time.Duration) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// the row is locked, and the value previously stored outside it is
+	// removed, before the value is written
+	sql, args, err := d.upsertQuery(key, nil, ttl)
+	if err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		// the key of an immutable value is already stored
+		return 0, nil
+	}
+	n, err := d.writeLarge(ctx, tx, key.String(), r)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit(ctx)
+}
+
+// writeLarge writes the stored form of the value of a locked row, read from
+// r, outside the row, references it from the row, and returns its size.
+func (d *Datastore) writeLarge(ctx context.Context, tx pgx.Tx, key string, r io.Reader) (int64, error) {
+	h := crc32.New(castagnoli)
+	r = io.TeeReader(r, h)
+	var ref uint32
+	var n int64
+	var err error
+	if d.chunkSize > 0 {
+		ref, n, err = d.writeChunks(ctx, tx, key, r)
+	} else {
+		ref, n, err = writeLargeObject(ctx, tx, r)
+	}
+	if err != nil {
+		return 0, err
+	}
+	args := []any{d.keyArg(key), ref}
+	update := fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1", d.table, d.largeCol(), d.keyCol)
+	if d.checksums {
+		args = append(args, int64(h.Sum32()))
+		update = fmt.Sprintf("UPDATE %s SET %s = $2, checksum = $3 WHERE %s = $1", d.table, d.largeCol(), d.keyCol)
+	}
+	_, err = tx.Exec(ctx, update, args...)
+	return n, err
+}
+
+// readChunk reads the next chunk of r into buf. It returns io.EOF with the
+// last chunk, which may be empty.
+func readChunk(r io.Reader, buf []byte) ([]byte, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return buf[:n], err
+}
+
+// writeLargeObject writes data read from r to a new large object in chunks,
+// and returns its OID and size.
+func writeLargeObject(ctx context.Context, tx pgx.Tx, r io.Reader) (uint32, int64, error) {
+	var oid uint32
+	err := tx.QueryRow(ctx, "SELECT lo_create(0)").Scan(&oid)
+	if err != nil {
+		return 0, 0, err
+	}
+	buf := make([]byte, largeObjectChunkSize)
+	var off int64
+	for {
+		chunk, err := readChunk(r, buf)
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if len(chunk) > 0 {
+			_, perr := tx.Exec(ctx, "SELECT lo_put($1, $2, $3)", oid, off, chunk)
+			if perr != nil {
+				return 0, 0, perr
+			}
+			off += int64(len(chunk))
+		}
+		if err == io.EOF {
+			return oid, off, nil
+		}
+	}
+}
+
+// errLargeObjectReplaced is returned by getLarge when the value of the key is
+// no longer stored outside its row.
+var errLargeObjectReplaced = errors.New("large object replaced")
+
+// largeValue is a value read from outside its row.
+type largeValue struct {
+	data []byte
+	sum  *int64
+	// ref is the value of the column of largeCol
+	ref uint32
+}
+
+// getLarge reads the stored form of the value of a key that is stored outside
+// its row, with the given checksum column.
+func (d *Datastore) getLarge(ctx context.Context, db querier, key string, sumCol string) (largeValue, error) {
+	if d.chunkSize > 0 {
+		return d.getChunks(ctx, db, key, sumCol)
+	}
+	return d.getLargeObject(ctx, db, key, sumCol)
+}
+
+// getLargeObject reads a value stored in a large object. The row is read and
+// the large object is opened by the same statement, so that the large object
+// is read as of the snapshot the row was read in, even if it is replaced in
+// the meantime.
+func (d *Datastore) getLargeObject(ctx context.Context, db querier, key string, sumCol string) (largeValue, error) {
+	var v largeValue
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return v, err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := fmt.Sprintf("SELECT lo_open(lo, %d), lo, %s FROM %s WHERE %s = $1 AND lo IS NOT NULL%s", invRead, sumCol, d.table, d.keyCol, d.notExpired())
+	var fd int32
+	switch err := tx.QueryRow(ctx, sql, d.keyArg(key)).Scan(&fd, &v.ref, &v.sum); err {
+	case pgx.ErrNoRows:
+		return v, errLargeObjectReplaced
+	case nil:
+	default:
+		return v, err
+	}
+
+	for {
+		var chunk []byte
+		err = tx.QueryRow(ctx, "SELECT loread($1, $2)", fd, largeObjectChunkSize).Scan(&chunk)
+		if err != nil {
+			return v, err
+		}
+		v.data = append(v.data, chunk...)
+		if len(chunk) < largeObjectChunkSize {
+			break
+		}
+	}
+	return v, tx.Commit(ctx)
+}
+
+// checksumCol returns the checksum column if values are verified, or NULL.
+func (d *Datastore) checksumCol() string {
+	if d.verifyChecksums {
+		return "checksum"
+	}
+	return "NULL::bigint"
+}
+
+// readValue returns the stored form of the value of a row read with
+// valueCols, and its checksum, reading it from outside the row if it is
+// stored there. A row whose value is no longer stored outside it is read
+// again.
+func (d *Datastore) readValue(ctx context.Context, db querier, key string, data []byte, sum *int64, ref *uint32) ([]byte, *int64, error) {
+	if ref == nil {
+		return data, sum, nil
+	}
+	// a separate function, as its scans move its arguments to the heap
+	return d.readLarge(ctx, db, key, data, sum, ref)
+}
+
+// readLarge reads a value stored outside its row for readValue.
+func (d *Datastore) readLarge(ctx context.Context, db querier, key string, data []byte, sum *int64, ref *uint32) ([]byte, *int64, error) {
+	for ref != nil {
+		v, err := d.getLarge(ctx, db, key, d.checksumCol())
+		if err != errLargeObjectReplaced {
+			return v.data, v.sum, err
+		}
+		sql := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s = $1%s", d.valueExpr(), d.checksumCol(), d.largeCol(), d.table, d.keyCol, d.notExpired())
+		err = db.QueryRow(ctx, sql, d.keyArg(key)).Scan(&data, &sum, &ref)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, ds.ErrNotFound
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, sum, nil
+}
+
+// rotateLarge re-encrypts the data keys of the values stored outside their
+// rows that are not encrypted with the current key, by writing them again.
+// Each row is locked while its value is rewritten.
+func (d *Datastore) rotateLarge(ctx context.Context) error {
+	col := d.largeCol()
+	rows, err := d.pool.Query(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE %s IS NOT NULL", d.keyCol, d.table, col))
+	if err != nil {
+		return err
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (string, error) {
+		var key string
+		err := row.Scan(d.keyDest(&key))
+		return key, err
+	})
+	if err != nil {
+		return err
+	}
+
+	lock := fmt.Sprintf("SELECT 1 FROM %s WHERE %s = $1 AND %s IS NOT NULL FOR UPDATE", d.table, d.keyCol, col)
+	for _, key := range keys {
+		err = d.inTx(ctx, func(tx pgx.Tx) error {
+			var locked int
+			err := tx.QueryRow(ctx, lock, d.keyArg(key)).Scan(&locked)
+			if err != nil {
+				return err
+			}
+			v, err := d.getLarge(ctx, tx, key, "NULL::bigint")
+			if err != nil {
+				return err
+			}
+			if len(v.data) < compressionHeaderSize {
+				return fmt.Errorf("%s: %w: short header", ds.RawKey(d.stripKey(key)), ErrCorruptValue)
+			}
+			rewrapped, err := d.encryption.rewrap(v.data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", ds.RawKey(d.stripKey(key)), err)
+			}
+			if rewrapped == nil {
+				return nil
+			}
+			_, err = d.writeLarge(ctx, tx, key, bytes.NewReader(rewrapped))
+			return err
+		})
+		// rows whose values are no longer stored outside them are skipped
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+	}
+	return nil
+}
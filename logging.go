@@ -0,0 +1,115 @@
+package pgds
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+// log records a message if a logger is configured and the level is enabled.
+func (d *Datastore) log(ctx context.Context, level tracelog.LogLevel, msg string, data map[string]any) {
+	if d.logger == nil || level > d.logLevel {
+		return
+	}
+	d.logger.Log(ctx, level, msg, data)
+}
+
+// GoLogLogger adapts an ipfs go-log logger to be used with the Logger option.
+func GoLogLogger(l *logging.ZapEventLogger) tracelog.Logger {
+	return tracelog.LoggerFunc(func(_ context.Context, level tracelog.LogLevel, msg string, data map[string]any) {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kvs := make([]any, 0, 2*len(keys))
+		for _, k := range keys {
+			kvs = append(kvs, k, data[k])
+		}
+
+		switch level {
+		case tracelog.LogLevelTrace, tracelog.LogLevelDebug:
+			l.Debugw(msg, kvs...)
+		case tracelog.LogLevelInfo:
+			l.Infow(msg, kvs...)
+		case tracelog.LogLevelWarn:
+			l.Warnw(msg, kvs...)
+		case tracelog.LogLevelError:
+			l.Errorw(msg, kvs...)
+		}
+	})
+}
+
+// logger returns the configured logger, or the go-log logger if none is
+// configured but slow queries are to be logged.
+func (o *Options) logger() tracelog.Logger {
+	if o.Logger == nil && o.SlowQueryThreshold > 0 {
+		return GoLogLogger(logging.Logger("pgds"))
+	}
+	return o.Logger
+}
+
+// tracer returns the tracer that logs the statements run on the connections
+// of a pool created by the datastore, if any.
+func (o *Options) tracer() pgx.QueryTracer {
+	logger := o.logger()
+	if logger == nil {
+		return nil
+	}
+	var tracers []pgx.QueryTracer
+	if o.Logger != nil {
+		tracers = append(tracers, &tracelog.TraceLog{Logger: logger, LogLevel: o.LogLevel})
+	}
+	if o.SlowQueryThreshold > 0 && o.LogLevel >= tracelog.LogLevelWarn {
+		tracers = append(tracers, &slowQueryTracer{logger: logger, threshold: o.SlowQueryThreshold})
+	}
+	if len(tracers) == 1 {
+		return tracers[0]
+	}
+	return multitracer.New(tracers...)
+}
+
+type slowQueryStartKey struct{}
+
+type slowQueryStart struct {
+	start time.Time
+	sql   string
+	args  []any
+}
+
+// slowQueryTracer logs the statements that take longer than a threshold.
+type slowQueryTracer struct {
+	logger    tracelog.Logger
+	threshold time.Duration
+}
+
+func (t *slowQueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, slowQueryStartKey{}, &slowQueryStart{start: time.Now(), sql: data.SQL, args: data.Args})
+}
+
+func (t *slowQueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(slowQueryStartKey{}).(*slowQueryStart)
+	if !ok {
+		return
+	}
+	duration := time.Since(start.start)
+	if duration <= t.threshold {
+		return
+	}
+	fields := map[string]any{"sql": start.sql, "time": duration}
+	// statements on a single key bind it first
+	if len(start.args) > 0 {
+		if key, ok := start.args[0].(string); ok {
+			fields["key"] = key
+		}
+	}
+	if data.Err != nil {
+		fields["err"] = data.Err
+	}
+	t.logger.Log(ctx, tracelog.LogLevelWarn, "slow query", fields)
+}
@@ -0,0 +1,84 @@
+package pgds
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// keyPathFunctionSQL creates the function that maps a key onto the ltree path
+// of its namespaces, which generates the path column. Namespaces that are not
+// made of letters and digits only, which is all ltree labels portably allow,
+// are encoded as an underscore followed by their hex encoding, so that they
+// cannot collide with namespaces used as labels as they are. keyPath must
+// encode keys the same way.
+const keyPathFunctionSQL = `CREATE OR REPLACE FUNCTION pgds_key_path(key text) RETURNS ltree
+	LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE AS $$
+	SELECT coalesce(string_agg(CASE WHEN s ~ '^[A-Za-z0-9]+$' THEN s ELSE '_' || encode(convert_to(s, 'UTF8'), 'hex') END, '.' ORDER BY n), '')::ltree
+	FROM unnest(string_to_array(trim(leading '/' from key), '/')) WITH ORDINALITY AS t(s, n)
+$$`
+
+// keyPath returns the ltree path of a key, as pgds_key_path does.
+func keyPath(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return ""
+	}
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		if !isLabel(s) {
+			segments[i] = "_" + hex.EncodeToString([]byte(s))
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// isLabel reports whether s is used as an ltree label as it is.
+func isLabel(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// descendantsQuery returns the lquery that matches the paths of the keys
+// under the given key, at depth levels below it, or at any depth if depth is
+// zero.
+func descendantsQuery(key string, depth int) string {
+	levels := "*{1,}"
+	if depth > 0 {
+		levels = fmt.Sprintf("*{%d}", depth)
+	}
+	path := keyPath(key)
+	if path == "" {
+		return levels
+	}
+	return path + "." + levels
+}
+
+// ensureKeyPaths adds the path column, generated from the key, and its GiST
+// index to the table, if they do not already exist.
+func (d *Datastore) ensureKeyPaths(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS ltree")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, keyPathFunctionSQL)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS path ltree GENERATED ALWAYS AS (pgds_key_path(%s)) STORED", d.table, d.keyCol))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING gist (path)", d.indexName("path_idx"), d.table))
+	return err
+}
@@ -0,0 +1,230 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// keyStrings returns the string form of the given keys.
+func keyStrings(keys []ds.Key) []string {
+	strs := make([]string, len(keys))
+	for i, k := range keys {
+		strs[i] = k.String()
+	}
+	return strs
+}
+
+// GetMany retrieves the values for the given keys in a single round trip.
+// Keys that are not found are omitted from the returned map.
+func (d *Datastore) GetMany(ctx context.Context, keys []ds.Key) (map[ds.Key][]byte, error) {
+	if len(d.tables) > 0 {
+		values := make(map[ds.Key][]byte, len(keys))
+		for td, tkeys := range d.routeKeys(keys) {
+			tvalues, err := td.getMany(ctx, tkeys)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range tvalues {
+				values[k] = v
+			}
+		}
+		return values, nil
+	}
+	return d.getMany(ctx, keys)
+}
+
+func (d *Datastore) getMany(ctx context.Context, keys []ds.Key) (values map[ds.Key][]byte, err error) {
+	err = d.do(ctx, opGetMany, "", func(ctx context.Context) error {
+		values, err = d.getManyRows(ctx, keys)
+		for _, v := range values {
+			d.metrics.bytesRead.Add(int64(len(v)))
+		}
+		return err
+	})
+	return values, err
+}
+
+func (d *Datastore) getManyRows(ctx context.Context, keys []ds.Key) (map[ds.Key][]byte, error) {
+	sql := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = ANY($1)%s", d.keyCol, d.valueCols(), d.table, d.keyCol, d.notExpired())
+	// values stored outside their rows are read from the same server
+	db := d.annotate(ctx, opGetMany, d.reader(ctx))
+	rows, err := db.Query(ctx, sql, d.keyArgs(d.prefixKeys(keys)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[ds.Key][]byte, len(keys))
+	s := d.newValueScan(true)
+	for rows.Next() {
+		err = rows.Scan(s.dest...)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.value(ctx, db, s.key, s)
+		if errors.Is(err, ds.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[ds.RawKey(d.stripKey(s.key))] = value
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return values, nil
+}
+
+// PutMany "upserts" rows for all the given entries in a single statement.
+func (d *Datastore) PutMany(ctx context.Context, entries map[ds.Key][]byte) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	for k, v := range entries {
+		if err := d.checkSize(k, int64(len(v))); err != nil {
+			return err
+		}
+	}
+	if len(d.tables) > 0 {
+		keys := make([]ds.Key, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+		for td, tkeys := range d.routeKeys(keys) {
+			tentries := make(map[ds.Key][]byte, len(tkeys))
+			for _, k := range tkeys {
+				tentries[k] = entries[k]
+			}
+			if err := td.putMany(ctx, tentries); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return d.putMany(ctx, entries)
+}
+
+func (d *Datastore) putMany(ctx context.Context, entries map[ds.Key][]byte) error {
+	return d.do(ctx, opPutMany, "", func(ctx context.Context) error {
+		err := d.putManyRows(ctx, entries)
+		if err == nil {
+			for _, v := range entries {
+				d.metrics.bytesWritten.Add(int64(len(v)))
+			}
+		}
+		return err
+	})
+}
+
+func (d *Datastore) putManyRows(ctx context.Context, entries map[ds.Key][]byte) error {
+	if d.largeValues() {
+		small := make(map[ds.Key][]byte, len(entries))
+		for k, v := range entries {
+			if !d.large(v) {
+				small[k] = v
+				continue
+			}
+			err := d.putLarge(ctx, d.annotate(ctx, opPutMany, d.pool), d.prefixKey(k), v, nil)
+			if err != nil {
+				return err
+			}
+		}
+		if len(small) == 0 {
+			return nil
+		}
+		entries = small
+	}
+
+	// rows are written in key order so that concurrent writers lock rows in
+	// the same order and cannot deadlock
+	keys := make([]ds.Key, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		v, err := d.dataArg(entries[k])
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	keys = d.prefixKeys(keys)
+
+	cols := []string{d.keyCol, d.dataCol}
+	arrays := []string{fmt.Sprintf("$1::%s[]", d.keyType()), "$2::bytea[]"}
+	args := []any{d.keyArgs(keys), values}
+	if d.checksums {
+		sums := make([]int64, len(values))
+		for i, v := range values {
+			sums[i] = checksum(v)
+		}
+		cols = append(cols, "checksum")
+		arrays = append(arrays, "$3::bigint[]")
+		args = append(args, sums)
+	}
+	if d.partition != nil {
+		values, err := d.partitionValues(keys)
+		if err != nil {
+			return err
+		}
+		cols = append(cols, d.partition.name)
+		args = append(args, values)
+		arrays = append(arrays, fmt.Sprintf("$%d::%s[]", len(args), d.partition.def))
+	}
+	selected := d.dataCols(cols)
+	from := fmt.Sprintf("unnest(%s) AS v(%s)", strings.Join(arrays, ", "), strings.Join(cols, ", "))
+	if d.ttl {
+		// a plain put removes any expiration previously set on the key
+		selected += ", NULL::timestamptz"
+		cols = append(cols, "expires_at")
+	}
+	if d.largeValues() {
+		// and the value previously stored outside the row
+		selected += ", NULL::" + d.largeType()
+		cols = append(cols, d.largeCol())
+	}
+	source := fmt.Sprintf("SELECT %s FROM %s", selected, from)
+
+	sql := d.withContent(d.putSQL(cols, source), "SELECT unnest($2::bytea[])")
+	_, err := d.annotate(ctx, opPutMany, d.pool).Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteMany removes the rows for all the given keys in a single statement.
+func (d *Datastore) DeleteMany(ctx context.Context, keys []ds.Key) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if len(d.tables) > 0 {
+		for td, tkeys := range d.routeKeys(keys) {
+			if err := td.deleteMany(ctx, tkeys); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return d.deleteMany(ctx, keys)
+}
+
+func (d *Datastore) deleteMany(ctx context.Context, keys []ds.Key) error {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", d.table, d.keyCol)
+	return d.do(ctx, opDeleteMany, "", func(ctx context.Context) error {
+		_, err := d.annotate(ctx, opDeleteMany, d.pool).Exec(ctx, sql, d.keyArgs(d.prefixKeys(keys)))
+		return err
+	})
+}
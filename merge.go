@@ -0,0 +1,71 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// mergeQuery returns the statement and arguments used to "upsert" a row with
+// MERGE, which leaves the row as it is if it already has the value, so that
+// putting the same value again does not create a new row version.
+func (d *Datastore) mergeQuery(key ds.Key, value []byte) (string, []any, error) {
+	cols := []string{d.keyCol, d.dataCol}
+	vals := []string{"$1::" + strings.ToLower(d.keyType()), "$2::bytea"}
+	data, err := d.dataArg(value)
+	if err != nil {
+		return "", nil, err
+	}
+	args := []any{d.keyArg(key.String()), data}
+	if d.checksums {
+		args = append(args, checksum(data))
+		cols = append(cols, "checksum")
+		vals = append(vals, "$3::bigint")
+	}
+
+	sets := make([]string, 0, len(cols))
+	inserts := make([]string, 0, len(cols)+1)
+	for _, col := range cols {
+		if col != d.keyCol {
+			sets = append(sets, fmt.Sprintf("%s = v.%s", col, col))
+		}
+		inserts = append(inserts, "v."+col)
+	}
+	insertCols := cols
+	changed := fmt.Sprintf("t.%s IS DISTINCT FROM v.%s", d.dataCol, d.dataCol)
+	if d.ttl {
+		// a plain put removes any expiration previously set on the key
+		sets = append(sets, "expires_at = NULL")
+		insertCols = append(insertCols[:len(insertCols):len(insertCols)], "expires_at")
+		inserts = append(inserts, "NULL")
+		changed += " OR t.expires_at IS NOT NULL"
+	}
+
+	sql := fmt.Sprintf(
+		"MERGE INTO %s AS t USING (VALUES (%s)) AS v (%s) ON t.%s = v.%s WHEN MATCHED AND (%s) THEN UPDATE SET %s WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s)",
+		d.table, strings.Join(vals, ", "), strings.Join(cols, ", "), d.keyCol, d.keyCol, changed, strings.Join(sets, ", "),
+		strings.Join(insertCols, ", "), strings.Join(inserts, ", "),
+	)
+	return sql, args, nil
+}
+
+// mergePut "upserts" a row with MERGE. Unlike ON CONFLICT, MERGE does not
+// wait for a concurrent insert of the same key and fails with a unique
+// violation instead, in which case it is run again to update the row that was
+// inserted.
+func (d *Datastore) mergePut(ctx context.Context, db querier, key ds.Key, value []byte) error {
+	sql, args, err := d.mergeQuery(key, value)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, sql, args...)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		_, err = db.Exec(ctx, sql, args...)
+	}
+	return err
+}
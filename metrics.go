@@ -0,0 +1,133 @@
+package pgds
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the metrics of a datastore, exported to Prometheus and by
+// Stats.
+type metrics struct {
+	ops      *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+
+	totalOps     atomic.Int64
+	totalErrors  atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+func newMetrics(table string) *metrics {
+	labels := prometheus.Labels{"table": table}
+	return &metrics{
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "pgds_operations_total",
+			Help:        "Number of datastore operations.",
+			ConstLabels: labels,
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "pgds_operation_errors_total",
+			Help:        "Number of datastore operations that failed, not counting keys that were not found.",
+			ConstLabels: labels,
+		}, []string{"op"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "pgds_operation_duration_seconds",
+			Help:        "Duration of datastore operations.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"op"}),
+	}
+}
+
+func (m *metrics) observe(op string, duration time.Duration, err error) {
+	m.ops.WithLabelValues(op).Inc()
+	m.totalOps.Add(1)
+	m.duration.WithLabelValues(op).Observe(duration.Seconds())
+	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+		m.errors.WithLabelValues(op).Inc()
+		m.totalErrors.Add(1)
+	}
+}
+
+// Collector returns a Prometheus collector of the metrics of the datastore:
+// the count, errors and latency of its operations, by table for the tables of
+// NamespaceTables, and the statistics of its pool of connections. The metrics
+// have a "table" label so the collectors of several datastores can be
+// registered together.
+func (d *Datastore) Collector() prometheus.Collector {
+	return &collector{d: d, pool: newPoolDescs(d.tableName)}
+}
+
+type collector struct {
+	d    *Datastore
+	pool poolDescs
+}
+
+type poolDescs struct {
+	acquired, idle, total, max      *prometheus.Desc
+	acquires, emptyAcquires, cancel *prometheus.Desc
+	acquireWait                     *prometheus.Desc
+}
+
+func newPoolDescs(table string) poolDescs {
+	labels := prometheus.Labels{"table": table}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("pgds_pool_"+name, help, nil, labels)
+	}
+	return poolDescs{
+		acquired:      desc("acquired_conns", "Number of connections currently acquired from the pool."),
+		idle:          desc("idle_conns", "Number of idle connections in the pool."),
+		total:         desc("total_conns", "Number of connections in the pool."),
+		max:           desc("max_conns", "Maximum number of connections in the pool."),
+		acquires:      desc("acquires_total", "Number of connections acquired from the pool."),
+		emptyAcquires: desc("empty_acquires_total", "Number of acquires that waited for a connection because the pool was empty."),
+		cancel:        desc("canceled_acquires_total", "Number of acquires canceled by their context."),
+		acquireWait:   desc("acquire_wait_seconds_total", "Time spent waiting for a connection from the pool."),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, td := range c.d.prefixTables(ds.NewKey("/")) {
+		td.metrics.ops.Describe(ch)
+		td.metrics.errors.Describe(ch)
+		td.metrics.duration.Describe(ch)
+	}
+	for _, desc := range []*prometheus.Desc{
+		c.pool.acquired, c.pool.idle, c.pool.total, c.pool.max,
+		c.pool.acquires, c.pool.emptyAcquires, c.pool.cancel, c.pool.acquireWait,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	for _, td := range c.d.prefixTables(ds.NewKey("/")) {
+		td.metrics.ops.Collect(ch)
+		td.metrics.errors.Collect(ch)
+		td.metrics.duration.Collect(ch)
+	}
+	c.collectPool(ch, c.d.pool.Stat())
+}
+
+func (c *collector) collectPool(ch chan<- prometheus.Metric, s *pgxpool.Stat) {
+	gauge := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+	}
+	counter := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v)
+	}
+	gauge(c.pool.acquired, float64(s.AcquiredConns()))
+	gauge(c.pool.idle, float64(s.IdleConns()))
+	gauge(c.pool.total, float64(s.TotalConns()))
+	gauge(c.pool.max, float64(s.MaxConns()))
+	counter(c.pool.acquires, float64(s.AcquireCount()))
+	counter(c.pool.emptyAcquires, float64(s.EmptyAcquireCount()))
+	counter(c.pool.cancel, float64(s.CanceledAcquireCount()))
+	counter(c.pool.acquireWait, s.AcquireDuration().Seconds())
+}
@@ -0,0 +1,111 @@
+// Package migrate copies the entries of another datastore, such as the
+// flatfs, badger or leveldb datastore of an existing kubo repo, into a pgds
+// table.
+//
+// Entries are read from the source in key order and imported in batches, each
+// streamed to the database with COPY in a transaction of its own, so an
+// interrupted migration can be resumed after the last key of the last batch
+// that was imported.
+package migrate
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// Progress is the progress of a migration.
+type Progress struct {
+	// Entries is the number of entries imported.
+	Entries int64
+	// Bytes is the size of the values of the entries imported.
+	Bytes int64
+	// LastKey is the key of the last entry imported.
+	LastKey string
+}
+
+// Config configures a migration.
+type Config struct {
+	// BatchSize is the number of entries imported in each transaction, 1000
+	// if zero.
+	BatchSize int
+	// Resume skips the keys up to the greatest key of the destination, which
+	// must only have the entries of a previous migration of the source.
+	Resume bool
+	// Progress is called after each batch is imported.
+	Progress func(Progress)
+}
+
+// Migrate copies the entries of the source datastore into the destination,
+// and returns the progress of the migration when it stops.
+func Migrate(ctx context.Context, src ds.Read, dst *pgds.Datastore, cfg Config) (Progress, error) {
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	var p Progress
+	q := dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}}
+	if cfg.Resume {
+		last, err := lastKey(ctx, dst)
+		if err != nil {
+			return p, err
+		}
+		if last != "" {
+			q.Filters = []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: last}}
+			p.LastKey = last
+		}
+	}
+
+	res, err := src.Query(ctx, q)
+	if err != nil {
+		return p, err
+	}
+	defer res.Close()
+
+	batch := make([]dsq.Entry, 0, batchSize)
+	for {
+		batch = batch[:0]
+		var size int64
+		for len(batch) < batchSize {
+			r, ok := res.NextSync()
+			if !ok {
+				break
+			}
+			if r.Error != nil {
+				return p, r.Error
+			}
+			batch = append(batch, r.Entry)
+			size += int64(len(r.Value))
+		}
+		if len(batch) == 0 {
+			return p, nil
+		}
+		n, err := dst.ImportEntries(ctx, dsq.ResultsWithEntries(dsq.Query{}, batch))
+		if err != nil {
+			return p, err
+		}
+		p.Entries += n
+		p.Bytes += size
+		p.LastKey = batch[len(batch)-1].Key
+		if cfg.Progress != nil {
+			cfg.Progress(p)
+		}
+	}
+}
+
+// lastKey returns the greatest key of the datastore, or the empty string if
+// it is empty.
+func lastKey(ctx context.Context, d *pgds.Datastore) (string, error) {
+	res, err := d.Query(ctx, dsq.Query{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 1})
+	if err != nil {
+		return "", err
+	}
+	entries, err := res.Rest()
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	return entries[0].Key, nil
+}
@@ -0,0 +1,79 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+func envString(key string, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+func testConnString() string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable",
+		envString("PG_USER", "postgres"),
+		envString("PG_PASS", ""),
+		envString("PG_HOST", "127.0.0.1"),
+		envString("PG_DB", envString("PG_USER", "postgres")),
+	)
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src := dssync.MutexWrap(ds.NewMapDatastore())
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := src.Put(ctx, ds.NewKey(fmt.Sprintf("/blocks/%02d", i)), []byte{byte(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dst, err := pgds.NewDatastore(ctx, testConnString(), pgds.Table("migrate_test"), pgds.CreateTable(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	defer dst.PgxPool().Exec(ctx, "DROP TABLE migrate_test")
+
+	put(0, 20)
+	var batches int
+	p, err := Migrate(ctx, src, dst, Config{BatchSize: 10, Progress: func(Progress) { batches++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Entries != 20 || batches != 2 {
+		t.Fatalf("unexpected progress %+v after %d batches", p, batches)
+	}
+
+	// only the keys after the last key imported are migrated again
+	put(20, 25)
+	p, err = Migrate(ctx, src, dst, Config{BatchSize: 10, Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Entries != 5 || p.LastKey != "/blocks/24" {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+	for i := 0; i < 25; i++ {
+		v, err := dst.Get(ctx, ds.NewKey(fmt.Sprintf("/blocks/%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 1 || v[0] != byte(i) {
+			t.Fatalf("unexpected value %v", v)
+		}
+	}
+}
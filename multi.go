@@ -0,0 +1,49 @@
+package pgds
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MultiDatastore creates datastores for several tables that share a single
+// pool of connections, such as the datastores mounted at the namespaces of a
+// go-datastore mount, rather than each of them opening a pool of its own.
+type MultiDatastore struct {
+	pool    *pgxpool.Pool
+	options []Option
+}
+
+// NewMultiDatastore creates a factory of datastores that use the given pool.
+// The options are applied to every datastore it creates. The pool is not
+// closed when the datastores are closed.
+func NewMultiDatastore(pool *pgxpool.Pool, options ...Option) *MultiDatastore {
+	return &MultiDatastore{pool: pool, options: options}
+}
+
+// Datastore creates a datastore for the given table, with the options of the
+// factory followed by the given options.
+func (m *MultiDatastore) Datastore(ctx context.Context, table string, options ...Option) (*Datastore, error) {
+	opts := make([]Option, 0, len(m.options)+1+len(options))
+	opts = append(opts, m.options...)
+	opts = append(opts, Table(table))
+	opts = append(opts, options...)
+	return NewDatastoreWithPool(ctx, m.pool, opts...)
+}
+
+// Mount creates a datastore for the given table, to be mounted at the given
+// prefix of a go-datastore mount.
+func (m *MultiDatastore) Mount(ctx context.Context, prefix string, table string, options ...Option) (mount.Mount, error) {
+	d, err := m.Datastore(ctx, table, options...)
+	if err != nil {
+		return mount.Mount{}, err
+	}
+	return mount.Mount{Prefix: ds.NewKey(prefix), Datastore: d}, nil
+}
+
+// PgxPool exposes the pool of connections shared by the datastores.
+func (m *MultiDatastore) PgxPool() *pgxpool.Pool {
+	return m.pool
+}
@@ -0,0 +1,115 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ListNamespaces returns the names of the first-level namespaces that have
+// keys under them, such as "blocks" for /blocks/..., in the table and in the
+// tables of NamespaceTables, sorted. Keys that are not in a namespace, such
+// as /foo, are left out. The namespaces are listed by the server, which
+// reads every key.
+func (d *Datastore) ListNamespaces(ctx context.Context) ([]string, error) {
+	seen := map[string]bool{}
+	for _, td := range d.prefixTables(ds.NewKey("/")) {
+		err := td.do(ctx, opNamespaces, "/", func(ctx context.Context) error {
+			return td.listNamespaces(ctx, seen)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	namespaces := make([]string, 0, len(seen))
+	for ns := range seen {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// listNamespaces adds the first-level namespaces of the table to the set.
+func (d *Datastore) listNamespaces(ctx context.Context, seen map[string]bool) error {
+	root := d.prefixKey(ds.NewKey("/")).String()
+	sql, args := d.countQuery("DISTINCT "+d.childExpr(root), ds.NewKey("/"), d.nestedExpr(root))
+	rows, err := d.annotate(ctx, opNamespaces, d.reader(ctx)).Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ns string
+	for rows.Next() {
+		if err := rows.Scan(d.keyDest(&ns)); err != nil {
+			return err
+		}
+		seen[ns] = true
+	}
+	return rows.Err()
+}
+
+// Child is a direct child of a prefix, listed by Children.
+type Child struct {
+	// Key is the key of the child.
+	Key ds.Key
+	// HasValue reports whether the key of the child is stored.
+	HasValue bool
+	// HasChildren reports whether keys are stored under the key of the
+	// child, which is then a namespace.
+	HasChildren bool
+}
+
+// Children returns the direct children of the given prefix that are stored
+// or have keys stored under them, as ls lists the entries of a directory, in
+// the table and in the tables of NamespaceTables, sorted by key. The
+// children are listed by the server, which reads every key under the prefix
+// but only returns each child once.
+func (d *Datastore) Children(ctx context.Context, prefix ds.Key) ([]Child, error) {
+	found := map[string]*Child{}
+	for _, td := range d.prefixTables(prefix) {
+		err := td.do(ctx, opChildren, prefix.String(), func(ctx context.Context) error {
+			return td.children(ctx, prefix, found)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	children := make([]Child, 0, len(found))
+	for _, c := range found {
+		children = append(children, *c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Key.String() < children[j].Key.String()
+	})
+	return children, nil
+}
+
+// children adds the children of the prefix in the table to the given ones,
+// by name.
+func (d *Datastore) children(ctx context.Context, prefix ds.Key, found map[string]*Child) error {
+	stored := d.prefixKey(prefix).String()
+	names, args := d.countQuery(fmt.Sprintf("%s AS name, %s AS nested", d.childExpr(stored), d.nestedExpr(stored)), prefix)
+	sql := fmt.Sprintf("SELECT name, bool_or(NOT nested), bool_or(nested) FROM (%s) AS s GROUP BY name", names)
+	rows, err := d.annotate(ctx, opChildren, d.reader(ctx)).Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var name string
+	var value, nested bool
+	for rows.Next() {
+		if err := rows.Scan(d.keyDest(&name), &value, &nested); err != nil {
+			return err
+		}
+		c, ok := found[name]
+		if !ok {
+			c = &Child{Key: prefix.ChildString(name)}
+			found[name] = c
+		}
+		c.HasValue = c.HasValue || value
+		c.HasChildren = c.HasChildren || nested
+	}
+	return rows.Err()
+}
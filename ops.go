@@ -0,0 +1,113 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+// Names of the operations of the datastore, used to instrument them and to
+// annotate their statements.
+const (
+	opGet     = "get"
+	opHas     = "has"
+	opGetSize = "get_size"
+	opPut     = "put"
+	opDelete  = "delete"
+	opQuery   = "query"
+	opBatch   = "batch"
+
+	opGetMany        = "get_many"
+	opPutMany        = "put_many"
+	opDeleteMany     = "delete_many"
+	opPutWithTTL     = "put_with_ttl"
+	opSetTTL         = "set_ttl"
+	opGetExpiration  = "get_expiration"
+	opSweep          = "sweep"
+	opCollectContent = "collect_content"
+	opGetStream      = "get_stream"
+	opPutStream      = "put_stream"
+	opSync           = "sync"
+	opCount          = "count"
+	opEstimateCount  = "estimate_count"
+	opDiskUsage      = "disk_usage"
+	opTableStats     = "table_stats"
+	opNamespaces     = "list_namespaces"
+	opChildren       = "children"
+	opSample         = "sample"
+	opImport         = "import"
+)
+
+// do runs an operation of the datastore on the given key, or key prefix for
+// queries, recording its outcome.
+func (d *Datastore) do(ctx context.Context, op string, key string, fn func(ctx context.Context) error) error {
+	ctx, cancel := d.withDefaultTimeout(ctx, op)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if d.breaker != nil && !d.breaker.allow() {
+		err = ErrCircuitOpen
+	} else {
+		if fi := d.faults.Load(); fi != nil {
+			inner := fn
+			fn = func(ctx context.Context) error {
+				if err := fi.inject(ctx, op); err != nil {
+					return err
+				}
+				return inner(ctx)
+			}
+		}
+		err = d.retry(ctx, op, fn)
+		if d.breaker != nil {
+			d.breaker.record(err)
+		}
+	}
+	duration := time.Since(start)
+	d.metrics.observe(op, duration, err)
+	// failing fast is not logged, the failures that opened the breaker were
+	if err != nil && !errors.Is(err, ds.ErrNotFound) && err != ErrCircuitOpen {
+		level := tracelog.LogLevelError
+		if retriable(err) {
+			level = tracelog.LogLevelWarn
+		}
+		d.log(ctx, level, "operation failed", map[string]any{
+			"op":        op,
+			"key":       key,
+			"time":      duration,
+			"err":       err,
+			"retriable": retriable(err),
+		})
+	}
+	if d.slowThreshold > 0 && duration > d.slowThreshold {
+		d.log(ctx, tracelog.LogLevelWarn, "slow operation", map[string]any{
+			"op":   op,
+			"key":  key,
+			"time": duration,
+		})
+	}
+	return err
+}
+
+// withDefaultTimeout returns a context with the default deadline of the
+// operation if the given context has none. Queries outlive the operation that
+// starts them, so they are given their deadline when they are started.
+func (d *Datastore) withDefaultTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	var timeout time.Duration
+	switch op {
+	case opGet, opHas, opGetSize, opGetMany, opGetExpiration:
+		timeout = d.readTimeout
+	case opPut, opDelete, opBatch, opPutMany, opDeleteMany, opPutWithTTL, opSetTTL:
+		timeout = d.writeTimeout
+	case opImport:
+		// imports stream their entries as queries stream their results
+		timeout = d.scanTimeout
+	}
+	if _, ok := ctx.Deadline(); ok || timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -1,12 +1,126 @@
 package pgds
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/tracelog"
 )
 
 // Options are Datastore options
 type Options struct {
-	Table string
+	Table          string
+	CreateTable    bool
+	VacuumFull     bool
+	Checksums      bool
+	ScrubRepair    bool
+	QueryFetchSize int
+	BatchMaxOps    int
+	BatchMaxBytes  int
+	Journal        bool
+	TTL            bool
+	SweepInterval  time.Duration
+	SweepBatchSize int
+	Logger         tracelog.Logger
+	LogLevel       tracelog.LogLevel
+
+	SlowQueryThreshold time.Duration
+
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	LazyConnect       bool
+	ConnectRetry      time.Duration
+
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	RetryPolicy RetryPolicy
+
+	ReadReplicas     []string
+	ReadReplicaPools []*pgxpool.Pool
+
+	Failover      bool
+	FailoverHosts []string
+
+	ReadOnly bool
+
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	ScanTimeout  time.Duration
+
+	SQLComments bool
+
+	BeforeConnect func(context.Context, *pgx.ConnConfig) error
+	DialFunc      pgconn.DialFunc
+
+	CredentialsProvider CredentialsProvider
+
+	TLSConfig     *tls.Config
+	TLSRootCAFile string
+	TLSCertFile   string
+	TLSKeyFile    string
+
+	Dialect SQLDialect
+
+	LoadBalanceRefresh time.Duration
+
+	Distributed bool
+	Hypertable  *HypertableConfig
+
+	Merge    bool
+	Unlogged bool
+
+	FillFactor int
+	Autovacuum AutovacuumSettings
+
+	PartitionNamespaces  []string
+	HashPartitions       int
+	HashIndex            bool
+	BRINPagesPerRange    int
+	PartialIndexes       []string
+	ByteaKeys            bool
+	LtreeKeys            bool
+	Schema               string
+	KeyColumn            string
+	DataColumn           string
+	NamespaceTables      map[string]string
+	KeyPrefix            string
+	GoDSSQLCompat        bool
+	Faults               *Faults
+	ImmutableValues      bool
+	Compression          CompressionAlgorithm
+	CompressionMinSize   int
+	Encryption           KeyProvider
+	VerifyChecksums      bool
+	Dedup                bool
+	LargeObjectThreshold int
+	ChunkSize            int
+	MaxValueSize         int
+
+	PrepareStatements      bool
+	QueryExecMode          pgx.QueryExecMode
+	StatementCacheCapacity int
+
+	SkipUnchanged bool
+	AsyncCommit   bool
+
+	// prepares the statements of the datastores on the connections of the
+	// pools they create
+	preparer *preparer
 }
 
 // Option is the Datastore option type.
@@ -22,10 +136,70 @@ func (o *Options) Apply(opts ...Option) error {
 	return nil
 }
 
+// validate rejects the options that cannot be combined, and sets up the
+// preparer of PrepareStatements.
+func (o *Options) validate() error {
+	if o.LazyConnect && o.CreateTable {
+		return errors.New("lazy connect cannot be combined with create table")
+	}
+	if o.ReadOnly && o.CreateTable {
+		return errors.New("read-only cannot be combined with create table")
+	}
+	if o.Distributed && o.Journal {
+		return errors.New("distributed cannot be combined with journal")
+	}
+	if o.Unlogged && (len(o.ReadReplicas) > 0 || len(o.ReadReplicaPools) > 0) {
+		return errors.New("unlogged cannot be combined with read replicas")
+	}
+	if o.ByteaKeys && (o.Journal || len(o.PartitionNamespaces) > 0 || o.LtreeKeys) {
+		return errors.New("bytea keys cannot be combined with journal, partitioning by namespace or ltree keys")
+	}
+	if len(o.PartitionNamespaces) > 0 && o.HashPartitions > 0 {
+		return errors.New("partitioning by namespace cannot be combined with hash partitions")
+	}
+	if (len(o.PartitionNamespaces) > 0 || o.HashPartitions > 0) && (o.Hypertable != nil || o.Unlogged || o.Distributed) {
+		return errors.New("partitioning cannot be combined with hypertable, unlogged or distributed")
+	}
+
+	if o.VerifyChecksums && !o.Checksums {
+		return errors.New("checksum verification needs checksums")
+	}
+
+	if o.Dedup && o.Encryption != nil {
+		return errors.New("deduplication cannot be combined with encryption")
+	}
+	if o.LargeObjectThreshold > 0 && (o.Dedup || o.GoDSSQLCompat || o.Dialect != "" && o.Dialect != DialectPostgres) {
+		return errors.New("large objects cannot be combined with deduplication, go-ds-sql compatibility or other dialects")
+	}
+	if o.SkipUnchanged && (o.LargeObjectThreshold > 0 || o.ChunkSize > 0) {
+		return errors.New("skipping unchanged values cannot be combined with large objects or chunked values")
+	}
+	if o.AsyncCommit && o.Dialect != "" && o.Dialect != DialectPostgres {
+		return errors.New("asynchronous commit cannot be combined with other dialects")
+	}
+	if o.ChunkSize > 0 && (o.LargeObjectThreshold > 0 || o.Dedup || o.GoDSSQLCompat || len(o.PartitionNamespaces) > 0 || o.Hypertable != nil) {
+		return errors.New("chunked values cannot be combined with large objects, deduplication, go-ds-sql compatibility, namespace partitioning or hypertable")
+	}
+
+	if o.GoDSSQLCompat && (o.Checksums || o.TTL || o.ByteaKeys || o.LtreeKeys || len(o.PartitionNamespaces) > 0 || o.HashPartitions > 0 || o.Hypertable != nil || o.Compression != "" || o.Encryption != nil || o.Dedup) {
+		return errors.New("go-ds-sql compatibility cannot be combined with checksums, TTL, bytea or ltree keys, partitioning, hypertable, compression, encryption or deduplication")
+	}
+
+	if o.PrepareStatements {
+		o.preparer = &preparer{}
+	}
+	return nil
+}
+
 // OptionDefaults are the default datastore options. This option will be automatically
 // prepended to any options you pass to the Hydra Head constructor.
 var OptionDefaults = func(o *Options) error {
 	o.Table = "blocks"
+	o.KeyColumn = "key"
+	o.DataColumn = "data"
+	o.SweepInterval = time.Minute
+	o.SweepBatchSize = 1000
+	o.LogLevel = tracelog.LogLevelInfo
 	return nil
 }
 
@@ -39,3 +213,1061 @@ func Table(t string) Option {
 		return nil
 	}
 }
+
+// CreateTable configures the datastore to create the table, and any columns
+// and indexes required by the other options, when it is constructed if they
+// do not already exist. Defaults to false.
+func CreateTable(create bool) Option {
+	return func(o *Options) error {
+		o.CreateTable = create
+		return nil
+	}
+}
+
+// VacuumFull configures CollectGarbage to run VACUUM FULL, which returns
+// space to the operating system but locks the table exclusively while it is
+// rewritten. Defaults to false.
+func VacuumFull(full bool) Option {
+	return func(o *Options) error {
+		o.VacuumFull = full
+		return nil
+	}
+}
+
+// Checksums configures the datastore to store a CRC-32C checksum of each
+// value in a `checksum BIGINT` column, which Scrub uses to detect corrupted
+// rows. Defaults to false.
+func Checksums(enabled bool) Option {
+	return func(o *Options) error {
+		o.Checksums = enabled
+		return nil
+	}
+}
+
+// ScrubRepair configures Scrub to delete rows that fail checksum
+// verification, so that they can be fetched again from elsewhere. Defaults to
+// false.
+func ScrubRepair(repair bool) Option {
+	return func(o *Options) error {
+		o.ScrubRepair = repair
+		return nil
+	}
+}
+
+// QueryFetchSize configures queries to read results through a server-side
+// cursor, fetching the given number of rows at a time, so that iterating over
+// very large result sets does not require the server to send them all at once.
+// The cursor holds a connection and a transaction open until the results are
+// closed. Zero disables cursors. Defaults to 0.
+func QueryFetchSize(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid query fetch size: %d", n)
+		}
+		o.QueryFetchSize = n
+		return nil
+	}
+}
+
+// BatchMaxOps configures batches to commit the updates queued so far once the
+// given number of updates have been queued. Zero means no limit. Defaults to 0.
+func BatchMaxOps(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid batch max ops: %d", n)
+		}
+		o.BatchMaxOps = n
+		return nil
+	}
+}
+
+// BatchMaxBytes configures batches to commit the updates queued so far once
+// the values queued add up to the given number of bytes. Zero means no limit.
+// Defaults to 0.
+func BatchMaxBytes(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid batch max bytes: %d", n)
+		}
+		o.BatchMaxBytes = n
+		return nil
+	}
+}
+
+// Journal configures the datastore to record every change made to the table
+// in an append-only journal table, named after the table with a "_journal"
+// suffix, which is populated by a trigger. The journal table and trigger are
+// created by EnsureSchema. Defaults to false.
+func Journal(enabled bool) Option {
+	return func(o *Options) error {
+		o.Journal = enabled
+		return nil
+	}
+}
+
+// TTL enables support for expiring entries. The table must have an
+// `expires_at TIMESTAMPTZ` column. Expired rows are never returned and are
+// periodically deleted by a background sweeper. Defaults to false.
+func TTL(enabled bool) Option {
+	return func(o *Options) error {
+		o.TTL = enabled
+		return nil
+	}
+}
+
+// SweepInterval configures how often expired rows are deleted when TTL
+// support is enabled, and unreferenced values are deleted when Dedup is
+// enabled. A zero interval disables the background sweeper. Defaults to 1
+// minute.
+func SweepInterval(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid sweep interval: %s", d)
+		}
+		o.SweepInterval = d
+		return nil
+	}
+}
+
+// SweepBatchSize configures the maximum number of expired rows deleted per
+// statement by the sweeper. Defaults to 1000.
+func SweepBatchSize(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid sweep batch size: %d", n)
+		}
+		o.SweepBatchSize = n
+		return nil
+	}
+}
+
+// Logger configures a logger that records the SQL executed by the datastore
+// with its duration, and the operations that fail, noting whether the error
+// is worth retrying. Use GoLogLogger to log to an ipfs go-log logger. SQL is
+// only logged if the datastore creates its own pool. Defaults to no logging.
+func Logger(l tracelog.Logger) Option {
+	return func(o *Options) error {
+		o.Logger = l
+		return nil
+	}
+}
+
+// LogLevel configures the most verbose level the logger records. Executed SQL
+// is logged at the info level and failures at the warn or error level.
+// Defaults to tracelog.LogLevelInfo.
+func LogLevel(level tracelog.LogLevel) Option {
+	return func(o *Options) error {
+		if level < tracelog.LogLevelNone || level > tracelog.LogLevelTrace {
+			return fmt.Errorf("invalid log level: %d", level)
+		}
+		o.LogLevel = level
+		return nil
+	}
+}
+
+// SlowQueryThreshold configures the datastore to log, at the warn level, the
+// operations that take longer than the given duration with the key they were
+// given, and the statements that do with their SQL text and the key bound to
+// them, to help find missing indexes and oversized scans. Statements are only
+// logged if the datastore creates its own pool. Without a Logger, they are
+// logged to the "pgds" go-log logger. Zero disables slow query logging.
+// Defaults to 0.
+func SlowQueryThreshold(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid slow query threshold: %s", d)
+		}
+		o.SlowQueryThreshold = d
+		return nil
+	}
+}
+
+// The pool options below only apply to the pool created by NewDatastore, and
+// take precedence over the pool_* parameters of the connection string. When
+// neither sets them, the pgxpool defaults are used, which suit a datastore:
+// a connection per CPU (at least 4) serves concurrent reads without
+// overloading the server, and connections are recycled every hour.
+
+// MaxConns configures the maximum number of connections in the pool. Defaults
+// to the greater of 4 and the number of CPUs.
+func MaxConns(n int32) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max conns: %d", n)
+		}
+		o.MaxConns = n
+		return nil
+	}
+}
+
+// MinConns configures the number of connections the pool keeps open even when
+// they are idle, so that bursts of operations after a quiet period do not wait
+// for new connections. Defaults to 0.
+func MinConns(n int32) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid min conns: %d", n)
+		}
+		o.MinConns = n
+		return nil
+	}
+}
+
+// MaxConnLifetime configures how long a connection is used before it is
+// closed and replaced, which spreads connections over servers behind a load
+// balancer and bounds the memory a server process accumulates. Defaults to 1
+// hour.
+func MaxConnLifetime(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid max conn lifetime: %s", d)
+		}
+		o.MaxConnLifetime = d
+		return nil
+	}
+}
+
+// MaxConnIdleTime configures how long a connection may be idle before it is
+// closed. Defaults to 30 minutes.
+func MaxConnIdleTime(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid max conn idle time: %s", d)
+		}
+		o.MaxConnIdleTime = d
+		return nil
+	}
+}
+
+// HealthCheckPeriod configures how often idle connections are checked and
+// closed if they are broken or past their lifetime. Defaults to 1 minute.
+func HealthCheckPeriod(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid health check period: %s", d)
+		}
+		o.HealthCheckPeriod = d
+		return nil
+	}
+}
+
+// LazyConnect configures NewDatastore not to connect to the database, so that
+// the datastore can be created before the database is reachable. Connections
+// are established by the first operations instead, which fail until the
+// database is reachable. It cannot be combined with CreateTable, call
+// EnsureSchema once the database is reachable instead. Defaults to false.
+func LazyConnect(lazy bool) Option {
+	return func(o *Options) error {
+		o.LazyConnect = lazy
+		return nil
+	}
+}
+
+// ConnectRetry configures NewDatastore to keep trying to connect to the
+// database for up to the given duration while it is unreachable, waiting
+// exponentially longer, with jitter, between attempts. This lets the datastore
+// start alongside the database it uses. Zero fails on the first attempt.
+// Defaults to 0.
+func ConnectRetry(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid connect retry duration: %s", d)
+		}
+		o.ConnectRetry = d
+		return nil
+	}
+}
+
+// CircuitBreaker configures the datastore to fail operations fast with
+// ErrCircuitOpen once the given number of consecutive operations have failed
+// to reach the database, rather than let callers pile up waiting for it.
+// After the cooldown, a single operation is let through to probe whether the
+// database is back. A zero threshold disables the circuit breaker. Defaults to
+// 0.
+func CircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *Options) error {
+		if threshold < 0 {
+			return fmt.Errorf("invalid circuit breaker threshold: %d", threshold)
+		}
+		if cooldown < 0 {
+			return fmt.Errorf("invalid circuit breaker cooldown: %s", cooldown)
+		}
+		o.CircuitBreakerThreshold = threshold
+		o.CircuitBreakerCooldown = cooldown
+		return nil
+	}
+}
+
+// Retry configures the datastore to retry operations that fail with transient
+// errors, such as a lost connection, a serialization failure, a deadlock or the
+// server shutting down, according to the given policy. Defaults to no retries.
+func Retry(policy RetryPolicy) Option {
+	return func(o *Options) error {
+		if policy.BaseDelay < 0 || policy.MaxDelay < policy.BaseDelay {
+			return fmt.Errorf("invalid retry delays: %s to %s", policy.BaseDelay, policy.MaxDelay)
+		}
+		o.RetryPolicy = policy
+		return nil
+	}
+}
+
+// ReadReplicas configures the datastore to connect to the given standby
+// databases, replicating the table from the primary, and to send Get, Has,
+// GetSize and Query to them in turn while writes go to the primary. Reads may
+// not observe recent writes: use WithStaleReads to read from the primary
+// instead. The pools are configured like the primary's and closed with the
+// datastore.
+func ReadReplicas(connStrings ...string) Option {
+	return func(o *Options) error {
+		o.ReadReplicas = append(o.ReadReplicas, connStrings...)
+		return nil
+	}
+}
+
+// ReadReplicaPools is like ReadReplicas, for existing pools of connections to
+// the standby databases. The pools are not closed when the datastore is
+// closed.
+func ReadReplicaPools(pools ...*pgxpool.Pool) Option {
+	return func(o *Options) error {
+		o.ReadReplicaPools = append(o.ReadReplicaPools, pools...)
+		return nil
+	}
+}
+
+// Failover configures the datastore to follow the primary when a standby is
+// promoted. The datastore connects to the first of the hosts of the connection
+// string and the given "host:port" hosts that accepts writes, as with
+// target_session_attrs=read-write, or with ReadOnly that is not in recovery,
+// as with target_session_attrs=primary. When the connection to the primary is
+// lost or a write is rejected because the server was demoted, the connections
+// of the pool are closed so that new ones are made to the new primary,
+// resolving host names again, and writes rejected as read-only are tried
+// again. Hosts only apply to the pool created by NewDatastore. Defaults to
+// false.
+func Failover(hosts ...string) Option {
+	return func(o *Options) error {
+		o.Failover = true
+		o.FailoverHosts = append(o.FailoverHosts, hosts...)
+		return nil
+	}
+}
+
+// ReadOnly configures the datastore not to write to the database: Put, Delete,
+// Batch and the other operations that write return ErrReadOnly, expired rows
+// are not swept, and the sessions of the pool created by NewDatastore default
+// to read-only transactions so that writes are also rejected by the server.
+// It cannot be combined with CreateTable. Defaults to false.
+func ReadOnly(readOnly bool) Option {
+	return func(o *Options) error {
+		o.ReadOnly = readOnly
+		return nil
+	}
+}
+
+// StatementTimeout configures the statement_timeout of the connections of the
+// pool created by NewDatastore, so that the server aborts any statement, such
+// as a pathological query, that runs for longer. It is rounded down to the
+// millisecond. Zero leaves the server's setting. Defaults to 0.
+func StatementTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid statement timeout: %s", d)
+		}
+		o.StatementTimeout = d
+		return nil
+	}
+}
+
+// LockTimeout configures the lock_timeout of the connections of the pool
+// created by NewDatastore, so that the server aborts any statement that waits
+// longer for a lock, such as an upsert blocked by a long transaction. It is
+// rounded down to the millisecond. Zero leaves the server's setting. Defaults
+// to 0.
+func LockTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid lock timeout: %s", d)
+		}
+		o.LockTimeout = d
+		return nil
+	}
+}
+
+// ReadTimeout configures the deadline of Get, Has, GetSize, GetMany and
+// GetExpiration operations called with a context that has none, so that
+// callers using background contexts do not hang on a stuck connection. Zero
+// means no deadline. Defaults to 0.
+func ReadTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid read timeout: %s", d)
+		}
+		o.ReadTimeout = d
+		return nil
+	}
+}
+
+// WriteTimeout configures the deadline of Put, Delete, PutMany, DeleteMany,
+// PutWithTTL and SetTTL operations and batch commits called with a context
+// that has none. Zero means no deadline.
+// Defaults to 0.
+func WriteTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid write timeout: %s", d)
+		}
+		o.WriteTimeout = d
+		return nil
+	}
+}
+
+// ScanTimeout configures the deadline of queries called with a context that
+// has none, including the time spent iterating over their results, and of
+// imports. Zero means no deadline. Defaults to 0.
+func ScanTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return fmt.Errorf("invalid scan timeout: %s", d)
+		}
+		o.ScanTimeout = d
+		return nil
+	}
+}
+
+// SQLComments configures the datastore to append a sqlcommenter-style comment
+// to its statements naming the operation, and the component and trace given
+// with WithComponent and WithTraceParent, so that load seen in
+// pg_stat_activity and pg_stat_statements can be attributed. Statements with
+// different comments are prepared and cached separately, so trace parents,
+// which differ on every call, are best combined with a statement cache
+// disabled in the connection string (default_query_exec_mode=exec). Defaults
+// to false.
+func SQLComments(enabled bool) Option {
+	return func(o *Options) error {
+		o.SQLComments = enabled
+		return nil
+	}
+}
+
+// BeforeConnect configures the datastore to call fn with the configuration of
+// each new connection of the pools it creates before connecting, so that it
+// can set credentials that change over time, such as short-lived tokens used
+// as passwords. Defaults to none.
+func BeforeConnect(fn func(context.Context, *pgx.ConnConfig) error) Option {
+	return func(o *Options) error {
+		o.BeforeConnect = fn
+		return nil
+	}
+}
+
+// DialFunc configures the pools created by the datastore to open connections
+// with fn, such as the Dial method of a Cloud SQL connector dialer, which
+// authenticates and encrypts connections to an instance without a proxy:
+//
+//	pgds.DialFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+//		return dialer.Dial(ctx, "project:region:instance")
+//	})
+//
+// The host names of the connection string are passed to fn without being
+// resolved. Defaults to dialing TCP or Unix sockets.
+func DialFunc(fn pgconn.DialFunc) Option {
+	return func(o *Options) error {
+		o.DialFunc = fn
+		return nil
+	}
+}
+
+// Credentials configures the pools created by the datastore to take the
+// credentials of each new connection from p rather than the connection string,
+// so that the password can be rotated without restarting. Connections that are
+// open when the password changes are kept until MaxConnLifetime. Defaults to
+// none.
+func Credentials(p CredentialsProvider) Option {
+	return func(o *Options) error {
+		o.CredentialsProvider = p
+		return nil
+	}
+}
+
+// TLSConfig configures the pools created by the datastore to connect over TLS
+// with the given configuration, overriding the ssl mode and files of the
+// connection string. The server certificate is verified against the name of
+// each host unless the configuration sets ServerName or skips verification.
+// Defaults to the ssl mode of the connection string.
+func TLSConfig(config *tls.Config) Option {
+	return func(o *Options) error {
+		o.TLSConfig = config
+		return nil
+	}
+}
+
+// TLSRootCA configures the datastore to connect over TLS, as with TLSConfig,
+// verifying server certificates against the PEM encoded certificates of the
+// given file rather than the system roots.
+func TLSRootCA(file string) Option {
+	return func(o *Options) error {
+		o.TLSRootCAFile = file
+		return nil
+	}
+}
+
+// TLSClientCert configures the datastore to connect over TLS, as with
+// TLSConfig, authenticating with the PEM encoded certificate and key of the
+// given files for mutual TLS.
+func TLSClientCert(certFile, keyFile string) Option {
+	return func(o *Options) error {
+		if certFile == "" || keyFile == "" {
+			return fmt.Errorf("invalid TLS client certificate: both certificate and key files are needed")
+		}
+		o.TLSCertFile = certFile
+		o.TLSKeyFile = keyFile
+		return nil
+	}
+}
+
+// Dialect configures the SQL dialect of the database server. When it is not
+// set, the dialect is detected when the datastore is created, or assumed to be
+// PostgreSQL when connecting lazily. On CockroachDB puts are made with UPSERT
+// and batches are committed with the client-side transaction retry protocol.
+// On CockroachDB and YugabyteDB, CollectGarbage only deletes expired rows, and
+// Watch and the journal, which rely on triggers and notifications, return
+// ErrUnsupported.
+func Dialect(dialect SQLDialect) Option {
+	return func(o *Options) error {
+		switch dialect {
+		case DialectPostgres, DialectCockroachDB, DialectYugabyteDB:
+		default:
+			return fmt.Errorf("invalid dialect: %s", dialect)
+		}
+		o.Dialect = dialect
+		return nil
+	}
+}
+
+// YugabyteLoadBalance configures the pools created by the datastore to spread
+// their connections over the servers of a YugabyteDB cluster, connecting each
+// new connection to the server with the fewest connections of the pool. The
+// servers are listed with yb_servers() on the hosts of the connection string,
+// and listed again when new connections are made after the refresh interval,
+// so that the pool follows servers joining and leaving the cluster. Set
+// MaxConnLifetime so that connections are rebalanced over new servers.
+// Defaults to disabled.
+func YugabyteLoadBalance(refresh time.Duration) Option {
+	return func(o *Options) error {
+		if refresh <= 0 {
+			return fmt.Errorf("invalid load balance refresh interval: %s", refresh)
+		}
+		o.LoadBalanceRefresh = refresh
+		return nil
+	}
+}
+
+// Distributed configures EnsureSchema to make the table a Citus distributed
+// table, hash-distributed on the key, so that it is sharded over the worker
+// nodes of the cluster. Statements on a single key, which all select it by
+// equality, are routed to the worker holding its shard, while queries are run
+// on all the shards. It cannot be combined with the journal, which relies on
+// triggers. Defaults to false.
+func Distributed(distributed bool) Option {
+	return func(o *Options) error {
+		o.Distributed = distributed
+		return nil
+	}
+}
+
+// Hypertable configures the datastore to store the rows in a TimescaleDB
+// hypertable partitioned by the time config.KeyTime finds in each key, so that
+// rows are stored in chunks by time and dropped after the retention period.
+// EnsureSchema creates the table with a ts column and a unique index on the
+// key and time, converts it to a hypertable and adds the retention policy.
+// Defaults to a plain table.
+func Hypertable(config HypertableConfig) Option {
+	return func(o *Options) error {
+		if config.KeyTime == nil {
+			return fmt.Errorf("invalid hypertable config: no key time function")
+		}
+		o.Hypertable = &config
+		return nil
+	}
+}
+
+// Merge configures Put to "upsert" rows with MERGE on PostgreSQL 15 and later,
+// only updating a row if its value changed, so that putting the same value
+// again, as providing does, does not create dead row versions that bloat the
+// table. Batches and transactions still use INSERT ... ON CONFLICT. It has no
+// effect with ImmutableValues, on older servers, on other dialects, on hypertables, or when
+// connecting lazily, as the server version is then unknown. Defaults to false.
+func Merge(enabled bool) Option {
+	return func(o *Options) error {
+		o.Merge = enabled
+		return nil
+	}
+}
+
+// Unlogged configures EnsureSchema to create the table as an unlogged table,
+// for data that can be regenerated such as DHT caches. Writes to unlogged
+// tables skip the write-ahead log, which makes them much faster, but the table
+// is emptied after a crash and is not replicated, so it cannot be combined
+// with read replicas. Existing tables are converted with SetUnlogged.
+// Defaults to false.
+func Unlogged(unlogged bool) Option {
+	return func(o *Options) error {
+		o.Unlogged = unlogged
+		return nil
+	}
+}
+
+// FillFactor configures EnsureSchema to set the fill factor of the table, the
+// percentage of each page filled by inserts. Leaving room in pages lets
+// updates of values put again keep the new row version in the same page,
+// avoiding index updates. Defaults to the server default of 100.
+func FillFactor(percent int) Option {
+	return func(o *Options) error {
+		if percent < 10 || percent > 100 {
+			return fmt.Errorf("invalid fill factor: %d", percent)
+		}
+		o.FillFactor = percent
+		return nil
+	}
+}
+
+// Autovacuum configures EnsureSchema to set the autovacuum parameters of the
+// table, as upsert-heavy workloads need the table vacuumed more aggressively
+// than the server defaults to avoid bloat. Defaults to the server settings.
+func Autovacuum(settings AutovacuumSettings) Option {
+	return func(o *Options) error {
+		if settings.VacuumScaleFactor < 0 || settings.AnalyzeScaleFactor < 0 || settings.VacuumThreshold < 0 || settings.AnalyzeThreshold < 0 || settings.VacuumCostLimit < 0 {
+			return fmt.Errorf("invalid autovacuum settings: %+v", settings)
+		}
+		o.Autovacuum = settings
+		return nil
+	}
+}
+
+// PartitionByNamespace configures EnsureSchema to create the table
+// partitioned by the first namespace of the keys, with a partition for each of
+// the given namespaces, such as "blocks", "pins" and "providers", and a default
+// partition for the keys of other namespaces. Each partition is vacuumed and
+// indexed on its own, and can be dropped or detached. Rows are "upserted" on
+// their key and namespace, stored in an ns column. Queries with a prefix only
+// scan the partition of its namespace. It requires PostgreSQL 11 and cannot be
+// combined with Hypertable, Unlogged or Distributed. Defaults to a plain
+// table.
+func PartitionByNamespace(namespaces ...string) Option {
+	return func(o *Options) error {
+		for _, ns := range namespaces {
+			if ns == "" || strings.Contains(ns, "/") {
+				return fmt.Errorf("invalid partition namespace: %s", ns)
+			}
+		}
+		o.PartitionNamespaces = append(o.PartitionNamespaces, namespaces...)
+		return nil
+	}
+}
+
+// HashPartitions configures EnsureSchema to create the table partitioned by
+// the hash of the key into n partitions, so that the indexes of very large
+// tables are smaller and the partitions are vacuumed in parallel. Operations
+// on a single key only touch its partition. The number of partitions of an
+// existing table is not changed. It requires PostgreSQL 11 and cannot be
+// combined with PartitionByNamespace, Hypertable, Unlogged or Distributed.
+// Defaults to a plain table.
+func HashPartitions(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("invalid hash partitions: %d", n)
+		}
+		o.HashPartitions = n
+		return nil
+	}
+}
+
+// HashIndex configures EnsureSchema to create a hash index on the key column,
+// which Get, GetSize and Has use for their exact matches. Hash indexes of long
+// keys such as CIDs are smaller and faster than the btree index, which is kept
+// for upserts and prefix queries, so this suits stores that do many lookups
+// and few prefix queries. It requires PostgreSQL 10. Defaults to false.
+func HashIndex(enabled bool) Option {
+	return func(o *Options) error {
+		o.HashIndex = enabled
+		return nil
+	}
+}
+
+// BRINIndex configures EnsureSchema to create a BRIN index on the key column
+// rather than a btree index for prefix queries, for tables whose keys are
+// mostly inserted in increasing order, such as journals with time ordered
+// keys. A BRIN index records the range of keys in each range of pagesPerRange
+// pages of the table, so it is a tiny fraction of the size of a btree index,
+// and prefix queries are given the range of keys they match to skip the pages
+// outside of it. The PostgreSQL default is 128 pages per range. Defaults to a
+// btree index.
+func BRINIndex(pagesPerRange int) Option {
+	return func(o *Options) error {
+		if pagesPerRange < 1 {
+			return fmt.Errorf("invalid BRIN pages per range: %d", pagesPerRange)
+		}
+		o.BRINPagesPerRange = pagesPerRange
+		return nil
+	}
+}
+
+// PartialIndex configures EnsureSchema to create an index on the keys of each
+// of the given namespaces, such as "/pins", which only has the rows of the
+// namespace. The index of a small namespace that is often queried in a large
+// table shared with other namespaces is a tiny fraction of the size of the
+// index on all keys, so it stays in memory. Queries with a prefix in one of
+// the namespaces are given the condition of its index. Defaults to none.
+func PartialIndex(namespaces ...string) Option {
+	return func(o *Options) error {
+		for _, ns := range namespaces {
+			k := ds.NewKey(ns)
+			if k.String() == "/" {
+				return fmt.Errorf("invalid partial index namespace: %s", ns)
+			}
+			o.PartialIndexes = append(o.PartialIndexes, k.String())
+		}
+		return nil
+	}
+}
+
+// ByteaKeys configures the datastore to store keys in a bytea column rather
+// than a text column, for keys that are not valid UTF-8 or that contain NUL
+// bytes, which text columns reject. Keys are compared byte-wise regardless of
+// the database collation, so prefix queries use the key index. EnsureSchema
+// creates the table with a bytea key column, and existing tables must have
+// one. It cannot be combined with Journal, PartitionByNamespace or Watch,
+// which handle keys as text. Defaults to false.
+func ByteaKeys(enabled bool) Option {
+	return func(o *Options) error {
+		o.ByteaKeys = enabled
+		return nil
+	}
+}
+
+// LtreeKeys configures EnsureSchema to add a path column to the table that
+// maps the namespaces of each key onto an ltree path, with a GiST index, and
+// prefix queries to match the paths of keys with ltree operators rather than
+// their keys with LIKE. The index serves prefix queries under any collation,
+// and queries of the immediate children of a key. The path column is
+// generated from the key by the database, so writes are unchanged, and adding
+// it to an existing table rewrites the table. It requires
+// PostgreSQL 12 and the ltree extension, which EnsureSchema creates, and
+// cannot be combined with ByteaKeys. Defaults to false.
+func LtreeKeys(enabled bool) Option {
+	return func(o *Options) error {
+		o.LtreeKeys = enabled
+		return nil
+	}
+}
+
+// Schema configures the schema of the table, rather than the first schema of
+// the search_path, unless the table name is qualified with its schema.
+// EnsureSchema creates the schema if it does not exist. Defaults to the
+// search_path.
+func Schema(name string) Option {
+	return func(o *Options) error {
+		o.Schema = name
+		return nil
+	}
+}
+
+// KeyColumn configures the name of the column of the table that stores keys,
+// for existing tables. It cannot be combined with Watch, whose trigger is
+// shared by all tables. Defaults to "key".
+func KeyColumn(name string) Option {
+	return func(o *Options) error {
+		if name == "" {
+			return fmt.Errorf("invalid key column: %s", name)
+		}
+		o.KeyColumn = name
+		return nil
+	}
+}
+
+// DataColumn configures the name of the column of the table that stores
+// values, for existing tables. Defaults to "data".
+func DataColumn(name string) Option {
+	return func(o *Options) error {
+		if name == "" {
+			return fmt.Errorf("invalid data column: %s", name)
+		}
+		o.DataColumn = name
+		return nil
+	}
+}
+
+// NamespaceTables configures the datastore to store the keys of the given
+// namespaces, such as "/pins", in tables of their own, while other keys are
+// stored in the default table. Keys are routed to the table of the longest
+// namespace they are in and queries are fanned out to every table that may
+// have matching keys, so hot namespaces can be moved to other tablespaces
+// with ALTER TABLE ... SET TABLESPACE. The tables share the pool and the other
+// options of the datastore. Defaults to none.
+func NamespaceTables(tables map[string]string) Option {
+	return func(o *Options) error {
+		for ns, table := range tables {
+			k := ds.NewKey(ns)
+			if k.String() == "/" {
+				return fmt.Errorf("invalid namespace table namespace: %s", ns)
+			}
+			if table == "" {
+				return fmt.Errorf("invalid namespace table: %s", table)
+			}
+			if o.NamespaceTables == nil {
+				o.NamespaceTables = map[string]string{}
+			}
+			o.NamespaceTables[k.String()] = table
+		}
+		return nil
+	}
+}
+
+// KeyPrefix configures the datastore to store its keys under the given
+// prefix, such as "/myapp", which is added to the keys of every operation and
+// removed from the keys of query results, so several datastores can share a
+// table without wrapping them in a keytransform datastore. Keys are routed to
+// the tables of NamespaceTables before they are prefixed. Defaults to none.
+func KeyPrefix(prefix string) Option {
+	return func(o *Options) error {
+		k := ds.NewKey(prefix)
+		if k.String() == "/" {
+			o.KeyPrefix = ""
+			return nil
+		}
+		o.KeyPrefix = k.String()
+		return nil
+	}
+}
+
+// GoDSSQLCompat configures the datastore to use the tables of go-ds-sql, so a
+// deployment can switch drivers without migrating its tables. EnsureSchema
+// creates tables as go-ds-sql does, with a value that cannot be null, nil
+// values are stored as empty values and queries are ordered by key in the
+// collation of the database, which the unique index on the key serves. It
+// cannot be combined with the options that add columns to the table.
+// Defaults to false.
+func GoDSSQLCompat(enabled bool) Option {
+	return func(o *Options) error {
+		o.GoDSSQLCompat = enabled
+		return nil
+	}
+}
+
+// InjectFaults configures the datastore to inject the given faults into its
+// operations, for testing how an application copes with latency, lost
+// connections and serialization failures. It is not meant for production
+// use. Faults can be changed later with SetFaults. Defaults to no faults.
+func InjectFaults(f Faults) Option {
+	return func(o *Options) error {
+		if _, err := newFaultInjector(f); err != nil {
+			return err
+		}
+		o.Faults = &f
+		return nil
+	}
+}
+
+// ImmutableValues configures Put, PutMany, batches and transactions to insert
+// rows with ON CONFLICT DO NOTHING, leaving the rows of keys that are already
+// stored as they are, for content addressed data whose values never change
+// for a key. Putting a stored block again then neither rewrites its row nor
+// writes WAL. The expiration of a stored key is not removed by Put, while
+// PutWithTTL still updates it. Defaults to false.
+func ImmutableValues(enabled bool) Option {
+	return func(o *Options) error {
+		o.ImmutableValues = enabled
+		return nil
+	}
+}
+
+// Compression configures the datastore to compress values of at least
+// minSize bytes with the given algorithm before they are written, and to
+// decompress them when they are read. Every value starts with a format byte
+// and its size, so tables can hold values compressed with different
+// algorithms and GetSize does not read the whole value, but they cannot hold
+// values written without compression, so existing tables are converted with
+// Export and Import. Values are compared and ordered by queries after they
+// are read. Defaults to no compression.
+func Compression(algo CompressionAlgorithm, minSize int) Option {
+	return func(o *Options) error {
+		if _, ok := compressionFormats[algo]; !ok {
+			return fmt.Errorf("invalid compression algorithm: %s", algo)
+		}
+		if minSize < 0 {
+			return fmt.Errorf("invalid compression min size: %d", minSize)
+		}
+		o.Compression = algo
+		o.CompressionMinSize = minSize
+		return nil
+	}
+}
+
+// Encryption configures the datastore to encrypt values with AES-GCM before
+// they are written, with a random key per value that is itself encrypted
+// with the current key of the provider, so that the values cannot be read
+// without the keys. The size of values is not encrypted. Values that were
+// written without encryption, but with Compression, are read as they are
+// until RotateKeys encrypts them, while other values cannot be read, so
+// existing tables are converted with Export and Import. Encrypted values
+// differ every time they are written, so Merge rewrites rows whose value is
+// unchanged. Defaults to no encryption.
+func Encryption(keys KeyProvider) Option {
+	return func(o *Options) error {
+		if keys == nil {
+			return fmt.Errorf("invalid encryption: no key provider")
+		}
+		o.Encryption = keys
+		return nil
+	}
+}
+
+// VerifyChecksums configures Get, GetMany and queries to verify the values
+// they read against their checksum, and to fail with a *ChecksumError if a
+// value does not match, so corruption is detected when it is read rather
+// than by the next Scrub. Values without a checksum, written before
+// checksums were enabled, are not verified. It needs the Checksums option.
+// Defaults to false.
+func VerifyChecksums(enabled bool) Option {
+	return func(o *Options) error {
+		o.VerifyChecksums = enabled
+		return nil
+	}
+}
+
+// Dedup configures the datastore to store each distinct value once, in a
+// content table named after the table with a "_content" suffix and keyed by
+// the SHA-256 hash of the value, with the number of keys that reference it.
+// The data column of the table then holds the hash. It suits values that are
+// stored under many keys, such as provider records or pins. Values are
+// hashed by the server, which must be PostgreSQL 11 or later, and the
+// references are counted by a trigger that EnsureSchema creates. It cannot be
+// combined with Encryption, whose values never repeat. Defaults to false.
+func Dedup(enabled bool) Option {
+	return func(o *Options) error {
+		o.Dedup = enabled
+		return nil
+	}
+}
+
+// LargeObjects configures the datastore to store values larger than the
+// threshold in bytes in large objects, referenced by an `lo OID` column,
+// which are written and read in chunks so that neither the client nor the
+// server holds a whole value in a single message or bytea datum. A trigger
+// created by EnsureSchema unlinks the large objects of values that are
+// overwritten or deleted. Values are compared and ordered by queries after
+// they are read, and ImportEntries stores every value in the table. Defaults
+// to 0, which stores every value in the table.
+func LargeObjects(threshold int) Option {
+	return func(o *Options) error {
+		if threshold < 0 {
+			return fmt.Errorf("invalid large object threshold: %d", threshold)
+		}
+		o.LargeObjectThreshold = threshold
+		return nil
+	}
+}
+
+// ChunkedValues configures the datastore to split values larger than the
+// chunk size in bytes into rows of chunks of that size, in a table named
+// after the table with a "_chunks" suffix, as an alternative to LargeObjects
+// that needs no large object privileges and is replicated, dumped and
+// restored with the tables. The chunks are written one statement at a time
+// and reassembled as they are received, and a trigger created by EnsureSchema
+// deletes the chunks of values that are overwritten or deleted. The chunk
+// size must be at least 16 bytes. Defaults to 0, which stores every value in
+// the table.
+func ChunkedValues(chunkSize int) Option {
+	return func(o *Options) error {
+		if chunkSize < 0 || chunkSize > 0 && chunkSize < 16 {
+			return fmt.Errorf("invalid chunk size: %d", chunkSize)
+		}
+		o.ChunkSize = chunkSize
+		return nil
+	}
+}
+
+// MaxValueSize configures the datastore to reject the puts of values larger
+// than the given size in bytes with a *ValueTooLargeError, before they are
+// sent to the server. Defaults to 0, which puts values of any size.
+func MaxValueSize(size int) Option {
+	return func(o *Options) error {
+		if size < 0 {
+			return fmt.Errorf("invalid maximum value size: %d", size)
+		}
+		o.MaxValueSize = size
+		return nil
+	}
+}
+
+// PrepareStatements configures the datastore to prepare the statements of
+// Get, Has, GetSize, Put and Delete on every connection of the pools the
+// datastore creates, by NewDatastore and for ReadReplicas, before it is first
+// used, so that these operations skip the round trip that parses and describes
+// them. The connections of a pool given to NewDatastoreWithPool are not
+// prepared. Statements annotated by the
+// SQLComments option are not prepared. It must stay disabled behind
+// connection poolers in transaction mode, such as PgBouncer, that do not keep
+// the prepared statements of a client, along with setting QueryExecMode to
+// pgx.QueryExecModeExec or pgx.QueryExecModeSimpleProtocol. Defaults to
+// false.
+func PrepareStatements(enabled bool) Option {
+	return func(o *Options) error {
+		o.PrepareStatements = enabled
+		return nil
+	}
+}
+
+// QueryExecMode configures how the connections of the pools that
+// NewDatastore creates execute the statements that are not prepared, see
+// pgx.QueryExecMode. Defaults to pgx.QueryExecModeCacheStatement, which
+// prepares and caches every statement on first use.
+func QueryExecMode(mode pgx.QueryExecMode) Option {
+	return func(o *Options) error {
+		if mode < pgx.QueryExecModeCacheStatement || mode > pgx.QueryExecModeSimpleProtocol {
+			return fmt.Errorf("invalid query exec mode: %d", mode)
+		}
+		o.QueryExecMode = mode
+		return nil
+	}
+}
+
+// StatementCacheCapacity configures the number of statements that the
+// connections of the pools that NewDatastore creates cache in the
+// pgx.QueryExecModeCacheStatement and pgx.QueryExecModeCacheDescribe modes.
+// Defaults to the default of pgx, 512.
+func StatementCacheCapacity(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid statement cache capacity: %d", n)
+		}
+		o.StatementCacheCapacity = n
+		return nil
+	}
+}
+
+// SkipUnchanged configures the datastore to leave the rows of keys that are
+// put again with the same value, checksum and expiration as they are, so that
+// putting them writes neither a new version of the row nor WAL. It has no
+// effect on CockroachDB, on encrypted values, whose stored form differs every
+// time, or with Merge, which already leaves unchanged rows as they are, and
+// cannot be combined with LargeObjects or ChunkedValues. Defaults to false.
+func SkipUnchanged(enabled bool) Option {
+	return func(o *Options) error {
+		o.SkipUnchanged = enabled
+		return nil
+	}
+}
+
+// AsyncCommit configures the connections of the pools created by the
+// datastore with synchronous_commit off, so that writes return before their
+// WAL is flushed to disk, and Sync flushes the WAL of all the writes committed
+// before it. Writes that are not synced may be lost if the server crashes,
+// but the database stays consistent. It cannot be combined with other
+// dialects. Defaults to false.
+func AsyncCommit(enabled bool) Option {
+	return func(o *Options) error {
+		o.AsyncCommit = enabled
+		return nil
+	}
+}
@@ -0,0 +1,144 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// partitionColumn is a column the table is partitioned by that is derived
+// from the key of each row. Unique indexes of partitioned tables must include
+// the columns they are partitioned by, so rows are "upserted" on the key and
+// the column, and the column is set by every statement that inserts rows.
+type partitionColumn struct {
+	name    string
+	def     string // type in definitions and casts
+	sqlType string // type as reported by format_type
+	value   func(ds.Key) (any, error)
+}
+
+// partitionKeyIndexSQL determines if the table has a valid unique index on
+// its key and the given partition column, which is required to "upsert" rows.
+const partitionKeyIndexSQL = `SELECT bool_or(i.indisvalid) FROM pg_index i
+	JOIN pg_attribute k ON k.attrelid = i.indrelid AND k.attnum = i.indkey[0]
+	JOIN pg_attribute p ON p.attrelid = i.indrelid AND p.attnum = i.indkey[1]
+	WHERE i.indrelid = $1::regclass AND i.indisunique AND i.indnatts = 2 AND k.attname = $2 AND p.attname = $3`
+
+// timePartition is the partition column of hypertables.
+func timePartition(keyTime func(ds.Key) (time.Time, error)) *partitionColumn {
+	return &partitionColumn{
+		name:    "ts",
+		def:     "TIMESTAMPTZ",
+		sqlType: "timestamp with time zone",
+		value: func(k ds.Key) (any, error) {
+			t, err := keyTime(k)
+			if err != nil {
+				return nil, fmt.Errorf("no time in key %s: %w", k, err)
+			}
+			return t, nil
+		},
+	}
+}
+
+// namespacePartition is the partition column of tables partitioned by the
+// first namespace of their keys.
+var namespacePartition = &partitionColumn{
+	name:    "ns",
+	def:     "TEXT",
+	sqlType: "text",
+	value: func(k ds.Key) (any, error) {
+		return firstNamespace(k.String()), nil
+	},
+}
+
+// firstNamespace returns the first namespace of a key, "blocks" for
+// "/blocks/foo", or the empty string for the root key.
+func firstNamespace(key string) string {
+	ns, _, _ := strings.Cut(strings.TrimPrefix(key, "/"), "/")
+	return ns
+}
+
+// conflictTarget returns the columns of the unique index rows are "upserted"
+// on.
+func (d *Datastore) conflictTarget() string {
+	if d.partition != nil {
+		return d.keyCol + ", " + d.partition.name
+	}
+	return d.keyCol
+}
+
+// partitionValue returns the value of the partition column for a key stored
+// in the table, derived from the key of the datastore without KeyPrefix.
+func (d *Datastore) partitionValue(key ds.Key) (any, error) {
+	return d.partition.value(ds.RawKey(d.stripKey(key.String())))
+}
+
+// partitionValues returns the values of the partition column for the given
+// keys stored in the table, as an array parameter.
+func (d *Datastore) partitionValues(keys []ds.Key) (any, error) {
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		v, err := d.partitionValue(k)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// relationName returns the quoted name of a relation in the schema of the
+// table, named after the table with the given suffix.
+func (d *Datastore) relationName(suffix string) string {
+	parts := strings.Split(d.tableName, ".")
+	parts[len(parts)-1] += "_" + suffix
+	return pgx.Identifier(parts).Sanitize()
+}
+
+// partitioned reports whether the table is created with declarative
+// partitioning.
+func (d *Datastore) partitioned() bool {
+	return len(d.namespaces) > 0 || d.hashPartitions > 0
+}
+
+// partitionStorage returns the WITH clause of partitions, which take the
+// storage parameters as partitioned tables have no storage of their own.
+func (d *Datastore) partitionStorage() string {
+	if len(d.storageParams) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" WITH (%s)", strings.Join(d.storageParams, ", "))
+}
+
+// ensureHashPartitions creates the partitions of a table partitioned by the
+// hash of the key, if they do not already exist.
+func (d *Datastore) ensureHashPartitions(ctx context.Context, tx pgx.Tx) error {
+	for i := 0; i < d.hashPartitions; i++ {
+		sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES WITH (MODULUS %d, REMAINDER %d)%s",
+			d.relationName(fmt.Sprintf("p%d", i)), d.table, d.hashPartitions, i, d.partitionStorage())
+		_, err := tx.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureNamespacePartitions creates a partition of the table for each of
+// the namespaces, and a default partition for keys in other namespaces, if
+// they do not already exist.
+func (d *Datastore) ensureNamespacePartitions(ctx context.Context, tx pgx.Tx) error {
+	with := d.partitionStorage()
+	for _, ns := range d.namespaces {
+		_, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES IN (%s)%s", d.relationName(ns), d.table, quoteLiteral(ns), with))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s DEFAULT%s", d.relationName("default"), d.table, with))
+	return err
+}
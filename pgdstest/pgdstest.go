@@ -0,0 +1,135 @@
+// Package pgdstest runs PostgreSQL embedded in tests, with
+// fergusstrange/embedded-postgres, and returns datastores backed by it, so
+// that projects that use pgds can test against it without Docker or a
+// database of their own.
+//
+// The PostgreSQL binaries are downloaded the first time a server is started,
+// and cached in ~/.embedded-postgres-go. PostgreSQL refuses to run as root.
+//
+//	func TestPins(t *testing.T) {
+//		d := pgdstest.New(t, pgds.TTL(true))
+//		...
+//	}
+//
+// Starting a server takes a few seconds, so packages with many tests should
+// share one, started in TestMain:
+//
+//	var server *pgdstest.Server
+//
+//	func TestMain(m *testing.M) {
+//		var err error
+//		server, err = pgdstest.Start()
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//		code := m.Run()
+//		server.Stop()
+//		os.Exit(code)
+//	}
+//
+// It is a module of its own so that its dependencies are not dependencies of
+// pgds.
+package pgdstest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+)
+
+// Server is an embedded PostgreSQL server.
+type Server struct {
+	pg         *embeddedpostgres.EmbeddedPostgres
+	dir        string
+	connString string
+	tables     atomic.Int64
+}
+
+// Start starts an embedded PostgreSQL server on a free port, with its data in
+// a temporary directory that Stop removes.
+func Start() (*Server, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "pgdstest")
+	if err != nil {
+		return nil, err
+	}
+	cfg := embeddedpostgres.DefaultConfig().
+		Port(port).
+		Database("pgdstest").
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+	pg := embeddedpostgres.NewDatabase(cfg)
+	if err := pg.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("starting embedded postgres: %w", err)
+	}
+	return &Server{pg: pg, dir: dir, connString: cfg.GetConnectionURL() + "?sslmode=disable"}, nil
+}
+
+// freePort returns a TCP port that is free on the loopback interface.
+func freePort() (uint32, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return uint32(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// ConnString returns the connection string of the server's database.
+func (s *Server) ConnString() string {
+	return s.connString
+}
+
+// Stop stops the server and removes its data.
+func (s *Server) Stop() error {
+	err := s.pg.Stop()
+	if rerr := os.RemoveAll(s.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// New returns a datastore on a new table of the server, created with the
+// given options, that is closed when the test completes.
+func (s *Server) New(t testing.TB, options ...pgds.Option) *pgds.Datastore {
+	t.Helper()
+	table := fmt.Sprintf("pgdstest_%d", s.tables.Add(1))
+	options = append([]pgds.Option{pgds.Table(table), pgds.CreateTable(true)}, options...)
+	d, err := pgds.NewDatastore(context.Background(), s.connString, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+// New starts a server for the test and returns a datastore created with the
+// given options. The server is stopped when the test completes.
+func New(t testing.TB, options ...pgds.Option) *pgds.Datastore {
+	t.Helper()
+	s, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	return s.New(t, options...)
+}
@@ -0,0 +1,28 @@
+package pgdstest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestNew(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("postgres cannot run as root")
+	}
+	ctx := context.Background()
+	d := New(t)
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, []byte("a")) {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
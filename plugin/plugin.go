@@ -0,0 +1,208 @@
+// Package plugin is a kubo plugin that adds the "pgds" datastore type, so that
+// a kubo repo can store its data in PostgreSQL without forking kubo. It is
+// built into kubo by adding it to plugin/loader/preload_list:
+//
+//	pgds github.com/ipfs/ipfs-ds-postgres/plugin *
+//
+// The datastore is then configured in the Datastore.Spec of the repo config,
+// for example to store blocks in PostgreSQL:
+//
+//	{
+//	  "type": "mount",
+//	  "mounts": [
+//	    {
+//	      "mountpoint": "/blocks",
+//	      "type": "pgds",
+//	      "connString": "postgres://ipfs@db.example.com/ipfs",
+//	      "table": "blocks",
+//	      "options": {"createTable": true, "immutableValues": true}
+//	    },
+//	    ...
+//	  ]
+//	}
+//
+// The options are those of the pgds package of the same name, starting with a
+// lowercase letter: createTable, checksums, ttl, immutableValues, keyPrefix,
+// schema, maxConns and queryFetchSize.
+//
+// It is a module of its own so that the dependencies of kubo are not
+// dependencies of pgds.
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	pgds "github.com/ipfs/ipfs-ds-postgres"
+	kplugin "github.com/ipfs/kubo/plugin"
+	"github.com/ipfs/kubo/repo"
+	"github.com/ipfs/kubo/repo/fsrepo"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Plugins are the plugins of the package, loaded by kubo.
+var Plugins = []kplugin.Plugin{
+	&pgdsPlugin{},
+}
+
+type pgdsPlugin struct{}
+
+var _ kplugin.PluginDatastore = (*pgdsPlugin)(nil)
+
+func (*pgdsPlugin) Name() string {
+	return "ds-pgds"
+}
+
+func (*pgdsPlugin) Version() string {
+	return "0.1.0"
+}
+
+func (*pgdsPlugin) Init(_ *kplugin.Environment) error {
+	return nil
+}
+
+func (*pgdsPlugin) DatastoreTypeName() string {
+	return "pgds"
+}
+
+// datastoreConfig is the configuration of a datastore parsed from its spec.
+type datastoreConfig struct {
+	connString string
+	options    []pgds.Option
+	// the database of the connection string, and the applied options, that
+	// the disk spec is made of
+	database string
+	applied  pgds.Options
+}
+
+// DatastoreConfigParser returns the parser of the specs of pgds datastores.
+func (*pgdsPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
+	return parseConfig
+}
+
+func parseConfig(params map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+	var c datastoreConfig
+	var ok bool
+	c.connString, ok = params["connString"].(string)
+	if !ok || c.connString == "" {
+		return nil, fmt.Errorf("'connString' field is missing or not string")
+	}
+	// the connection string is parsed now, without connecting, so that an
+	// invalid one is reported when the config is loaded, and its password
+	// is not part of the error
+	connConfig, err := pgconn.ParseConfig(c.connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'connString': %w", err)
+	}
+	c.database = connConfig.Database
+	if table, ok := params["table"]; ok {
+		name, ok := table.(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("'table' field is not a string")
+		}
+		c.options = append(c.options, pgds.Table(name))
+	}
+
+	options, _ := params["options"].(map[string]interface{})
+	if _, ok := params["options"]; ok && options == nil {
+		return nil, fmt.Errorf("'options' field is not an object")
+	}
+	for name, v := range options {
+		opt, err := parseOption(name, v)
+		if err != nil {
+			return nil, err
+		}
+		c.options = append(c.options, opt)
+	}
+	// options are validated now rather than when the repo is opened
+	err = c.applied.Apply(append([]pgds.Option{pgds.OptionDefaults}, c.options...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseOption returns the pgds option of the given name and JSON value.
+func parseOption(name string, v interface{}) (pgds.Option, error) {
+	switch name {
+	case "createTable":
+		b, err := boolOption(name, v)
+		return pgds.CreateTable(b), err
+	case "checksums":
+		b, err := boolOption(name, v)
+		return pgds.Checksums(b), err
+	case "ttl":
+		b, err := boolOption(name, v)
+		return pgds.TTL(b), err
+	case "immutableValues":
+		b, err := boolOption(name, v)
+		return pgds.ImmutableValues(b), err
+	case "keyPrefix":
+		s, err := stringOption(name, v)
+		return pgds.KeyPrefix(s), err
+	case "schema":
+		s, err := stringOption(name, v)
+		return pgds.Schema(s), err
+	case "maxConns":
+		n, err := intOption(name, v)
+		return pgds.MaxConns(int32(n)), err
+	case "queryFetchSize":
+		n, err := intOption(name, v)
+		return pgds.QueryFetchSize(n), err
+	}
+	return nil, fmt.Errorf("unknown option %q", name)
+}
+
+func boolOption(name string, v interface{}) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("option %q is not a boolean", name)
+	}
+	return b, nil
+}
+
+func stringOption(name string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("option %q is not a string", name)
+	}
+	return s, nil
+}
+
+// intOption returns the value of an integer option, which JSON decodes as a
+// float64.
+func intOption(name string, v interface{}) (int, error) {
+	f, ok := v.(float64)
+	if !ok || f != float64(int32(f)) {
+		return 0, fmt.Errorf("option %q is not an integer", name)
+	}
+	return int(f), nil
+}
+
+// DiskSpec returns the values that identify the stored data, which kubo
+// persists in the datastore_spec file of the repo and compares with the spec
+// of the config each time the repo is opened: the database, the table, and
+// the prefix of the keys. The values are normalized, so that equivalent specs
+// have the same disk spec. The host, which may change when the database is
+// moved or fails over, is left out, as are the user and password, so that no
+// secret is written to the repo, and the options that do not change where
+// the data is stored.
+func (c *datastoreConfig) DiskSpec() fsrepo.DiskSpec {
+	spec := map[string]interface{}{
+		"type":     "pgds",
+		"database": c.database,
+		"table":    c.applied.Table,
+	}
+	if c.applied.Schema != "" {
+		spec["schema"] = c.applied.Schema
+	}
+	if c.applied.KeyPrefix != "" {
+		spec["keyPrefix"] = c.applied.KeyPrefix
+	}
+	return spec
+}
+
+// Create opens the datastore. The path of the repo is not used.
+func (c *datastoreConfig) Create(string) (repo.Datastore, error) {
+	return pgds.NewDatastore(context.Background(), c.connString, c.options...)
+}
@@ -0,0 +1,114 @@
+package pgds
+
+import (
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// prefixKey returns the key stored in the table for the given key, under the
+// KeyPrefix of the datastore.
+func (d *Datastore) prefixKey(key ds.Key) ds.Key {
+	if d.keyPrefix == "" {
+		return key
+	}
+	return ds.RawKey(d.keyPrefix).Child(key)
+}
+
+// prefixKeys returns the keys stored in the table for the given keys.
+func (d *Datastore) prefixKeys(keys []ds.Key) []ds.Key {
+	if d.keyPrefix == "" {
+		return keys
+	}
+	prefixed := make([]ds.Key, len(keys))
+	for i, k := range keys {
+		prefixed[i] = d.prefixKey(k)
+	}
+	return prefixed
+}
+
+// stripKey returns the key of the datastore for the given key stored in the
+// table.
+func (d *Datastore) stripKey(key string) string {
+	if d.keyPrefix == "" {
+		return key
+	}
+	key = strings.TrimPrefix(key, d.keyPrefix)
+	if key == "" {
+		return "/"
+	}
+	return key
+}
+
+// prefixFilter translates a filter on the keys of the datastore into a
+// filter on the keys stored in the table. It returns false if the filter
+// must be applied to the keys of the datastore.
+func (d *Datastore) prefixFilter(f dsq.Filter) (dsq.Filter, bool) {
+	switch f := f.(type) {
+	case dsq.FilterKeyCompare:
+		f.Key = d.prefixKey(ds.RawKey(f.Key)).String()
+		return f, true
+	case dsq.FilterKeyPrefix:
+		return dsq.FilterKeyPrefix{Prefix: d.keyPrefix + f.Prefix}, true
+	case seekAfter:
+		return seekAfter{key: d.keyPrefix + f.key}, true
+	case dsq.FilterValueCompare:
+		return f, true
+	}
+	return nil, false
+}
+
+// prefixQuery runs the query with the given function on the keys stored in
+// the table, and returns its results with the keys of the datastore. Filters
+// and orders on keys that cannot be translated are applied to the results,
+// along with the offset and limit of the query.
+func (d *Datastore) prefixQuery(q dsq.Query, query func(dsq.Query) (dsq.Results, error)) (dsq.Results, error) {
+	if d.keyPrefix == "" {
+		return query(q)
+	}
+
+	tq := q
+	tq.Prefix = d.prefixKey(ds.NewKey(q.Prefix)).String()
+	tq.Filters = nil
+	var naive dsq.Query
+	for _, f := range q.Filters {
+		tf, ok := d.prefixFilter(f)
+		if !ok {
+			naive.Filters = append(naive.Filters, f)
+			continue
+		}
+		tq.Filters = append(tq.Filters, tf)
+	}
+	for _, o := range q.Orders {
+		switch o.(type) {
+		case dsq.OrderByKey, dsq.OrderByKeyDescending, dsq.OrderByValue, dsq.OrderByValueDescending:
+			// keys under the same prefix sort in the same order
+		default:
+			naive.Orders = q.Orders
+		}
+	}
+	if len(naive.Filters) > 0 || len(naive.Orders) > 0 {
+		tq.Orders = nil
+		tq.Offset = 0
+		tq.Limit = 0
+		naive.Offset = q.Offset
+		naive.Limit = q.Limit
+	}
+
+	res, err := query(tq)
+	if err != nil {
+		return nil, err
+	}
+	stripped := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if ok && r.Error == nil {
+				r.Key = d.stripKey(r.Key)
+			}
+			return r, ok
+		},
+		Close: res.Close,
+	})
+	return dsq.ResultsReplaceQuery(dsq.NaiveQueryApply(naive, stripped), q), nil
+}
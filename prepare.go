@@ -0,0 +1,77 @@
+package pgds
+
+import (
+	"context"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// preparer prepares the statements of the datastores that share a pool on
+// its connections, when they are acquired. A statement is prepared with its
+// SQL as its name, so that pgx executes the prepared statement when it is
+// given the SQL, and falls back to executing the SQL on the connections it
+// could not be prepared on.
+type preparer struct {
+	mu    sync.Mutex
+	stmts []string
+	// the number of statements prepared, or that failed to be, on each
+	// connection
+	conns sync.Map // *pgx.Conn -> int
+}
+
+// add adds statements to prepare on the connections.
+func (p *preparer) add(stmts ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stmts = append(p.stmts, stmts...)
+}
+
+// prepare prepares the statements that were not yet prepared on the
+// connection. Statements that fail to be prepared, for example because the
+// table does not exist yet, are executed as they are.
+func (p *preparer) prepare(ctx context.Context, conn *pgx.Conn) {
+	p.mu.Lock()
+	stmts := p.stmts
+	p.mu.Unlock()
+	var done int
+	if n, ok := p.conns.Load(conn); ok {
+		done = n.(int)
+	}
+	if done == len(stmts) {
+		return
+	}
+	for _, sql := range stmts[done:] {
+		_, _ = conn.Prepare(ctx, sql, sql)
+	}
+	p.conns.Store(conn, len(stmts))
+}
+
+// forget forgets a connection that is closed.
+func (p *preparer) forget(conn *pgx.Conn) {
+	p.conns.Delete(conn)
+}
+
+// preparedStatements returns the statements of the datastore that
+// PrepareStatements prepares.
+func (d *Datastore) preparedStatements() []string {
+	stmts := []string{d.getSQL, d.hasSQL, d.getSizeSQL}
+	if d.readOnly {
+		return stmts
+	}
+	stmts = append(stmts, d.deleteSQL)
+	// the statement of a put only depends on the configuration, but the
+	// partition of the key must be valid
+	var sql string
+	var err error
+	if d.merge {
+		sql, _, err = d.mergeQuery(ds.NewKey(d.keyPrefix+"/pgds"), []byte{})
+	} else {
+		sql, _, err = d.putQuery(ds.NewKey(d.keyPrefix+"/pgds"), []byte{})
+	}
+	if err == nil {
+		stmts = append(stmts, sql)
+	}
+	return stmts
+}
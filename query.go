@@ -0,0 +1,406 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jackc/pgx/v5"
+)
+
+// sqlOps are the SQL comparison operators for query filter operations.
+var sqlOps = map[dsq.Op]string{
+	dsq.Equal:              "=",
+	dsq.NotEqual:           "<>",
+	dsq.GreaterThan:        ">",
+	dsq.GreaterThanOrEqual: ">=",
+	dsq.LessThan:           "<",
+	dsq.LessThanOrEqual:    "<=",
+}
+
+// escapeLike escapes the LIKE pattern metacharacters in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// SeekAfter returns a query filter that matches keys that sort after the given
+// key. Unless the query has other orders, results are ordered by key, so that a
+// large scan can be resumed from the last key it returned, starting from the
+// empty key:
+//
+//	q := dsq.Query{Filters: []dsq.Filter{pgds.SeekAfter(last)}, Limit: 1000}
+//
+// This uses the index on the key column rather than skipping rows like an
+// offset does, so the cost of each page does not grow as the scan progresses.
+func SeekAfter(key string) dsq.Filter {
+	return seekAfter{key: key}
+}
+
+type seekAfter struct {
+	key string
+}
+
+func (f seekAfter) Filter(e dsq.Entry) bool {
+	return e.Key > f.key
+}
+
+func (f seekAfter) String() string {
+	return fmt.Sprintf("SEEK AFTER %q", f.key)
+}
+
+// filterSQL translates a query filter into a SQL condition that takes the
+// returned argument as parameter n. It returns false if the filter cannot be
+// expressed in SQL.
+func (d *Datastore) filterSQL(f dsq.Filter, n int) (string, any, bool) {
+	switch f := f.(type) {
+	case dsq.FilterKeyCompare:
+		op, ok := sqlOps[f.Op]
+		if !ok {
+			return "", nil, false
+		}
+		// keys are compared byte-wise, as the naive filter does
+		return fmt.Sprintf("%s %s $%d", d.orderedKey(), op, n), d.keyArg(f.Key), true
+	case dsq.FilterKeyPrefix:
+		cond, arg := d.hasPrefixSQL(f.Prefix, n)
+		return cond, arg, true
+	case seekAfter:
+		return fmt.Sprintf("%s > $%d", d.orderedKey(), n), d.keyArg(f.key), true
+	case dsq.FilterValueCompare:
+		op, ok := sqlOps[f.Op]
+		// encoded values and large objects are compared after they are read
+		if !ok || !d.comparesValues() {
+			return "", nil, false
+		}
+		return fmt.Sprintf("%s %s $%d", d.valueExpr(), op, n), f.Value, true
+	default:
+		return "", nil, false
+	}
+}
+
+// ordersSQL translates query orders into ORDER BY expressions. It returns
+// false if any of the orders cannot be expressed in SQL.
+func (d *Datastore) ordersSQL(orders []dsq.Order) ([]string, bool) {
+	exprs := make([]string, 0, len(orders))
+	for _, o := range orders {
+		switch o.(type) {
+		case dsq.OrderByKey:
+			// keys are ordered byte-wise, as the naive order does
+			exprs = append(exprs, d.orderedKey())
+		case dsq.OrderByKeyDescending:
+			exprs = append(exprs, d.orderedKey()+" DESC")
+		case dsq.OrderByValue:
+			// encoded values and large objects are ordered after they are read
+			if !d.comparesValues() {
+				return nil, false
+			}
+			exprs = append(exprs, d.valueExpr())
+		case dsq.OrderByValueDescending:
+			if !d.comparesValues() {
+				return nil, false
+			}
+			exprs = append(exprs, d.valueExpr()+" DESC")
+		default:
+			return nil, false
+		}
+	}
+	return exprs, true
+}
+
+// prefixWhere appends the conditions that match the keys under the given
+// normalized prefix, and their arguments, to where and args.
+func (d *Datastore) prefixWhere(prefix string, where []string, args []any) ([]string, []any) {
+	if prefix == "/" {
+		return where, args
+	}
+	if d.ltreeKeys {
+		args = append(args, descendantsQuery(prefix, 0))
+		where = append(where, fmt.Sprintf("path ~ $%d::lquery", len(args)))
+	} else if !d.byteaKeys {
+		args = append(args, escapeLike(prefix+"/")+"%")
+		where = append(where, fmt.Sprintf(`%s LIKE $%d ESCAPE '\'`, d.keyCol, len(args)))
+	}
+	// LIKE is not supported by bytea and only uses btree indexes, the BRIN
+	// index needs the range of keys under the prefix
+	if d.byteaKeys || d.brinPages > 0 {
+		cond, rangeArgs := d.prefixRange(prefix, len(args)+1)
+		where = append(where, cond)
+		args = append(args, rangeArgs...)
+	}
+	// the partial index of the namespace is only used if the query has its
+	// condition, which must not be a parameter
+	if ns, ok := d.partialIndex(prefix); ok {
+		where = append(where, d.namespacePredicate(ns))
+	}
+	// only scan the partition of the namespace, which KeyPrefix is not part of
+	if ns := firstNamespace(d.stripKey(prefix)); d.partition == namespacePartition && ns != "" {
+		args = append(args, ns)
+		where = append(where, fmt.Sprintf("ns = $%d", len(args)))
+	}
+	return where, args
+}
+
+// Query returns multiple rows from the SQL database based on the passed query parameters.
+func (d *Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	if len(d.tables) > 0 {
+		return d.queryTables(q, func(td *Datastore, tq dsq.Query) (dsq.Results, error) {
+			return td.prefixQuery(tq, func(pq dsq.Query) (dsq.Results, error) {
+				return td.queryTable(ctx, pq)
+			})
+		})
+	}
+	return d.prefixQuery(q, func(pq dsq.Query) (dsq.Results, error) {
+		return d.queryTable(ctx, pq)
+	})
+}
+
+// queryTable returns the rows of the table that match the query.
+func (d *Datastore) queryTable(ctx context.Context, q dsq.Query) (res dsq.Results, err error) {
+	if _, ok := ctx.Deadline(); ok || d.scanTimeout == 0 {
+		err = d.do(ctx, opQuery, q.Prefix, func(ctx context.Context) error {
+			res, err = d.query(ctx, d.annotate(ctx, opQuery, d.reader(ctx)), q)
+			return err
+		})
+		return res, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.scanTimeout)
+	err = d.do(ctx, opQuery, q.Prefix, func(ctx context.Context) error {
+		res, err = d.query(ctx, d.annotate(ctx, opQuery, d.reader(ctx)), q)
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the deadline lasts until the results are closed
+	return dsq.ResultsFromIterator(res.Query(), dsq.Iterator{
+		Next: res.NextSync,
+		Close: func() error {
+			defer cancel()
+			return res.Close()
+		},
+	}), nil
+}
+
+func (d *Datastore) query(ctx context.Context, db querier, q dsq.Query) (dsq.Results, error) {
+	var sql string
+	if q.KeysOnly && q.ReturnsSizes {
+		sql = fmt.Sprintf("SELECT %s, %s", d.keyCol, d.sizeExpr())
+	} else if q.KeysOnly {
+		sql = "SELECT " + d.keyCol
+	} else {
+		sql = fmt.Sprintf("SELECT %s, %s", d.keyCol, d.valueCols())
+	}
+	returnExpirations := d.ttl && q.ReturnExpirations
+	if returnExpirations {
+		sql += ", expires_at"
+	}
+	sql += fmt.Sprintf(" FROM %s", d.table)
+
+	var where []string
+	var args []any
+	if q.Prefix != "" {
+		// normalize
+		where, args = d.prefixWhere(ds.NewKey(q.Prefix).String(), where, args)
+	}
+	if d.ttl {
+		where = append(where, notExpiredPredicate)
+	}
+
+	// filters that cannot be expressed in SQL are applied to the results
+	var naiveFilters []dsq.Filter
+	for _, f := range q.Filters {
+		cond, arg, ok := d.filterSQL(f, len(args)+1)
+		if !ok {
+			naiveFilters = append(naiveFilters, f)
+			continue
+		}
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	// orders are applied to the results if any of them cannot be expressed in SQL
+	orderBy, ok := d.ordersSQL(q.Orders)
+	naiveOrder := !ok
+	if ok && len(orderBy) > 0 {
+		sql += " ORDER BY " + strings.Join(orderBy, ", ")
+	} else if ok {
+		// always order so that pages selected by limit and offset are
+		// stable, in the same byte-wise order seek filters compare keys in
+		sql += " ORDER BY " + d.orderedKey()
+	}
+
+	// only apply limit and offset if we do not have to naive filter/order the results
+	if len(naiveFilters) == 0 && !naiveOrder {
+		if q.Limit != 0 {
+			sql += fmt.Sprintf(" LIMIT %d", q.Limit)
+		}
+		if q.Offset != 0 {
+			sql += fmt.Sprintf(" OFFSET %d", q.Offset)
+		}
+	}
+
+	var rows resultRows
+	var err error
+	if d.fetchSize > 0 {
+		rows, err = openCursor(ctx, db, d.fetchSize, sql, args...)
+	} else {
+		rows, err = db.Query(ctx, sql, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the destinations of the rows are allocated once
+	var s *valueScan
+	var size int
+	var expiration *time.Time
+	var dest []any
+	if q.KeysOnly {
+		s = &valueScan{}
+		dest = []any{d.keyDest(&s.key)}
+		if q.ReturnsSizes {
+			dest = append(dest, &size)
+		}
+	} else {
+		s = d.newValueScan(true)
+		dest = s.dest
+	}
+	if returnExpirations {
+		dest = append(dest, &expiration)
+	}
+
+	// the rows of a query in a transaction hold its connection, so they are
+	// all read before the values stored outside them are read on it
+	_, inTxn := db.(pgx.Tx)
+	var buffered []scannedRow
+	buffering := inTxn && !q.KeysOnly && d.largeValues()
+	if buffering {
+		buffered, err = readRows(rows, s, dest, &expiration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			if buffering {
+				if len(buffered) == 0 {
+					return dsq.Result{}, false
+				}
+				buffered[0].restore(s, &expiration)
+				buffered = buffered[1:]
+			} else if !rows.Next() {
+				if rows.Err() != nil {
+					return dsq.Result{Error: rows.Err()}, false
+				}
+				return dsq.Result{}, false
+			} else if err := rows.Scan(dest...); err != nil {
+				return dsq.Result{Error: err}, false
+			}
+
+			entry := dsq.Entry{Key: s.key}
+			if q.KeysOnly && q.ReturnsSizes {
+				entry.Size = size
+			} else if !q.KeysOnly {
+				// unless they were buffered, the rows of the query hold
+				// the connection and the values stored outside them are
+				// read on another one
+				vdb := querier(d.pool)
+				if buffering {
+					vdb = db
+				}
+				data, err := d.value(ctx, vdb, s.key, s)
+				if err != nil {
+					return dsq.Result{Error: err}, false
+				}
+				entry.Value = data
+				d.metrics.bytesRead.Add(int64(len(data)))
+				if q.ReturnsSizes {
+					entry.Size = len(data)
+				}
+			}
+			if expiration != nil {
+				entry.Expiration = *expiration
+			}
+			return dsq.Result{Entry: entry}, true
+		},
+		Close: func() error {
+			rows.Close()
+			return nil
+		},
+	}
+
+	res := dsq.ResultsFromIterator(q, it)
+
+	for _, f := range naiveFilters {
+		res = dsq.NaiveFilter(res, f)
+	}
+
+	if naiveOrder {
+		res = dsq.NaiveOrder(res, q.Orders...)
+	}
+
+	// if we have naive filters or orders, offset and limit won't have been applied in the query
+	if len(naiveFilters) > 0 || naiveOrder {
+		if q.Offset != 0 {
+			res = dsq.NaiveOffset(res, q.Offset)
+		}
+		if q.Limit != 0 {
+			res = dsq.NaiveLimit(res, q.Limit)
+		}
+	}
+
+	return res, nil
+}
+
+// scannedRow is a row of a query scanned into a valueScan, kept until its
+// value is read.
+type scannedRow struct {
+	key        string
+	data       []byte
+	sum        *int64
+	ref        *uint32
+	expiration *time.Time
+}
+
+// readRows scans all the rows into the destinations of s and expiration and
+// closes them. The values are scanned into slices of their own, as s has no
+// buffer.
+func readRows(rows resultRows, s *valueScan, dest []any, expiration **time.Time) ([]scannedRow, error) {
+	defer rows.Close()
+	var scanned []scannedRow
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r := scannedRow{key: s.key, data: s.data}
+		if s.sum != nil {
+			sum := *s.sum
+			r.sum = &sum
+		}
+		if s.ref != nil {
+			ref := *s.ref
+			r.ref = &ref
+		}
+		if *expiration != nil {
+			exp := **expiration
+			r.expiration = &exp
+		}
+		scanned = append(scanned, r)
+	}
+	return scanned, rows.Err()
+}
+
+// restore sets the destinations of the row as if it was just scanned.
+func (r scannedRow) restore(s *valueScan, expiration **time.Time) {
+	s.key, s.data, s.sum, s.ref = r.key, r.data, r.sum, r.ref
+	*expiration = r.expiration
+}
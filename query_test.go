@@ -0,0 +1,374 @@
+package pgds
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestEscapeLike(t *testing.T) {
+	cases := map[string]string{
+		"/a/b":    "/a/b",
+		"/100%":   `/100\%`,
+		"/a_b":    `/a\_b`,
+		`/a\b`:    `/a\\b`,
+		`/%_\%_`:  `/\%\_\\\%\_`,
+		"/plain/": "/plain/",
+	}
+	for in, expect := range cases {
+		if out := escapeLike(in); out != expect {
+			t.Errorf("escapeLike(%q) = %q, expected %q", in, out, expect)
+		}
+	}
+}
+
+func TestFilterSQL(t *testing.T) {
+	d := &Datastore{keyName: "key", keyCol: `"key"`, dataName: "data", dataCol: `"data"`}
+	cond, arg, ok := d.filterSQL(dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a"}, 2)
+	if !ok || cond != `"key" COLLATE "C" > $2` || arg != "/a" {
+		t.Fatalf("unexpected key compare translation: %q, %v, %v", cond, arg, ok)
+	}
+	cond, arg, ok = d.filterSQL(dsq.FilterKeyPrefix{Prefix: "/a_"}, 1)
+	if !ok || cond != `"key" LIKE $1 ESCAPE '\'` || arg != `/a\_%` {
+		t.Fatalf("unexpected key prefix translation: %q, %v, %v", cond, arg, ok)
+	}
+	_, _, ok = d.filterSQL(dsq.FilterValueCompare{Op: "~", Value: []byte("a")}, 1)
+	if ok {
+		t.Fatal("expected unknown operator not to be translated")
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, k := range []string{"/f/a", "/f/b", "/f/c", "/f/c_d", "/f/cxd"} {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := []dsq.Filter{
+		dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/f/a"},
+		dsq.FilterKeyPrefix{Prefix: "/f/c_"},
+		dsq.FilterValueCompare{Op: dsq.NotEqual, Value: []byte("/f/b")},
+		dsq.FilterKeyCompare{Op: dsq.LessThanOrEqual, Key: "/f/c"},
+	}
+	for _, f := range filters {
+		res, err := d.Query(ctx, dsq.Query{Prefix: "/f", Filters: []dsq.Filter{f}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expect int
+		for _, k := range []string{"/f/a", "/f/b", "/f/c", "/f/c_d", "/f/cxd"} {
+			if f.Filter(dsq.Entry{Key: k, Value: []byte(k)}) {
+				expect++
+			}
+		}
+		if len(entries) != expect {
+			t.Fatalf("filter %s returned %d entries, expected %d", f, len(entries), expect)
+		}
+		for _, e := range entries {
+			if !f.Filter(e) {
+				t.Fatalf("filter %s returned unexpected entry %s", f, e.Key)
+			}
+		}
+	}
+}
+
+func TestOrdersSQL(t *testing.T) {
+	d := &Datastore{keyName: "key", keyCol: `"key"`, dataName: "data", dataCol: `"data"`}
+	exprs, ok := d.ordersSQL([]dsq.Order{dsq.OrderByKeyDescending{}, dsq.OrderByValue{}})
+	if !ok || len(exprs) != 2 || exprs[0] != `"key" COLLATE "C" DESC` || exprs[1] != `"data"` {
+		t.Fatalf("unexpected orders translation: %v, %v", exprs, ok)
+	}
+	_, ok = d.ordersSQL([]dsq.Order{dsq.OrderByKey{}, dsq.OrderByFunction(func(a, b dsq.Entry) int { return 0 })})
+	if ok {
+		t.Fatal("expected custom order not to be translated")
+	}
+}
+
+func TestQueryOrders(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	keys := []string{"/o/B", "/o/a", "/o/c", "/o/A"}
+	for _, k := range keys {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := d.Query(ctx, dsq.Query{Prefix: "/o", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// byte-wise descending order is /o/c, /o/a, /o/B, /o/A
+	if len(entries) != 2 || entries[0].Key != "/o/a" || entries[1].Key != "/o/B" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestQueryPrefixMetacharacters(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	for _, k := range []string{"/p%/a", "/pq/a", "/p_/a", `/p\/a`} {
+		err := d.Put(ctx, ds.RawKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, prefix := range []string{"/p%", "/p_", `/p\`} {
+		res, err := d.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Key != prefix+"/a" {
+			t.Fatalf("prefix %q returned unexpected entries: %v", prefix, entries)
+		}
+	}
+}
+
+func TestQueryBRINIndex(t *testing.T) {
+	d, done := newDS(t, BRINIndex(16))
+	defer done()
+
+	ctx := context.Background()
+	err := d.EnsureSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var method string
+	err = d.pool.QueryRow(ctx, "SELECT am.amname FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid JOIN pg_am am ON am.oid = c.relam WHERE c.relname = 'blocks_key_brin_idx'").Scan(&method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "brin" {
+		t.Fatalf("expected a BRIN index, got %s", method)
+	}
+
+	for _, k := range []string{"/journal/1", "/journal/2", "/journal0", "/journal/1/a", "/journa"} {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := d.Query(ctx, dsq.Query{Prefix: "/journal", KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Key != "/journal/1" || entries[1].Key != "/journal/1/a" || entries[2].Key != "/journal/2" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestPartialIndex(t *testing.T) {
+	d := &Datastore{tableName: "blocks", table: quoteTable("blocks"), keyName: "key", keyCol: `"key"`, dataName: "data", dataCol: `"data"`, partialIndexes: []string{"/pins", "/pins/recursive"}}
+	for prefix, expected := range map[string]string{"/pins": "/pins", "/pins/a": "/pins", "/pins/recursive/a": "/pins/recursive", "/pinsx": "", "/blocks": ""} {
+		if ns, _ := d.partialIndex(prefix); ns != expected {
+			t.Errorf("expected the partial index of %s to be %q, got %q", prefix, expected, ns)
+		}
+	}
+	sql, err := d.indexSQL(IndexSpec{Kind: IndexPrefix, Namespace: "/pins/recursive"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `CREATE INDEX IF NOT EXISTS "blocks_pins_recursive_idx" ON "blocks" ("key" COLLATE "C") WHERE "key" COLLATE "C" >= '/pins/recursive/' AND "key" COLLATE "C" < '/pins/recursive0'`; sql != expected {
+		t.Fatalf("unexpected index statement %s", sql)
+	}
+	if pred := d.namespacePredicate("/it's"); pred != `"key" COLLATE "C" >= '/it''s/' AND "key" COLLATE "C" < '/it''s0'` {
+		t.Fatalf("unexpected predicate %s", pred)
+	}
+
+	d, done := newDS(t, PartialIndex("/pins"))
+	defer done()
+	ctx := context.Background()
+	err = d.EnsureSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/pins/a", "/pins/b", "/pinsx/c", "/blocks/d"} {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var partial bool
+	err = d.pool.QueryRow(ctx, "SELECT indpred IS NOT NULL FROM pg_index WHERE indexrelid = 'blocks_pins_idx'::regclass").Scan(&partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial {
+		t.Fatal("expected the index of the namespace to be partial")
+	}
+	res, err := d.Query(ctx, dsq.Query{Prefix: "/pins", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/pins/a" || entries[1].Key != "/pins/b" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	// "/B" sorts before "/a" byte-wise, but after it in most collations
+	for _, k := range []string{"/d", "/c", "/b", "/a", "/B"} {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	for offset := 0; offset < 5; offset += 2 {
+		res, err := d.Query(ctx, dsq.Query{KeysOnly: true, Offset: offset, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+	}
+	if len(keys) != 5 {
+		t.Fatalf("expected pages to cover all keys, got: %v", keys)
+	}
+	for i, k := range []string{"/B", "/a", "/b", "/c", "/d"} {
+		if keys[i] != k {
+			t.Fatalf("expected pages in byte-wise key order, got: %v", keys)
+		}
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	d, done := newDS(t, QueryFetchSize(2))
+	defer done()
+
+	ctx := context.Background()
+	keys := []string{"/a", "/b", "/c", "/d", "/e"}
+	for _, k := range keys {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txn, err := d.NewTransaction(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Discard(ctx)
+
+	for _, r := range []ds.Read{d, txn} {
+		res, err := r.Query(ctx, dsq.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(keys) {
+			t.Fatalf("expected %d entries, got %d", len(keys), len(entries))
+		}
+		for i, e := range entries {
+			if e.Key != keys[i] || string(e.Value) != keys[i] {
+				t.Fatalf("unexpected entry %d: %v", i, e)
+			}
+		}
+	}
+}
+
+func TestQuerySeekAfter(t *testing.T) {
+	d, done := newDS(t)
+	defer done()
+
+	ctx := context.Background()
+	expect := []string{"/s/A", "/s/B", "/s/a", "/s/b", "/s/c"}
+	for _, k := range expect {
+		err := d.Put(ctx, ds.NewKey(k), []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	var last string
+	for {
+		q := dsq.Query{Prefix: "/s", KeysOnly: true, Limit: 2, Filters: []dsq.Filter{SeekAfter(last)}}
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		last = entries[len(entries)-1].Key
+	}
+	if len(keys) != len(expect) {
+		t.Fatalf("expected seeking to cover all keys, got: %v", keys)
+	}
+	for i, k := range expect {
+		if keys[i] != k {
+			t.Fatalf("expected keys in byte-wise order, got: %v", keys)
+		}
+	}
+}
+
+func TestSQLComment(t *testing.T) {
+	ctx := WithComponent(context.Background(), "block store")
+	ctx = WithTraceParent(ctx, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	comment := sqlComment(ctx, opGet)
+	expected := " /*component='block%20store',op='get',traceparent='00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'*/"
+	if comment != expected {
+		t.Fatalf("expected %s, got %s", expected, comment)
+	}
+
+	comment = sqlComment(WithComponent(context.Background(), "*/ DROP TABLE blocks; /*'"), opGet)
+	if strings.Count(comment, "*/") != 1 || strings.Count(comment, "'") != 4 {
+		t.Fatalf("comment not escaped: %s", comment)
+	}
+}
@@ -0,0 +1,120 @@
+// Package rdsauth authenticates pgds connections to Amazon RDS and Aurora
+// PostgreSQL with IAM database authentication, so that no static password is
+// needed in the connection string.
+//
+// The user of the connection string must be granted the rds_iam role, and the
+// connections must use TLS (sslmode=require or stricter):
+//
+//	creds := aws.NewCredentialsCache(...)
+//	d, err := pgds.NewDatastore(ctx, "postgres://pgds@mydb.123456789012.us-east-1.rds.amazonaws.com:5432/ipfs?sslmode=verify-full",
+//		pgds.BeforeConnect(rdsauth.BeforeConnect("us-east-1", creds)))
+package rdsauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/jackc/pgx/v5"
+)
+
+// TokenLifetime is how long a token is accepted by the server to open new
+// connections. Connections that are already open are not affected when it
+// expires.
+const TokenLifetime = 15 * time.Minute
+
+// refreshBefore is how long before they expire tokens are replaced.
+const refreshBefore = 5 * time.Minute
+
+// emptyPayloadHash is the SHA-256 hash of the empty body of the token request.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// BuildToken returns a token authenticating user on the database server at
+// endpoint, as "host:port", in the given region, signed with the given
+// credentials. The token is used as the password of the connection.
+func BuildToken(ctx context.Context, endpoint, region, user string, creds aws.CredentialsProvider) (string, error) {
+	return buildToken(ctx, endpoint, region, user, creds, time.Now())
+}
+
+func buildToken(ctx context.Context, endpoint, region, user string, creds aws.CredentialsProvider, now time.Time) (string, error) {
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return "", fmt.Errorf("invalid endpoint %s: %w", endpoint, err)
+	}
+	credentials, err := creds.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("retrieving AWS credentials: %w", err)
+	}
+
+	query := url.Values{
+		"Action":        {"connect"},
+		"DBUser":        {user},
+		"X-Amz-Expires": {strconv.Itoa(int(TokenLifetime.Seconds()))},
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+endpoint+"/?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	signed, _, err := v4.NewSigner().PresignHTTP(ctx, credentials, req, emptyPayloadHash, "rds-db", region, now.UTC())
+	if err != nil {
+		return "", fmt.Errorf("signing RDS auth token: %w", err)
+	}
+	return strings.TrimPrefix(signed, "https://"), nil
+}
+
+// BeforeConnect returns a hook for the pgds.BeforeConnect option that sets the
+// password of each new connection to a token for its host, port and user in
+// the given region. Tokens are built again when they are about to expire, and
+// credentials are retrieved from creds when they are, so creds should cache
+// them, like aws.CredentialsCache does.
+func BeforeConnect(region string, creds aws.CredentialsProvider) func(context.Context, *pgx.ConnConfig) error {
+	t := &tokens{region: region, creds: creds, cache: make(map[string]token)}
+	return t.beforeConnect
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// tokens caches the tokens of each endpoint and user.
+type tokens struct {
+	region string
+	creds  aws.CredentialsProvider
+
+	mu    sync.Mutex
+	cache map[string]token
+}
+
+func (t *tokens) beforeConnect(ctx context.Context, config *pgx.ConnConfig) error {
+	endpoint := net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	value, err := t.get(ctx, endpoint, config.User, time.Now())
+	if err != nil {
+		return err
+	}
+	config.Password = value
+	return nil
+}
+
+func (t *tokens) get(ctx context.Context, endpoint, user string, now time.Time) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := user + "@" + endpoint
+	if tok, ok := t.cache[key]; ok && now.Before(tok.expires.Add(-refreshBefore)) {
+		return tok.value, nil
+	}
+	value, err := buildToken(ctx, endpoint, t.region, user, t.creds, now)
+	if err != nil {
+		return "", err
+	}
+	t.cache[key] = token{value: value, expires: now.Add(TokenLifetime)}
+	return value, nil
+}
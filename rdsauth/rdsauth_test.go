@@ -0,0 +1,101 @@
+package rdsauth
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/jackc/pgx/v5"
+)
+
+func testCredentials(retrieved *int) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		*retrieved++
+		return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+	})
+}
+
+func TestBuildToken(t *testing.T) {
+	var retrieved int
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	token, err := buildToken(context.Background(), "db.example.com:5432", "us-east-1", "pgds", testCredentials(&retrieved), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, "db.example.com:5432/?") {
+		t.Fatalf("unexpected token %s", token)
+	}
+	u, err := url.Parse("https://" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	expected := map[string]string{
+		"Action":           "connect",
+		"DBUser":           "pgds",
+		"X-Amz-Expires":    "900",
+		"X-Amz-Date":       "20240102T030405Z",
+		"X-Amz-Credential": "AKIDEXAMPLE/20240102/us-east-1/rds-db/aws4_request",
+	}
+	for k, v := range expected {
+		if q.Get(k) != v {
+			t.Errorf("expected %s=%s, got %s", k, v, q.Get(k))
+		}
+	}
+	if q.Get("X-Amz-Signature") == "" {
+		t.Error("token is not signed")
+	}
+
+	_, err = BuildToken(context.Background(), "db.example.com", "us-east-1", "pgds", testCredentials(&retrieved))
+	if err == nil {
+		t.Fatal("expected an error for an endpoint without port")
+	}
+}
+
+func TestBeforeConnect(t *testing.T) {
+	var retrieved int
+	config, err := pgx.ParseConfig("postgres://pgds@db.example.com:5433/ipfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = BeforeConnect("eu-west-1", testCredentials(&retrieved))(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(config.Password, "db.example.com:5433/?") || !strings.Contains(config.Password, "DBUser=pgds") {
+		t.Fatalf("unexpected password %s", config.Password)
+	}
+
+	// tokens are reused until they are about to expire
+	tokens := &tokens{region: "eu-west-1", creds: testCredentials(&retrieved), cache: make(map[string]token)}
+	now := time.Now()
+	first, err := tokens.get(context.Background(), "db.example.com:5433", "pgds", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retrieved = 0
+	second, err := tokens.get(context.Background(), "db.example.com:5433", "pgds", now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || retrieved != 0 {
+		t.Fatal("expected the token to be reused")
+	}
+	third, err := tokens.get(context.Background(), "db.example.com:5433", "pgds", now.Add(TokenLifetime-refreshBefore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || retrieved != 1 {
+		t.Fatal("expected the token to be refreshed")
+	}
+	_, err = tokens.get(context.Background(), "db.example.com:5433", "other", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved != 2 {
+		t.Fatal("expected a token for each user")
+	}
+}
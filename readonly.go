@@ -0,0 +1,17 @@
+package pgds
+
+import (
+	"errors"
+)
+
+// ErrReadOnly is returned by the operations that write to the database when
+// the datastore was created with the ReadOnly option.
+var ErrReadOnly = errors.New("datastore is read-only")
+
+// writable returns ErrReadOnly if the datastore is read-only.
+func (d *Datastore) writable() error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
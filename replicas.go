@@ -0,0 +1,37 @@
+package pgds
+
+import (
+	"context"
+)
+
+type staleReadsKey struct{}
+
+// WithStaleReads returns a context that controls whether reads made with it
+// may be served by a read replica, and so miss recent writes. Reads may be
+// stale by default when read replicas are configured.
+func WithStaleReads(ctx context.Context, allowed bool) context.Context {
+	return context.WithValue(ctx, staleReadsKey{}, allowed)
+}
+
+// reader returns where reads made with the given context are sent: the next
+// read replica, or the primary if there are none or stale reads are not
+// allowed.
+func (d *Datastore) reader(ctx context.Context) querier {
+	if len(d.replicas) == 0 {
+		return d.pool
+	}
+	if allowed, ok := ctx.Value(staleReadsKey{}).(bool); ok && !allowed {
+		return d.pool
+	}
+	i := d.nextReplica.Add(1)
+	return d.replicas[i%uint64(len(d.replicas))]
+}
+
+// closeReplicas closes the pools of connections to read replicas the
+// datastore created.
+func (d *Datastore) closeReplicas() {
+	for _, replica := range d.ownedReplicas {
+		replica.Close()
+	}
+	d.ownedReplicas = nil
+}
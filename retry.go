@@ -0,0 +1,89 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+// RetryPolicy configures how operations that fail with transient errors are
+// retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is tried, including the
+	// first. One or less disables retries.
+	MaxAttempts int
+	// BaseDelay is how long to wait before the first retry. The delay doubles
+	// with each retry, up to MaxDelay, and is jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// retriable reports whether an operation that failed with the given error may
+// succeed if it is tried again: the statement was never sent, the transaction
+// was aborted by a serialization failure or deadlock, or the connection to the
+// server was lost or refused.
+func retriable(err error) bool {
+	if pgconn.SafeToRetry(err) || connectionError(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01":
+			return true
+		case "XX000":
+			// YugabyteDB reports some transient conflicts as internal errors
+			for _, msg := range yugabyteTransient {
+				if strings.Contains(pgErr.Message, msg) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// yugabyteTransient are the messages of the errors YugabyteDB returns for
+// operations that conflicted with others or raced with a change of schema,
+// which succeed when tried again.
+var yugabyteTransient = []string{
+	"Try again",
+	"Restart read required",
+	"catalog snapshot used for this transaction has been invalidated",
+}
+
+// retry runs an operation, retrying it according to the retry policy while it
+// fails with transient errors. All the operations of the datastore are
+// idempotent, so they can safely be run again even if an attempt failed after
+// its statement reached the server.
+func (d *Datastore) retry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		// the reader of a stream and the entries of an import cannot be
+		// read again
+		if op == opPutStream || op == opImport {
+			d.maybeFailover(err)
+			return err
+		}
+		if d.maybeFailover(err) && attempt == 0 {
+			continue
+		}
+		if err == nil || attempt+1 >= d.retryPolicy.MaxAttempts || !retriable(err) {
+			return err
+		}
+		delay := backoff(attempt, d.retryPolicy.BaseDelay, d.retryPolicy.MaxDelay)
+		d.log(ctx, tracelog.LogLevelDebug, "retrying operation", map[string]any{
+			"op":      op,
+			"attempt": attempt + 1,
+			"delay":   delay,
+			"err":     err,
+		})
+		if sleep(ctx, delay) != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// sampleOversampling is how many more rows than requested the blocks sampled
+// by Sample are expected to have, so that the rows under the prefix that are
+// not evenly spread among the blocks are still likely to be enough.
+const sampleOversampling = 4
+
+// Sample returns up to n keys under the given prefix chosen at random, from
+// the table and from the tables of NamespaceTables in proportion to their
+// estimated number of keys, so that large datastores can be audited without
+// scanning every key. On PostgreSQL, the keys are chosen among the rows of
+// blocks of the table sampled with TABLESAMPLE SYSTEM when the prefix has
+// many more keys than requested, which reads a fraction of the table but
+// favors keys stored close together. Otherwise, or if the sampled blocks do
+// not have enough keys, they are chosen among all the keys under the prefix.
+func (d *Datastore) Sample(ctx context.Context, prefix ds.Key, n int) ([]ds.Key, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	tables := d.prefixTables(prefix)
+	counts := make([]int64, len(tables))
+	var total int64
+	for i, td := range tables {
+		c, err := td.estimateCount(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = c
+		total += c
+	}
+
+	var keys []ds.Key
+	for i, td := range tables {
+		m := n
+		if len(tables) > 1 && total > 0 {
+			m = int(math.Ceil(float64(n) * float64(counts[i]) / float64(total)))
+		}
+		if m == 0 {
+			continue
+		}
+		var sampled []ds.Key
+		err := td.do(ctx, opSample, prefix.String(), func(ctx context.Context) error {
+			var err error
+			sampled, err = td.sample(ctx, prefix, m, counts[i])
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sampled...)
+	}
+	if len(tables) > 1 {
+		rand.Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+	}
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys, nil
+}
+
+// sample returns up to n keys of the table under the prefix, which has about
+// the given number of keys, chosen at random.
+func (d *Datastore) sample(ctx context.Context, prefix ds.Key, n int, estimate int64) ([]ds.Key, error) {
+	where, args := d.prefixWhere(d.prefixKey(prefix).String(), nil, nil)
+	if d.ttl {
+		where = append(where, notExpiredPredicate)
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	if percent := 100 * float64(sampleOversampling*n) / float64(estimate); d.dialect == DialectPostgres && percent < 100 {
+		from := fmt.Sprintf("%s TABLESAMPLE SYSTEM (%g)", d.table, percent)
+		keys, err := d.sampleKeys(ctx, from, cond, args, n)
+		if err != nil || len(keys) == n {
+			return keys, err
+		}
+	}
+	return d.sampleKeys(ctx, d.table, cond, args, n)
+}
+
+// sampleKeys returns up to n keys of the rows of from that match cond, in a
+// random order.
+func (d *Datastore) sampleKeys(ctx context.Context, from, cond string, args []any, n int) ([]ds.Key, error) {
+	sql := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY random() LIMIT %d", d.keyCol, from, cond, n)
+	rows, err := d.annotate(ctx, opSample, d.reader(ctx)).Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]ds.Key, 0, n)
+	var key string
+	for rows.Next() {
+		if err := rows.Scan(d.keyDest(&key)); err != nil {
+			return nil, err
+		}
+		keys = append(keys, ds.RawKey(d.stripKey(key)))
+	}
+	return keys, rows.Err()
+}
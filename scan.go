@@ -0,0 +1,89 @@
+package pgds
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// valueScan holds the destinations of a key and the columns of valueCols, so
+// that they are allocated once per statement rather than once per row.
+type valueScan struct {
+	key  string
+	data []byte
+	sum  *int64
+	ref  *uint32
+	// dest are the destinations of the key, if it is scanned, and of the
+	// columns of valueCols
+	dest []any
+	// buf is the buffer the value of the next row is appended to. The
+	// values of rows are owned by the caller, so it is only set by
+	// AppendValue, with a buffer owned by its caller.
+	buf []byte
+	// direct is set if values are stored as they are put, so that the
+	// stored value is scanned straight into buf, after its contents
+	direct bool
+}
+
+// newValueScan returns the destinations of the columns of valueCols, preceded
+// by the key if withKey is set.
+func (d *Datastore) newValueScan(withKey bool) *valueScan {
+	s := &valueScan{direct: !d.encodesValues()}
+	if withKey {
+		s.dest = append(s.dest, d.keyDest(&s.key))
+	}
+	// the value is copied once, from the buffer of the connection
+	s.dest = append(s.dest, d.valueDest(appendBytes{s}, &s.sum, &s.ref)...)
+	return s
+}
+
+// stored returns the stored form of the value scanned from the row, without
+// the contents of buf it follows.
+func (s *valueScan) stored() []byte {
+	if s.data == nil || !s.direct {
+		return s.data
+	}
+	return s.data[len(s.buf):]
+}
+
+// appendBytes scans a value into a valueScan: appended to its buffer if it is
+// stored as it was put, or into a slice of its own to be decoded. Empty
+// values are scanned into empty slices rather than nil.
+type appendBytes struct {
+	s *valueScan
+}
+
+func (a appendBytes) ScanBytes(src []byte) error {
+	if src == nil {
+		a.s.data = nil
+		return nil
+	}
+	buf := a.s.buf
+	if buf == nil || !a.s.direct {
+		buf = make([]byte, 0, len(src))
+	}
+	a.s.data = append(buf, src...)
+	return nil
+}
+
+// value returns the value of the row scanned with the key, reading it from
+// outside the row if it is stored there, verifying it and decoding it. The
+// value is appended to the buffer of the scan.
+func (d *Datastore) value(ctx context.Context, db querier, key string, s *valueScan) ([]byte, error) {
+	data, sum, err := d.readValue(ctx, db, key, s.stored(), s.sum, s.ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.verify(ds.RawKey(d.stripKey(key)), data, sum); err != nil {
+		return nil, err
+	}
+	if s.ref == nil && s.direct {
+		// the value was scanned into the buffer
+		return s.data, nil
+	}
+	value, err := d.decode(data)
+	if err != nil || s.buf == nil {
+		return value, err
+	}
+	return append(s.buf, value...), nil
+}
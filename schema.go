@@ -0,0 +1,374 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+// quoteTable quotes a possibly schema qualified table name for use in SQL.
+func quoteTable(name string) string {
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
+
+// indexName returns the quoted name of an index on the table, suffixed with
+// the given name. Indexes are always created in the schema of their table, so
+// the name is unqualified.
+func (d *Datastore) indexName(suffix string) string {
+	parts := strings.Split(d.tableName, ".")
+	return pgx.Identifier{parts[len(parts)-1] + "_" + suffix}.Sanitize()
+}
+
+// schemaName returns the schema the table name is qualified with, if any.
+func (d *Datastore) schemaName() string {
+	parts := strings.Split(d.tableName, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// ensureSchemaExists creates the schema of the table if it does not exist.
+// Its existence is checked first as creating a schema requires the CREATE
+// privilege on the database, even if it exists.
+func (d *Datastore) ensureSchemaExists(ctx context.Context, tx pgx.Tx) error {
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_namespace WHERE nspname = $1)", d.schemaName()).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{d.schemaName()}.Sanitize())
+	return err
+}
+
+// keyIndexSQL determines if the table has a valid unique index on the key
+// column, which is required to "upsert" rows. It returns NULL if there is no
+// such index and false if the only such indexes are invalid.
+const keyIndexSQL = `SELECT bool_or(i.indisvalid) FROM pg_index i
+	JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+	WHERE i.indrelid = $1::regclass AND i.indisunique AND i.indnatts = 1 AND a.attname = $2`
+
+// prefixIndexSQL determines if the table has a valid btree index on its key
+// column that can serve prefix scans with LIKE, and byte-wise ordering of
+// keys, which is one that compares keys byte-wise with the C collation. The
+// pattern operator classes serve prefix scans but not ORDER BY key COLLATE
+// "C". The primary key only does if the database collation is C.
+const prefixIndexSQL = `SELECT exists(SELECT 1 FROM pg_index i
+	JOIN pg_class c ON c.oid = i.indexrelid
+	JOIN pg_am am ON am.oid = c.relam
+	JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+	JOIN pg_opclass op ON op.oid = i.indclass[0]
+	JOIN pg_collation co ON co.oid = i.indcollation[0]
+	WHERE i.indrelid = $1::regclass AND i.indisvalid AND i.indpred IS NULL AND am.amname = 'btree' AND a.attname = $2
+	AND op.opcdefault
+	AND (co.collcollate IN ('C', 'POSIX')
+		OR co.collname = 'default' AND (SELECT datcollate FROM pg_database WHERE datname = current_database()) IN ('C', 'POSIX')))`
+
+// EnsureSchema creates the table, and any columns and indexes required by the
+// configured options, if they do not already exist.
+func (d *Datastore) EnsureSchema(ctx context.Context) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if d.schemaName() != "" {
+		err = d.ensureSchemaExists(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	create := "CREATE TABLE"
+	if d.unlogged {
+		create = "CREATE UNLOGGED TABLE"
+	}
+	if d.hypertable != nil {
+		// unique indexes of a hypertable must include its time column, the
+		// index is created with the hypertable
+		_, err = tx.Exec(ctx, fmt.Sprintf("%s IF NOT EXISTS %s (%s %s NOT NULL, %s BYTEA, ts TIMESTAMPTZ NOT NULL)", create, d.table, d.keyCol, d.keyType(), d.dataCol))
+	} else if len(d.namespaces) > 0 {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %[1]s (%[2]s TEXT NOT NULL, %[3]s BYTEA, ns TEXT NOT NULL, PRIMARY KEY (%[2]s, ns)) PARTITION BY LIST (ns)", d.table, d.keyCol, d.dataCol))
+		if err == nil {
+			err = d.ensureNamespacePartitions(ctx, tx)
+		}
+	} else if d.hashPartitions > 0 {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %[1]s (%[2]s %[3]s PRIMARY KEY, %[4]s BYTEA) PARTITION BY HASH (%[2]s)", d.table, d.keyCol, d.keyType(), d.dataCol))
+		if err == nil {
+			err = d.ensureHashPartitions(ctx, tx)
+		}
+	} else if d.goDSSQL {
+		_, err = tx.Exec(ctx, fmt.Sprintf("%s IF NOT EXISTS %s (%s TEXT NOT NULL UNIQUE, %s BYTEA NOT NULL)", create, d.table, d.keyCol, d.dataCol))
+	} else {
+		_, err = tx.Exec(ctx, fmt.Sprintf("%s IF NOT EXISTS %s (%s %s PRIMARY KEY, %s BYTEA)", create, d.table, d.keyCol, d.keyType(), d.dataCol))
+	}
+	if err != nil {
+		return err
+	}
+
+	// tables created by hand may be missing the index needed for upserts
+	var keyIndexValid *bool
+	err = tx.QueryRow(ctx, keyIndexSQL, d.table, d.keyName).Scan(&keyIndexValid)
+	if err != nil {
+		return err
+	}
+	if keyIndexValid == nil && d.partition == nil {
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", d.indexName("key_idx"), d.table, d.keyCol))
+		if err != nil {
+			return err
+		}
+	}
+
+	// under other collations the primary key cannot serve prefix scans;
+	// bytea keys and other dialects compare keys byte-wise already
+	if d.dialect == DialectPostgres && d.brinPages == 0 && !d.byteaKeys {
+		var prefixIndex bool
+		err = tx.QueryRow(ctx, prefixIndexSQL, d.table, d.keyName).Scan(&prefixIndex)
+		if err != nil {
+			return err
+		}
+		if !prefixIndex {
+			sql, _ := d.indexSQL(IndexSpec{Kind: IndexPrefix}, false)
+			_, err = tx.Exec(ctx, sql)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, spec := range d.indexSpecs() {
+		sql, err := d.indexSQL(spec, false)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the parameters are not supported by the other dialects, and are set on
+	// the partitions of partitioned tables
+	if d.dialect == DialectPostgres && !d.partitioned() {
+		err = d.setStorageParameters(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.checksums {
+		_, err = tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS checksum BIGINT", d.table))
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.ttl {
+		_, err = tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ", d.table))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (expires_at) WHERE expires_at IS NOT NULL", d.indexName("expires_at_idx"), d.table))
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.ltreeKeys {
+		err = d.ensureKeyPaths(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.journal {
+		err = d.ensureJournal(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.dedup {
+		err = d.ensureContent(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.loThreshold > 0 {
+		err = d.ensureLargeObjects(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.chunkSize > 0 {
+		err = d.ensureChunks(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.hypertable != nil {
+		err = d.ensureHypertable(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.distributed {
+		// the table is distributed last, so that the columns and indexes
+		// above are created on the coordinator only once
+		var distributed bool
+		err = tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_dist_partition WHERE logicalrelid = $1::regclass)", d.table).Scan(&distributed)
+		if err != nil {
+			return err
+		}
+		if !distributed {
+			_, err = tx.Exec(ctx, "SELECT create_distributed_table($1::regclass, $2)", d.table, d.keyName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// SetUnlogged converts the table to an unlogged table, or back to a logged
+// one. Unlogged tables are not written to the write-ahead log, which makes
+// writes much faster, but they are emptied after a crash and are not
+// replicated to standbys, so they suit data that can be regenerated, such as
+// caches. The table is rewritten under an exclusive lock.
+func (d *Datastore) SetUnlogged(ctx context.Context, unlogged bool) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("ALTER TABLE %s SET LOGGED", d.table)
+	if unlogged {
+		sql = fmt.Sprintf("ALTER TABLE %s SET UNLOGGED", d.table)
+	}
+	_, err := d.pool.Exec(ctx, sql)
+	return err
+}
+
+// columnTypes are the types of the columns the datastore requires, as
+// reported by format_type.
+func (d *Datastore) columnTypes() map[string]string {
+	types := map[string]string{
+		d.keyName:  "text",
+		d.dataName: "bytea",
+	}
+	if d.byteaKeys {
+		types[d.keyName] = "bytea"
+	}
+	if d.ltreeKeys {
+		types["path"] = "ltree"
+	}
+	if d.checksums {
+		types["checksum"] = "bigint"
+	}
+	if d.ttl {
+		types["expires_at"] = "timestamp with time zone"
+	}
+	if d.largeValues() {
+		types[d.largeCol()] = d.largeType()
+	}
+	if d.partition != nil {
+		types[d.partition.name] = d.partition.sqlType
+	}
+	return types
+}
+
+// Check verifies that the database is reachable and that the table exists
+// with the columns and indexes the datastore requires.
+func (d *Datastore) Check(ctx context.Context) error {
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+	err = conn.Ping(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", d.table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("table %s does not exist", d.table)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT attname, format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped", d.table)
+	if err != nil {
+		return err
+	}
+	actual := map[string]string{}
+	for rows.Next() {
+		var name, typ string
+		err = rows.Scan(&name, &typ)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		actual[name] = typ
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	for name, typ := range d.columnTypes() {
+		actualType, ok := actual[name]
+		if !ok {
+			return fmt.Errorf("table %s is missing column %s", d.table, name)
+		}
+		if actualType != typ {
+			return fmt.Errorf("column %s of table %s has type %s, expected %s", name, d.table, actualType, typ)
+		}
+	}
+
+	var keyIndexValid *bool
+	columns := fmt.Sprintf("the %s column", d.keyName)
+	if d.partition != nil {
+		columns = fmt.Sprintf("the %s and %s columns", d.keyName, d.partition.name)
+		err = conn.QueryRow(ctx, partitionKeyIndexSQL, d.table, d.keyName, d.partition.name).Scan(&keyIndexValid)
+	} else {
+		err = conn.QueryRow(ctx, keyIndexSQL, d.table, d.keyName).Scan(&keyIndexValid)
+	}
+	if err != nil {
+		return err
+	}
+	if keyIndexValid == nil {
+		return fmt.Errorf("table %s has no primary key or unique index on %s", d.table, columns)
+	}
+	if !*keyIndexValid {
+		return fmt.Errorf("unique index on %s of table %s is invalid and must be rebuilt with REINDEX", columns, d.table)
+	}
+
+	// prefix scans still work without the index, scanning the whole table
+	if d.dialect == DialectPostgres && d.brinPages == 0 && !d.byteaKeys {
+		var prefixIndex bool
+		err = conn.QueryRow(ctx, prefixIndexSQL, d.table, d.keyName).Scan(&prefixIndex)
+		if err != nil {
+			return err
+		}
+		if !prefixIndex {
+			d.log(ctx, tracelog.LogLevelWarn, "no index serves prefix queries and queries ordered by key, create one with EnsureSchema", map[string]any{"table": d.tableName})
+		}
+	}
+
+	return nil
+}
+
+var _ ds.CheckedDatastore = (*Datastore)(nil)
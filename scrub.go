@@ -0,0 +1,194 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC-32C checksum of a value as stored in the checksum
+// column.
+func checksum(value []byte) int64 {
+	return int64(crc32.Checksum(value, castagnoli))
+}
+
+// ErrChecksumsDisabled is returned by Scrub when the datastore was created
+// without the Checksums option.
+var ErrChecksumsDisabled = errors.New("checksums are not enabled")
+
+// ScrubError is returned by Scrub when rows fail checksum verification.
+type ScrubError struct {
+	// Keys are the keys of the rows that failed verification.
+	Keys []ds.Key
+	// Repaired is true if the rows were deleted.
+	Repaired bool
+}
+
+func (e *ScrubError) Error() string {
+	if e.Repaired {
+		return fmt.Sprintf("deleted %d rows that failed checksum verification", len(e.Keys))
+	}
+	return fmt.Sprintf("%d rows failed checksum verification", len(e.Keys))
+}
+
+// ChecksumError is returned by reads that verify checksums when a value does
+// not match its checksum. It matches ErrCorruptValue with errors.Is.
+type ChecksumError struct {
+	// Key is the key of the corrupted value.
+	Key ds.Key
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("value of %s failed checksum verification", e.Key)
+}
+
+// Unwrap returns ErrCorruptValue.
+func (e *ChecksumError) Unwrap() error {
+	return ErrCorruptValue
+}
+
+// valueCols returns the columns read with the value of a row, which include
+// its checksum if values are verified, and the column of largeCol if values
+// may be stored outside their rows.
+func (d *Datastore) valueCols() string {
+	cols := d.valueExpr()
+	if d.verifyChecksums {
+		cols += ", checksum"
+	}
+	if d.largeValues() {
+		cols += ", " + d.largeCol()
+	}
+	return cols
+}
+
+// valueDest returns the destinations of the columns of valueCols.
+func (d *Datastore) valueDest(data any, sum **int64, ref **uint32) []any {
+	dest := []any{data}
+	if d.verifyChecksums {
+		dest = append(dest, sum)
+	}
+	if d.largeValues() {
+		dest = append(dest, ref)
+	}
+	return dest
+}
+
+// verify verifies a value read with valueCols against its checksum, if it
+// has one.
+func (d *Datastore) verify(key ds.Key, data []byte, sum *int64) error {
+	if sum == nil || *sum == checksum(data) {
+		return nil
+	}
+	return &ChecksumError{Key: key}
+}
+
+// Scrub reads every row of the datastore, in the table and in the tables of
+// NamespaceTables, and verifies the value against its checksum. Rows written
+// before checksums were enabled have their checksum filled in. If any row
+// fails verification a *ScrubError listing the keys is returned, and if the
+// ScrubRepair option is set the corrupted rows are deleted.
+func (d *Datastore) Scrub(ctx context.Context) error {
+	if !d.checksums {
+		return ErrChecksumsDisabled
+	}
+	// checksums missing from rows are filled in
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	var corrupt []ds.Key
+	for _, td := range d.prefixTables(ds.NewKey("/")) {
+		keys, err := td.scrub(ctx)
+		if err != nil {
+			return err
+		}
+		corrupt = append(corrupt, keys...)
+	}
+	if len(corrupt) > 0 {
+		return &ScrubError{Keys: corrupt, Repaired: d.scrubRepair}
+	}
+	return nil
+}
+
+// scrub verifies the rows of the keys of the datastore in the table, and
+// returns the keys of the corrupted rows.
+func (d *Datastore) scrub(ctx context.Context) ([]ds.Key, error) {
+	cols := fmt.Sprintf("%s, %s, checksum", d.keyCol, d.valueExpr())
+	if d.largeValues() {
+		cols += ", " + d.largeCol()
+	}
+	// only the rows under the KeyPrefix of the datastore are read
+	sql := fmt.Sprintf("SELECT %s FROM %s", cols, d.table)
+	where, args := d.prefixWhere(d.prefixKey(ds.NewKey("/")).String(), nil, nil)
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := d.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fill := fmt.Sprintf("UPDATE %s SET checksum = $2 WHERE %s = $1 AND checksum IS NULL AND %s = $3", d.table, d.keyCol, d.valueExpr())
+	fillLarge := fmt.Sprintf("UPDATE %s SET checksum = $2 WHERE %s = $1 AND checksum IS NULL AND %s = $3", d.table, d.keyCol, d.largeCol())
+	remove := fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND checksum = $2", d.table, d.keyCol)
+
+	var corrupt []ds.Key
+	for rows.Next() {
+		var key string
+		var data []byte
+		var sum *int64
+		var ref *uint32
+		dest := []any{d.keyDest(&key), &data, &sum}
+		if d.largeValues() {
+			dest = append(dest, &ref)
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			v, err := d.getLarge(ctx, d.pool, key, "checksum")
+			if err == errLargeObjectReplaced {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			data, sum, ref = v.data, v.sum, &v.ref
+		}
+
+		actual := checksum(data)
+		if sum == nil {
+			if ref != nil {
+				_, err = d.pool.Exec(ctx, fillLarge, d.keyArg(key), actual, *ref)
+			} else {
+				_, err = d.pool.Exec(ctx, fill, d.keyArg(key), actual, data)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if *sum == actual {
+			continue
+		}
+
+		corrupt = append(corrupt, ds.RawKey(d.stripKey(key)))
+		if d.scrubRepair {
+			_, err = d.pool.Exec(ctx, remove, d.keyArg(key), *sum)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return corrupt, rows.Err()
+}
+
+var _ ds.ScrubbedDatastore = (*Datastore)(nil)
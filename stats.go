@@ -0,0 +1,172 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Stats are statistics of a datastore since it was created.
+type Stats struct {
+	// Pool are the statistics of the pool of connections.
+	Pool *pgxpool.Stat
+	// Ops is the number of Get, Has, GetSize, Put, Delete, Query and batch
+	// commit operations.
+	Ops int64
+	// Errors is the number of operations that failed, not counting keys that
+	// were not found.
+	Errors int64
+	// BytesRead is the size of the values read by Get and queries.
+	BytesRead int64
+	// BytesWritten is the size of the values written by Put and batches.
+	BytesWritten int64
+}
+
+// Stats returns statistics of the datastore, including the operations on the
+// tables of NamespaceTables, and its pool of connections.
+func (d *Datastore) Stats() Stats {
+	stats := Stats{Pool: d.pool.Stat()}
+	for _, td := range d.prefixTables(ds.NewKey("/")) {
+		stats.Ops += td.metrics.totalOps.Load()
+		stats.Errors += td.metrics.totalErrors.Load()
+		stats.BytesRead += td.metrics.bytesRead.Load()
+		stats.BytesWritten += td.metrics.bytesWritten.Load()
+	}
+	return stats
+}
+
+// statsNamespaces is the number of namespaces TableStats reports.
+const statsNamespaces = 10
+
+// TableStats are statistics of the keys and values stored in the table and
+// in the tables of NamespaceTables.
+type TableStats struct {
+	// Keys is the number of keys.
+	Keys int64
+	// Bytes is the size of the values as they were put.
+	Bytes int64
+	// Sizes is the histogram of the sizes of the values, by increasing size.
+	// Empty buckets are left out.
+	Sizes []SizeBucket
+	// Namespaces are the first-level namespaces whose values are the
+	// largest, by decreasing size.
+	Namespaces []NamespaceStats
+}
+
+// SizeBucket is a bucket of the histogram of the sizes of values, which has
+// the values larger than the maximum size of the previous bucket, half its
+// own, up to its maximum size.
+type SizeBucket struct {
+	// MaxSize is the size of the largest values of the bucket, a power of 2.
+	MaxSize int64
+	Keys    int64
+	Bytes   int64
+}
+
+// NamespaceStats are statistics of the keys of a first-level namespace.
+type NamespaceStats struct {
+	// Namespace is the name of the namespace, without slashes.
+	Namespace string
+	Keys      int64
+	Bytes     int64
+}
+
+// TableStats returns statistics of the keys and values stored in the table,
+// for capacity planning: the number of keys and size of the values, the
+// histogram of the sizes of the values and the namespaces that use the most
+// space. They are computed by the server, which reads every row twice.
+func (d *Datastore) TableStats(ctx context.Context) (TableStats, error) {
+	var stats TableStats
+	buckets := map[int64]*SizeBucket{}
+	namespaces := map[string]*NamespaceStats{}
+	for _, td := range d.prefixTables(ds.NewKey("/")) {
+		err := td.do(ctx, opTableStats, "/", func(ctx context.Context) error {
+			return td.tableStats(ctx, buckets, namespaces)
+		})
+		if err != nil {
+			return TableStats{}, err
+		}
+	}
+
+	for _, b := range buckets {
+		stats.Keys += b.Keys
+		stats.Bytes += b.Bytes
+		stats.Sizes = append(stats.Sizes, *b)
+	}
+	sort.Slice(stats.Sizes, func(i, j int) bool {
+		return stats.Sizes[i].MaxSize < stats.Sizes[j].MaxSize
+	})
+	for _, ns := range namespaces {
+		stats.Namespaces = append(stats.Namespaces, *ns)
+	}
+	sort.Slice(stats.Namespaces, func(i, j int) bool {
+		a, b := stats.Namespaces[i], stats.Namespaces[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Namespace < b.Namespace
+	})
+	if len(stats.Namespaces) > statsNamespaces {
+		stats.Namespaces = stats.Namespaces[:statsNamespaces]
+	}
+	return stats, nil
+}
+
+// tableStats adds the histogram and namespaces of the values of the table to
+// the given ones. The bucket of a size is the bit length of size-1, so that
+// values of 2^(n-1)+1 to 2^n bytes are in bucket n.
+func (d *Datastore) tableStats(ctx context.Context, buckets map[int64]*SizeBucket, namespaces map[string]*NamespaceStats) error {
+	db := d.annotate(ctx, opTableStats, d.reader(ctx))
+	root := ds.NewKey("/")
+	size := fmt.Sprintf("coalesce(%s, 0)::bigint AS size", d.sizeExpr())
+
+	sizes, args := d.countQuery(size, root)
+	sql := fmt.Sprintf("SELECT length(ltrim((greatest(size, 1) - 1)::bit(64)::text, '0')), count(*), coalesce(sum(size), 0)::bigint FROM (%s) AS s GROUP BY 1", sizes)
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	var bucket, keys, bytes int64
+	for rows.Next() {
+		if err := rows.Scan(&bucket, &keys, &bytes); err != nil {
+			rows.Close()
+			return err
+		}
+		maxSize := int64(1) << bucket
+		b, ok := buckets[maxSize]
+		if !ok {
+			b = &SizeBucket{MaxSize: maxSize}
+			buckets[maxSize] = b
+		}
+		b.Keys += keys
+		b.Bytes += bytes
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	children, args := d.countQuery(fmt.Sprintf("%s AS ns, %s", d.childExpr(d.prefixKey(root).String()), size), root)
+	sql = fmt.Sprintf("SELECT ns, count(*), coalesce(sum(size), 0)::bigint FROM (%s) AS s GROUP BY ns ORDER BY 3 DESC, 1 LIMIT %d", children, statsNamespaces)
+	rows, err = db.Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var name string
+	for rows.Next() {
+		if err := rows.Scan(d.keyDest(&name), &keys, &bytes); err != nil {
+			return err
+		}
+		ns, ok := namespaces[name]
+		if !ok {
+			ns = &NamespaceStats{Namespace: name}
+			namespaces[name] = ns
+		}
+		ns.Keys += keys
+		ns.Bytes += bytes
+	}
+	return rows.Err()
+}
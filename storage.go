@@ -0,0 +1,63 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AutovacuumSettings are the per-table autovacuum parameters of the table.
+// Zero values leave the server settings.
+type AutovacuumSettings struct {
+	// VacuumScaleFactor and VacuumThreshold set how many rows must be updated
+	// or deleted, as a fraction of the table plus a number of rows, before
+	// the table is vacuumed.
+	VacuumScaleFactor float64
+	VacuumThreshold   int
+	// AnalyzeScaleFactor and AnalyzeThreshold set how many rows must change
+	// before the table is analyzed.
+	AnalyzeScaleFactor float64
+	AnalyzeThreshold   int
+	// VacuumCostLimit sets how much work autovacuum does on the table before
+	// sleeping.
+	VacuumCostLimit int
+}
+
+// storageParameters returns the storage parameters of the table set by the
+// options, as "name = value" settings.
+func (o *Options) storageParameters() []string {
+	var params []string
+	if o.FillFactor > 0 {
+		params = append(params, "fillfactor = "+strconv.Itoa(o.FillFactor))
+	}
+	av := o.Autovacuum
+	if av.VacuumScaleFactor > 0 {
+		params = append(params, "autovacuum_vacuum_scale_factor = "+strconv.FormatFloat(av.VacuumScaleFactor, 'f', -1, 64))
+	}
+	if av.VacuumThreshold > 0 {
+		params = append(params, "autovacuum_vacuum_threshold = "+strconv.Itoa(av.VacuumThreshold))
+	}
+	if av.AnalyzeScaleFactor > 0 {
+		params = append(params, "autovacuum_analyze_scale_factor = "+strconv.FormatFloat(av.AnalyzeScaleFactor, 'f', -1, 64))
+	}
+	if av.AnalyzeThreshold > 0 {
+		params = append(params, "autovacuum_analyze_threshold = "+strconv.Itoa(av.AnalyzeThreshold))
+	}
+	if av.VacuumCostLimit > 0 {
+		params = append(params, "autovacuum_vacuum_cost_limit = "+strconv.Itoa(av.VacuumCostLimit))
+	}
+	return params
+}
+
+// setStorageParameters sets the storage parameters of the table, so that they
+// also apply to a table that already exists.
+func (d *Datastore) setStorageParameters(ctx context.Context, tx pgx.Tx) error {
+	if len(d.storageParams) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s SET (%s)", d.table, strings.Join(d.storageParams, ", ")))
+	return err
+}
@@ -0,0 +1,248 @@
+package pgds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// PutStream "upserts" a row with the value read from r. Values stored outside
+// their rows, with the LargeObjects or ChunkedValues options, are streamed to
+// the server in chunks, so that only a chunk of the value is held in memory.
+// Other values, and values that are compressed or encrypted, are read whole
+// and put with Put. Unlike Put, a failed PutStream is not retried.
+func (d *Datastore) PutStream(ctx context.Context, key ds.Key, r io.Reader) error {
+	if td := d.route(key); td != d {
+		return td.PutStream(ctx, key, r)
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if d.maxValueSize > 0 {
+		r = &sizeLimitedReader{d: d, key: key, r: r}
+	}
+	if !d.largeValues() || d.encodesValues() {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return d.Put(ctx, key, value)
+	}
+	// values up to the threshold are stored in their rows
+	head, err := io.ReadAll(io.LimitReader(r, int64(d.largeThreshold())+1))
+	if err != nil {
+		return err
+	}
+	if !d.large(head) {
+		return d.Put(ctx, key, head)
+	}
+
+	key = d.prefixKey(key)
+	return d.do(ctx, opPutStream, key.String(), func(ctx context.Context) error {
+		n, err := d.putLargeFrom(ctx, d.annotate(ctx, opPutStream, d.pool), key, io.MultiReader(bytes.NewReader(head), r), nil)
+		if err == nil {
+			d.metrics.bytesWritten.Add(n)
+		}
+		return err
+	})
+}
+
+// GetStream returns a reader of the value of a key. Values stored outside
+// their rows, with the LargeObjects or ChunkedValues options, are read from
+// the server in chunks as the reader is read, in a consistent snapshot, so
+// that only a chunk of the value is held in memory. Other values, and values
+// that are compressed or encrypted, are read whole with Get. The reader holds
+// a connection until it is closed, and is read with ctx. If values are
+// verified the checksum is verified at the end of the value, and the reader
+// returns a *ChecksumError instead of io.EOF if it does not match.
+func (d *Datastore) GetStream(ctx context.Context, key ds.Key) (io.ReadCloser, error) {
+	if td := d.route(key); td != d {
+		return td.GetStream(ctx, key)
+	}
+	if !d.largeValues() || d.encodesValues() {
+		value, err := d.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	key = d.prefixKey(key)
+	var r *valueReader
+	err := d.do(ctx, opGetStream, key.String(), func(ctx context.Context) error {
+		var err error
+		if d.chunkSize > 0 {
+			r, err = d.openChunks(ctx, d.annotate(ctx, opGetStream, d.reader(ctx)), key)
+		} else {
+			r, err = d.openLargeObject(ctx, d.annotate(ctx, opGetStream, d.reader(ctx)), key)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// valueReader reads a value chunk by chunk, verifying it against its checksum
+// if it has one.
+type valueReader struct {
+	key   ds.Key
+	next  func() ([]byte, error) // returns io.EOF after the last chunk
+	close func() error
+	buf   []byte
+	sum   *int64
+	hash  hash.Hash32
+	err   error
+}
+
+func newValueReader(key ds.Key, sum *int64, next func() ([]byte, error), close func() error) *valueReader {
+	return &valueReader{key: key, next: next, close: close, sum: sum, hash: crc32.New(castagnoli)}
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.buf, r.err = r.next()
+		r.hash.Write(r.buf)
+		if r.err == io.EOF && r.sum != nil && *r.sum != int64(r.hash.Sum32()) {
+			r.buf, r.err = nil, &ChecksumError{Key: r.key}
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *valueReader) Close() error {
+	return r.close()
+}
+
+// openLargeObject opens a reader of the value of a key that may be stored in
+// a large object, in a transaction that the reader commits when it is closed.
+func (d *Datastore) openLargeObject(ctx context.Context, db querier, key ds.Key) (*valueReader, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sql := fmt.Sprintf("SELECT %s, %s, lo_open(lo, %d) FROM %s WHERE %s = $1%s", d.valueExpr(), d.checksumCol(), invRead, d.table, d.keyCol, d.notExpired())
+	var data []byte
+	var sum *int64
+	var fd *int32
+	err = tx.QueryRow(ctx, sql, d.keyArg(key.String())).Scan(&data, &sum, &fd)
+	if err != nil {
+		tx.Rollback(ctx)
+		if err == pgx.ErrNoRows {
+			return nil, ds.ErrNotFound
+		}
+		return nil, err
+	}
+	if fd == nil {
+		// the value is stored in the row
+		if err := tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		return newValueReader(key, sum, func() ([]byte, error) {
+			return data, io.EOF
+		}, func() error { return nil }), nil
+	}
+
+	next := func() ([]byte, error) {
+		var chunk []byte
+		err := tx.QueryRow(ctx, "SELECT loread($1, $2)", *fd, largeObjectChunkSize).Scan(&chunk)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) < largeObjectChunkSize {
+			return chunk, io.EOF
+		}
+		return chunk, nil
+	}
+	return newValueReader(key, sum, next, func() error { return tx.Commit(ctx) }), nil
+}
+
+// openChunks opens a reader of the value of a key that may be stored in
+// chunks. The row and its chunks are read by a single statement, whose rows
+// are received as the reader is read.
+func (d *Datastore) openChunks(ctx context.Context, db querier, key ds.Key) (*valueReader, error) {
+	sql := fmt.Sprintf(
+		"SELECT t.%s, %s, t.chunks, c.chunk FROM %s AS t LEFT JOIN %s AS c ON c.%s = t.%s WHERE t.%s = $1%s ORDER BY c.seq",
+		d.dataCol, d.checksumCol(), d.table, d.chunksTable(), d.keyCol, d.keyCol, d.keyCol, d.notExpired(),
+	)
+	rows, err := db.Query(ctx, sql, d.keyArg(key.String()))
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var sum *int64
+	var chunks *uint32
+	var chunk []byte
+	if !rows.Next() {
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ds.ErrNotFound
+	}
+	if err := rows.Scan(&data, &sum, &chunks, &chunk); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	if chunks == nil {
+		// the value is stored in the row
+		rows.Close()
+		return newValueReader(key, sum, func() ([]byte, error) {
+			return data, io.EOF
+		}, func() error { return nil }), nil
+	}
+
+	var n uint32
+	next := func() ([]byte, error) {
+		if n > 0 {
+			if !rows.Next() {
+				if err := rows.Err(); err != nil {
+					return nil, err
+				}
+				if n != *chunks {
+					return nil, fmt.Errorf("%w: %d chunks, expected %d", ErrCorruptValue, n, *chunks)
+				}
+				return nil, io.EOF
+			}
+			if err := rows.Scan(&data, &sum, &chunks, &chunk); err != nil {
+				return nil, err
+			}
+		}
+		n++
+		return chunk, nil
+	}
+	return newValueReader(key, sum, next, func() error {
+		rows.Close()
+		return rows.Err()
+	}), nil
+}
+
+// sizeLimitedReader reads a value and returns a *ValueTooLargeError once it
+// reads more than the maximum value size.
+type sizeLimitedReader struct {
+	d    *Datastore
+	key  ds.Key
+	r    io.Reader
+	read int64
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if serr := r.d.checkSize(r.key, r.read); serr != nil {
+		return n, serr
+	}
+	return n, err
+}
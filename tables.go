@@ -0,0 +1,141 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// namespaceTable is a table that stores the keys of a namespace.
+type namespaceTable struct {
+	prefix ds.Key
+	ds     *Datastore
+}
+
+// openNamespaceTables creates a datastore for each of the tables of
+// NamespaceTables, sharing the pool and replicas of the default table.
+func (d *Datastore) openNamespaceTables(ctx context.Context, pool *pgxpool.Pool, cfg Options) error {
+	for ns, table := range cfg.NamespaceTables {
+		if table == cfg.Table {
+			return fmt.Errorf("namespace table %s is the default table", table)
+		}
+		tcfg := cfg
+		tcfg.Table = table
+		tcfg.NamespaceTables = nil
+		tcfg.ReadReplicas = nil
+		tcfg.ReadReplicaPools = d.replicas
+		td, err := newDatastore(ctx, pool, tcfg)
+		if err != nil {
+			return fmt.Errorf("namespace table %s: %w", table, err)
+		}
+		d.tables = append(d.tables, namespaceTable{prefix: ds.RawKey(ns), ds: td})
+	}
+	// the longest namespace a key is in is found first
+	sort.Slice(d.tables, func(i, j int) bool {
+		return len(d.tables[i].prefix.String()) > len(d.tables[j].prefix.String())
+	})
+	return nil
+}
+
+// closeNamespaceTables closes the datastores of the namespace tables.
+func (d *Datastore) closeNamespaceTables() {
+	for _, t := range d.tables {
+		t.ds.Close()
+	}
+	d.tables = nil
+}
+
+// route returns the datastore of the table that stores the given key.
+func (d *Datastore) route(key ds.Key) *Datastore {
+	for _, t := range d.tables {
+		if t.prefix.Equal(key) || t.prefix.IsAncestorOf(key) {
+			return t.ds
+		}
+	}
+	return d
+}
+
+// routeKeys groups the given keys by the datastore of the table that stores
+// them.
+func (d *Datastore) routeKeys(keys []ds.Key) map[*Datastore][]ds.Key {
+	routed := map[*Datastore][]ds.Key{}
+	for _, k := range keys {
+		td := d.route(k)
+		routed[td] = append(routed[td], k)
+	}
+	return routed
+}
+
+// prefixTables returns the datastores of the tables that may have keys under
+// the given prefix: the table of the longest namespace the prefix is in, and
+// the tables of the namespaces in the prefix.
+func (d *Datastore) prefixTables(prefix ds.Key) []*Datastore {
+	tables := []*Datastore{d.route(prefix)}
+	for _, t := range d.tables {
+		if prefix.String() == "/" || prefix.IsAncestorOf(t.prefix) {
+			tables = append(tables, t.ds)
+		}
+	}
+	return tables
+}
+
+// queryTables returns the results of the query from every table that may
+// have keys with its prefix: the table of the longest namespace the prefix
+// is in, and the tables of the namespaces in the prefix. The results of the
+// tables are merged and sorted in memory, by key if the query has no orders,
+// as the results of a single table are. Each table is queried with the given
+// function.
+func (d *Datastore) queryTables(q dsq.Query, query func(*Datastore, dsq.Query) (dsq.Results, error)) (dsq.Results, error) {
+	sources := d.prefixTables(ds.NewKey(q.Prefix))
+	if len(sources) == 1 {
+		return query(sources[0], q)
+	}
+
+	// offset and limit apply to the merged results
+	tq := q
+	tq.Offset = 0
+	if q.Limit > 0 {
+		tq.Limit = q.Offset + q.Limit
+	}
+	// the tables are queried one after the other, as the results of a
+	// transaction must be closed before it runs another query
+	res, err := query(sources[0], tq)
+	if err != nil {
+		return nil, err
+	}
+	sources = sources[1:]
+	merged := dsq.ResultsFromIterator(tq, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				r, ok := res.NextSync()
+				if ok || len(sources) == 0 {
+					return r, ok
+				}
+				if err := res.Close(); err != nil {
+					return dsq.Result{Error: err}, true
+				}
+				res, err = query(sources[0], tq)
+				if err != nil {
+					res = dsq.ResultsWithEntries(tq, nil)
+					sources = nil
+					return dsq.Result{Error: err}, true
+				}
+				sources = sources[1:]
+			}
+		},
+		Close: func() error {
+			return res.Close()
+		},
+	})
+	orders := q.Orders
+	if len(orders) == 0 {
+		// pages selected by offset and limit are stable
+		orders = []dsq.Order{dsq.OrderByKey{}}
+	}
+	merged = dsq.NaiveQueryApply(dsq.Query{Orders: orders, Offset: q.Offset, Limit: q.Limit}, merged)
+	return dsq.ResultsReplaceQuery(merged, q), nil
+}
@@ -0,0 +1,81 @@
+package pgds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// tlsConfig returns the TLS configuration given by the options, or nil if
+// the connection string is to decide.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	if o.TLSConfig == nil && o.TLSRootCAFile == "" && o.TLSCertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if o.TLSConfig != nil {
+		config = o.TLSConfig.Clone()
+	}
+	if o.TLSRootCAFile != "" {
+		pem, err := os.ReadFile(o.TLSRootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS root CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid TLS root CA file %s: no certificates", o.TLSRootCAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client certificate: %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
+
+// configureTLS makes a pool connect to its hosts over TLS with the
+// configuration given by the options, instead of the ssl mode of the
+// connection string, verifying the server name of each host unless the
+// configuration names one.
+func (o *Options) configureTLS(config *pgxpool.Config) error {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+	forHost := func(host string) *tls.Config {
+		// TLS is not negotiated over Unix sockets
+		if strings.HasPrefix(host, "/") {
+			return nil
+		}
+		c := tlsConfig.Clone()
+		if c.ServerName == "" {
+			c.ServerName = host
+		}
+		return c
+	}
+
+	cc := config.ConnConfig
+	cc.TLSConfig = forHost(cc.Host)
+	// the ssl mode may have added attempts without TLS, which are dropped
+	seen := map[string]bool{fmt.Sprintf("%s:%d", cc.Host, cc.Port): true}
+	fallbacks := cc.Fallbacks[:0]
+	for _, fb := range cc.Fallbacks {
+		addr := fmt.Sprintf("%s:%d", fb.Host, fb.Port)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		fallbacks = append(fallbacks, &pgconn.FallbackConfig{Host: fb.Host, Port: fb.Port, TLSConfig: forHost(fb.Host)})
+	}
+	cc.Fallbacks = fallbacks
+	return nil
+}
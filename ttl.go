@@ -0,0 +1,157 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrTTLDisabled is returned by the TTL methods when the datastore was created
+// without the TTL option.
+var ErrTTLDisabled = errors.New("TTL support is not enabled")
+
+// notExpiredPredicate matches rows that have no expiration or have not yet expired.
+const notExpiredPredicate = "(expires_at IS NULL OR expires_at > now())"
+
+// notExpired returns a condition to append to a WHERE clause that excludes
+// expired rows, or an empty string if TTL support is disabled.
+func (d *Datastore) notExpired() string {
+	if !d.ttl {
+		return ""
+	}
+	return " AND " + notExpiredPredicate
+}
+
+// PutWithTTL "upserts" a row into the SQL database that expires after the
+// given duration.
+func (d *Datastore) PutWithTTL(ctx context.Context, key ds.Key, value []byte, ttl time.Duration) error {
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if td := d.route(key); td != d {
+		return td.PutWithTTL(ctx, key, value, ttl)
+	}
+	key = d.prefixKey(key)
+	if !d.ttl {
+		return ErrTTLDisabled
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	return d.do(ctx, opPutWithTTL, key.String(), func(ctx context.Context) error {
+		var err error
+		if d.large(value) {
+			err = d.putLarge(ctx, d.annotate(ctx, opPutWithTTL, d.pool), key, value, &ttl)
+		} else {
+			var sql string
+			var args []any
+			sql, args, err = d.upsertQuery(key, value, &ttl)
+			if err != nil {
+				return err
+			}
+			_, err = d.annotate(ctx, opPutWithTTL, d.pool).Exec(ctx, sql, args...)
+		}
+		if err == nil {
+			d.metrics.bytesWritten.Add(int64(len(value)))
+		}
+		return err
+	})
+}
+
+// SetTTL sets the expiration of an existing row to the given duration from now.
+func (d *Datastore) SetTTL(ctx context.Context, key ds.Key, ttl time.Duration) error {
+	if td := d.route(key); td != d {
+		return td.SetTTL(ctx, key, ttl)
+	}
+	key = d.prefixKey(key)
+	if !d.ttl {
+		return ErrTTLDisabled
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("UPDATE %s SET expires_at = now() + make_interval(secs => $2) WHERE %s = $1%s", d.table, d.keyCol, d.notExpired())
+	return d.do(ctx, opSetTTL, key.String(), func(ctx context.Context) error {
+		tag, err := d.annotate(ctx, opSetTTL, d.pool).Exec(ctx, sql, d.keyArg(key.String()), ttl.Seconds())
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ds.ErrNotFound
+		}
+		return nil
+	})
+}
+
+// GetExpiration returns the time at which the row for the given key expires.
+// The zero time is returned if the row does not expire.
+func (d *Datastore) GetExpiration(ctx context.Context, key ds.Key) (time.Time, error) {
+	if td := d.route(key); td != d {
+		return td.GetExpiration(ctx, key)
+	}
+	key = d.prefixKey(key)
+	if !d.ttl {
+		return time.Time{}, ErrTTLDisabled
+	}
+	sql := fmt.Sprintf("SELECT expires_at FROM %s WHERE %s = $1%s", d.table, d.keyCol, d.notExpired())
+	var expiration *time.Time
+	err := d.do(ctx, opGetExpiration, key.String(), func(ctx context.Context) error {
+		err := d.annotate(ctx, opGetExpiration, d.pool).QueryRow(ctx, sql, d.keyArg(key.String())).Scan(&expiration)
+		if err == pgx.ErrNoRows {
+			return ds.ErrNotFound
+		}
+		return err
+	})
+	if err != nil || expiration == nil {
+		return time.Time{}, err
+	}
+	return *expiration, nil
+}
+
+// sweep deletes expired rows in batches until none remain.
+func (d *Datastore) sweep(ctx context.Context) error {
+	sql := fmt.Sprintf("DELETE FROM %[1]s WHERE %[2]s IN (SELECT %[2]s FROM %[1]s WHERE expires_at <= now() LIMIT $1)", d.table, d.keyCol)
+	for {
+		tag, err := d.annotate(ctx, opSweep, d.pool).Exec(ctx, sql, d.sweepBatchSize)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() < int64(d.sweepBatchSize) {
+			return nil
+		}
+	}
+}
+
+// startSweeper starts a goroutine that deletes expired rows, and the values
+// of the content table that are no longer referenced, every interval until
+// the datastore is closed.
+func (d *Datastore) startSweeper(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.sweepCancel = cancel
+	d.sweepWg.Add(1)
+	go func() {
+		defer d.sweepWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// errors are retried on the next tick
+				if d.ttl {
+					_ = d.sweep(ctx)
+				}
+				if d.dedup {
+					_, _ = d.collectContent(ctx)
+				}
+			}
+		}
+	}()
+}
+
+var _ ds.TTLDatastore = (*Datastore)(nil)
@@ -0,0 +1,89 @@
+package pgds
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jackc/pgx/v5"
+)
+
+type txn struct {
+	ds *Datastore
+	tx pgx.Tx
+}
+
+// NewTransaction starts a new transaction. All operations performed on the
+// transaction run in a single PostgreSQL transaction and only take effect
+// when it is committed. A read-only transaction rejects writes.
+func (d *Datastore) NewTransaction(ctx context.Context, readOnly bool) (ds.Txn, error) {
+	opts := pgx.TxOptions{AccessMode: pgx.ReadWrite}
+	if readOnly {
+		opts.AccessMode = pgx.ReadOnly
+	}
+	tx, err := d.pool.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &txn{ds: d, tx: tx}, nil
+}
+
+func (t *txn) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	td := t.ds.route(key)
+	return td.get(ctx, t.tx, td.prefixKey(key), nil)
+}
+
+func (t *txn) Has(ctx context.Context, key ds.Key) (bool, error) {
+	td := t.ds.route(key)
+	return td.has(ctx, t.tx, td.prefixKey(key))
+}
+
+func (t *txn) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	td := t.ds.route(key)
+	return td.getSize(ctx, t.tx, td.prefixKey(key))
+}
+
+// Query runs a query inside the transaction. The results must be closed
+// before any other operation is performed on the transaction.
+func (t *txn) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	if len(t.ds.tables) > 0 {
+		return t.ds.queryTables(q, func(td *Datastore, tq dsq.Query) (dsq.Results, error) {
+			return td.prefixQuery(tq, func(pq dsq.Query) (dsq.Results, error) {
+				return td.query(ctx, t.tx, pq)
+			})
+		})
+	}
+	return t.ds.prefixQuery(q, func(pq dsq.Query) (dsq.Results, error) {
+		return t.ds.query(ctx, t.tx, pq)
+	})
+}
+
+func (t *txn) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := t.ds.writable(); err != nil {
+		return err
+	}
+	if err := t.ds.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	td := t.ds.route(key)
+	return td.put(ctx, t.tx, td.prefixKey(key), value)
+}
+
+func (t *txn) Delete(ctx context.Context, key ds.Key) error {
+	if err := t.ds.writable(); err != nil {
+		return err
+	}
+	td := t.ds.route(key)
+	return td.delete(ctx, t.tx, td.prefixKey(key))
+}
+
+func (t *txn) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t *txn) Discard(ctx context.Context) {
+	// rolling back a committed transaction is a no-op
+	_ = t.tx.Rollback(ctx)
+}
+
+var _ ds.TxnDatastore = (*Datastore)(nil)
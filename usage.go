@@ -0,0 +1,71 @@
+package pgds
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// PrefixUsage is the space used by the keys under a prefix.
+type PrefixUsage struct {
+	// Keys is the number of keys under the prefix.
+	Keys int64
+	// Bytes is the size of the keys and of their values as stored, after
+	// compression and including the values stored outside their rows. The
+	// values of deduplicated keys are counted as the size of their hashes.
+	Bytes int64
+	// IndexBytes is an estimate of the share of the indexes of the table
+	// used by the keys, in proportion to the estimated number of rows of
+	// the table. It is 0 on other dialects.
+	IndexBytes int64
+}
+
+// DiskUsageByPrefix returns the space used by the keys under the given
+// prefix, as a query with the prefix would match them, in the table and in
+// the tables of NamespaceTables. Every matching row is read to sum the sizes
+// of the keys and values, so that the space used by namespaces such as
+// /blocks, /datastore and /pins can be compared.
+func (d *Datastore) DiskUsageByPrefix(ctx context.Context, prefix ds.Key) (PrefixUsage, error) {
+	var total PrefixUsage
+	for _, td := range d.prefixTables(prefix) {
+		u, err := td.diskUsageByPrefix(ctx, prefix)
+		if err != nil {
+			return PrefixUsage{}, err
+		}
+		total.Keys += u.Keys
+		total.Bytes += u.Bytes
+		total.IndexBytes += u.IndexBytes
+	}
+	return total, nil
+}
+
+func (d *Datastore) diskUsageByPrefix(ctx context.Context, prefix ds.Key) (u PrefixUsage, err error) {
+	sql, args := d.countQuery(fmt.Sprintf("count(*), coalesce(sum(octet_length(%s) + coalesce(%s, 0)), 0)::bigint", d.keyCol, d.storedSizeExpr()), prefix)
+	err = d.do(ctx, opDiskUsage, prefix.String(), func(ctx context.Context) error {
+		db := d.annotate(ctx, opDiskUsage, d.reader(ctx))
+		err := db.QueryRow(ctx, sql, args...).Scan(&u.Keys, &u.Bytes)
+		if err != nil || d.dialect != DialectPostgres || u.Keys == 0 {
+			return err
+		}
+		// the share of the indexes is estimated from the number of rows the
+		// planner estimates the table has, which is not known before the
+		// table is analyzed
+		return db.QueryRow(ctx,
+			"SELECT coalesce((pg_indexes_size(oid) * least(1, $2 / nullif(greatest(reltuples, 0), 0)))::bigint, 0) FROM pg_class WHERE oid = $1::regclass",
+			d.table, float64(u.Keys)).Scan(&u.IndexBytes)
+	})
+	return u, err
+}
+
+// storedSizeExpr returns the expression of the size of the value of a row as
+// it is stored, including the value stored outside the row.
+func (d *Datastore) storedSizeExpr() string {
+	switch {
+	case d.loThreshold > 0:
+		return fmt.Sprintf("coalesce(octet_length(%s), lo_lseek64(lo_open(lo, %d), 0, 2))", d.dataCol, invRead)
+	case d.chunkSize > 0:
+		return fmt.Sprintf("coalesce(octet_length(%s), (SELECT sum(octet_length(chunk)) FROM %s WHERE %s = %s.%s))", d.dataCol, d.chunksTable(), d.keyCol, d.table, d.keyCol)
+	}
+	return fmt.Sprintf("octet_length(%s)", d.dataCol)
+}
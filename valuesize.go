@@ -0,0 +1,41 @@
+package pgds
+
+import (
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrValueTooLarge is matched with errors.Is by the errors of the puts of
+// values larger than the MaxValueSize option.
+var ErrValueTooLarge = errors.New("value too large")
+
+// ValueTooLargeError is returned by the puts of values larger than the
+// MaxValueSize option, which are not sent to the server.
+type ValueTooLargeError struct {
+	// Key is the key of the value.
+	Key ds.Key
+	// Size is the size of the value, or the size read so far by PutStream.
+	Size int64
+	// Max is the maximum size of a value.
+	Max int64
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value of %s is larger than the maximum of %d bytes: %d bytes", e.Key, e.Max, e.Size)
+}
+
+// Unwrap returns ErrValueTooLarge.
+func (e *ValueTooLargeError) Unwrap() error {
+	return ErrValueTooLarge
+}
+
+// checkSize returns a *ValueTooLargeError if a value of the given size cannot
+// be put.
+func (d *Datastore) checkSize(key ds.Key, size int64) error {
+	if d.maxValueSize > 0 && size > int64(d.maxValueSize) {
+		return &ValueTooLargeError{Key: key, Size: size, Max: int64(d.maxValueSize)}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package pgds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ChangeOp is the kind of change made to a row.
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is a change made to a row of the table, by this or any other process
+// sharing the database.
+type Change struct {
+	Key ds.Key
+	Op  ChangeOp
+	// Err is set on the last change sent if watching failed.
+	Err error
+}
+
+// notifyFunctionSQL creates the trigger function that publishes changes to the
+// channel given as its argument. Keys too long to fit in a notification
+// payload are not published rather than failing the write.
+const notifyFunctionSQL = `CREATE OR REPLACE FUNCTION pgds_notify_change() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		IF octet_length(OLD.key) < 7900 THEN
+			PERFORM pg_notify(TG_ARGV[0], 'D' || OLD.key);
+		END IF;
+	ELSIF octet_length(NEW.key) < 7900 THEN
+		PERFORM pg_notify(TG_ARGV[0], left(TG_OP, 1) || NEW.key);
+	END IF;
+	RETURN NULL;
+END
+$$`
+
+// quoteLiteral quotes a string for use as a SQL literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// channel returns the name of the notification channel changes to the table
+// are published on.
+func (d *Datastore) channel() string {
+	return strings.ReplaceAll(d.tableName, ".", "_") + "_changes"
+}
+
+// installNotifyTrigger creates the trigger that publishes changes to the
+// table, if it does not already exist.
+func (d *Datastore) installNotifyTrigger(ctx context.Context) error {
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, notifyFunctionSQL)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	err = tx.QueryRow(ctx, "SELECT exists(SELECT 1 FROM pg_trigger WHERE tgrelid = $1::regclass AND tgname = 'pgds_notify_change')", d.table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		sql := fmt.Sprintf(
+			"CREATE TRIGGER pgds_notify_change AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE pgds_notify_change(%s)",
+			d.table, quoteLiteral(d.channel()),
+		)
+		_, err = tx.Exec(ctx, sql)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42710" {
+			// created concurrently by another process
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// Watch returns a channel of the changes made to rows with keys under the
+// given prefix, until the context is canceled. It installs a trigger on the
+// table that publishes changes with NOTIFY, so the changes made by every
+// process sharing the table are observed. Changes are only published once
+// the transaction making them commits. Watching holds a dedicated connection,
+// outside of the pool, open.
+func (d *Datastore) Watch(ctx context.Context, prefix ds.Key) (<-chan Change, error) {
+	if err := d.supports("watch"); err != nil {
+		return nil, err
+	}
+	// notifications carry keys as text, from the key column of the shared
+	// trigger function
+	if d.byteaKeys || d.keyName != "key" {
+		return nil, fmt.Errorf("watch with bytea keys or another key column: %w", ErrUnsupported)
+	}
+	prefix = d.prefixKey(prefix)
+	// a read-only datastore relies on a writer having installed the trigger
+	if !d.readOnly {
+		err := d.installNotifyTrigger(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pc, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the connection is taken out of the pool as it is left listening
+	conn := pc.Hijack()
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{d.channel()}.Sanitize())
+	if err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+
+	changes := make(chan Change, 128)
+	go func() {
+		defer close(changes)
+		defer conn.Close(context.Background())
+		for {
+			n, err := conn.WaitForNotification(ctx)
+			if err != nil {
+				select {
+				case changes <- Change{Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if len(n.Payload) < 2 {
+				continue
+			}
+			change := Change{Key: ds.RawKey(n.Payload[1:])}
+			switch n.Payload[0] {
+			case 'I':
+				change.Op = ChangeInsert
+			case 'U':
+				change.Op = ChangeUpdate
+			case 'D':
+				change.Op = ChangeDelete
+			default:
+				continue
+			}
+			if !hasPrefix(change.Key, prefix) {
+				continue
+			}
+			change.Key = ds.RawKey(d.stripKey(change.Key.String()))
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// hasPrefix determines if key is under the given prefix, or is the prefix.
+func hasPrefix(key ds.Key, prefix ds.Key) bool {
+	return prefix.String() == "/" || key.Equal(prefix) || prefix.IsAncestorOf(key)
+}